@@ -0,0 +1,71 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageFieldPolicySpec defines where images live in a custom resource
+type ImageFieldPolicySpec struct {
+	// Group is the API group of the resource (e.g. "argoproj.io")
+	// +kubebuilder:validation:Required
+	Group string `json:"group"`
+	// Version is the API version of the resource (e.g. "v1alpha1")
+	// +kubebuilder:validation:Required
+	Version string `json:"version"`
+	// Kind is the kind of the resource (e.g. "Workflow")
+	// +kubebuilder:validation:Required
+	Kind string `json:"kind"`
+	// Resource is the plural resource name used to register the webhook rule (e.g. "workflows")
+	// +kubebuilder:validation:Required
+	Resource string `json:"resource"`
+	// ImagePaths are paths to image fields within the resource, made of dot separated
+	// field names where "[*]" matches every item of a list (e.g. "spec.templates[*].container.image")
+	// +kubebuilder:validation:MinItems=1
+	ImagePaths []string `json:"imagePaths"`
+}
+
+// ImageFieldPolicyStatus defines the observed state of ImageFieldPolicy
+type ImageFieldPolicyStatus struct {
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// ImageFieldPolicy is the Schema for the imagefieldpolicies API
+// +kubebuilder:resource:shortName=ifp,singular=imagefieldpolicy,scope=Cluster,categories={"imageswap","imgswap","imgswp"}
+type ImageFieldPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageFieldPolicySpec   `json:"spec,omitempty"`
+	Status ImageFieldPolicyStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ImageFieldPolicyList contains a list of ImageFieldPolicy
+type ImageFieldPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageFieldPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageFieldPolicy{}, &ImageFieldPolicyList{})
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"twr.dev/imgswap/api/v1beta1"
+)
+
+// SwapFromPullSecretsAnnotation holds the swapFrom.imagePullSecret of each
+// map, keyed by map name, on v1beta1 SwapMaps, which have no field for it, so
+// converting to v1beta1 and back doesn't lose it
+const SwapFromPullSecretsAnnotation = "maps.k8s.imgswap.io/swapfrom-image-pull-secrets"
+
+// matchTypes maps the v1alpha1 map types to v1beta1 match types
+var matchTypes = map[string]v1beta1.MatchType{
+	"default": v1beta1.MatchDefault,
+	"swap":    v1beta1.MatchPrefix,
+	"exact":   v1beta1.MatchExact,
+	"replace": v1beta1.MatchReplace,
+}
+
+// ConvertTo converts this SwapMap to the v1beta1 hub version.
+// swapFrom.imagePullSecret isn't used and is kept in the
+// SwapFromPullSecretsAnnotation.
+func (src *SwapMap) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1beta1.SwapMap)
+
+	dst.ObjectMeta = src.ObjectMeta
+	pullSecrets := map[string]string{}
+	for _, srcMap := range src.Spec.Maps {
+		if srcMap.SwapFrom.ImagePullSecret != "" {
+			pullSecrets[srcMap.Name] = srcMap.SwapFrom.ImagePullSecret
+		}
+	}
+	if len(pullSecrets) > 0 {
+		value, err := json.Marshal(pullSecrets)
+		if err != nil {
+			return err
+		}
+		dst.Annotations = make(map[string]string, len(src.Annotations)+1)
+		for k, v := range src.Annotations {
+			dst.Annotations[k] = v
+		}
+		dst.Annotations[SwapFromPullSecretsAnnotation] = string(value)
+	}
+
+	dst.Spec.Maps = nil
+	if src.Spec.Maps != nil {
+		dst.Spec.Maps = make([]v1beta1.Map, 0, len(src.Spec.Maps))
+	}
+	for _, srcMap := range src.Spec.Maps {
+		matchType, ok := matchTypes[srcMap.Type]
+		if !ok {
+			matchType = v1beta1.MatchType(srcMap.Type)
+		}
+		action := v1beta1.ActionSwap
+		if srcMap.NoSwap {
+			action = v1beta1.ActionNoSwap
+		}
+		match, err := toImageReference(srcMap.SwapFrom)
+		if err != nil {
+			return fmt.Errorf("map %q swapFrom: %w", srcMap.Name, err)
+		}
+		target, err := toImageReference(srcMap.SwapTo)
+		if err != nil {
+			return fmt.Errorf("map %q swapTo: %w", srcMap.Name, err)
+		}
+		canary, err := toCanary(srcMap.Canary)
+		if err != nil {
+			return fmt.Errorf("map %q canary.swapTo: %w", srcMap.Name, err)
+		}
+
+		dst.Spec.Maps = append(dst.Spec.Maps, v1beta1.Map{
+			Name: srcMap.Name,
+			Match: v1beta1.Match{
+				Type:              matchType,
+				ImageReference:    match,
+				Wildcards:         srcMap.Wildcards,
+				Containers:        toContainerSelector(srcMap.Containers),
+				NamespaceSelector: srcMap.NamespaceSelector,
+				PodSelector:       srcMap.PodSelector,
+			},
+			Action: action,
+			Target: v1beta1.Target{
+				ImageReference:  target,
+				ImagePullSecret: srcMap.SwapTo.ImagePullSecret,
+			},
+			Priority:    srcMap.Priority,
+			ActiveFrom:  srcMap.ActiveFrom,
+			ActiveUntil: srcMap.ActiveUntil,
+			Schedule:    (*v1beta1.Schedule)(srcMap.Schedule),
+			Canary:      canary,
+		})
+	}
+
+	dst.Spec.RestartPolicy = nil
+	if src.Spec.RestartPolicy != nil {
+		dst.Spec.RestartPolicy = &v1beta1.RestartPolicy{
+			Mode:                 src.Spec.RestartPolicy.Mode,
+			MaxRestartsPerMinute: src.Spec.RestartPolicy.MaxRestartsPerMinute,
+		}
+	}
+	dst.Spec.Mode = src.Spec.Mode
+
+	dst.Status = v1beta1.SwapMapStatus{
+		ObservedGeneration: src.Status.ObservedGeneration,
+		Maps:               src.Status.Maps,
+		Conflicts:          src.Status.Conflicts,
+		ActiveMaps:         src.Status.ActiveMaps,
+		Mode:               src.Status.Mode,
+		LastReconcileTime:  src.Status.LastReconcileTime,
+		Conditions:         src.Status.Conditions,
+	}
+	if src.Status.Canaries != nil {
+		dst.Status.Canaries = make([]v1beta1.CanaryStatus, 0, len(src.Status.Canaries))
+		for _, canary := range src.Status.Canaries {
+			dst.Status.Canaries = append(dst.Status.Canaries, v1beta1.CanaryStatus(canary))
+		}
+	}
+
+	return nil
+}
+
+// ConvertFrom converts from the v1beta1 hub version to this version
+func (dst *SwapMap) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1beta1.SwapMap)
+
+	dst.ObjectMeta = src.ObjectMeta
+	pullSecrets := map[string]string{}
+	if value, ok := src.Annotations[SwapFromPullSecretsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &pullSecrets); err != nil {
+			return fmt.Errorf("invalid %s annotation: %w", SwapFromPullSecretsAnnotation, err)
+		}
+		dst.Annotations = make(map[string]string, len(src.Annotations)-1)
+		for k, v := range src.Annotations {
+			if k != SwapFromPullSecretsAnnotation {
+				dst.Annotations[k] = v
+			}
+		}
+	}
+
+	dst.Spec.Maps = nil
+	if src.Spec.Maps != nil {
+		dst.Spec.Maps = make([]Map, 0, len(src.Spec.Maps))
+	}
+	for _, srcMap := range src.Spec.Maps {
+		mapType := string(srcMap.Match.Type)
+		for alphaType, matchType := range matchTypes {
+			if matchType == srcMap.Match.Type {
+				mapType = alphaType
+			}
+		}
+
+		swapFrom := fromImageReference(srcMap.Match.ImageReference)
+		swapFrom.ImagePullSecret = pullSecrets[srcMap.Name]
+		swapTo := fromImageReference(srcMap.Target.ImageReference)
+		swapTo.ImagePullSecret = srcMap.Target.ImagePullSecret
+		dst.Spec.Maps = append(dst.Spec.Maps, Map{
+			Name:              srcMap.Name,
+			Type:              mapType,
+			SwapFrom:          swapFrom,
+			SwapTo:            swapTo,
+			Wildcards:         srcMap.Match.Wildcards,
+			NoSwap:            srcMap.Action == v1beta1.ActionNoSwap,
+			Priority:          srcMap.Priority,
+			ActiveFrom:        srcMap.ActiveFrom,
+			ActiveUntil:       srcMap.ActiveUntil,
+			Schedule:          (*Schedule)(srcMap.Schedule),
+			Canary:            fromCanary(srcMap.Canary),
+			Containers:        fromContainerSelector(srcMap.Match.Containers),
+			NamespaceSelector: srcMap.Match.NamespaceSelector,
+			PodSelector:       srcMap.Match.PodSelector,
+		})
+	}
+
+	dst.Spec.RestartPolicy = nil
+	if src.Spec.RestartPolicy != nil {
+		dst.Spec.RestartPolicy = &RestartPolicy{
+			Mode:                 src.Spec.RestartPolicy.Mode,
+			MaxRestartsPerMinute: src.Spec.RestartPolicy.MaxRestartsPerMinute,
+		}
+	}
+	dst.Spec.Mode = src.Spec.Mode
+
+	dst.Status = SwapMapStatus{
+		ObservedGeneration: src.Status.ObservedGeneration,
+		Maps:               src.Status.Maps,
+		Conflicts:          src.Status.Conflicts,
+		ActiveMaps:         src.Status.ActiveMaps,
+		Mode:               src.Status.Mode,
+		LastReconcileTime:  src.Status.LastReconcileTime,
+		Conditions:         src.Status.Conditions,
+	}
+	if src.Status.Canaries != nil {
+		dst.Status.Canaries = make([]CanaryStatus, 0, len(src.Status.Canaries))
+		for _, canary := range src.Status.Canaries {
+			dst.Status.Canaries = append(dst.Status.Canaries, CanaryStatus(canary))
+		}
+	}
+
+	return nil
+}
+
+func toCanary(canary *Canary) (*v1beta1.Canary, error) {
+	if canary == nil {
+		return nil, nil
+	}
+	imageRef, err := toImageReference(canary.SwapTo)
+	if err != nil {
+		return nil, err
+	}
+	return &v1beta1.Canary{
+		Percent: canary.Percent,
+		Target: v1beta1.Target{
+			ImageReference:  imageRef,
+			ImagePullSecret: canary.SwapTo.ImagePullSecret,
+		},
+	}, nil
+}
+
+func fromCanary(canary *v1beta1.Canary) *Canary {
+	if canary == nil {
+		return nil
+	}
+	swapTo := fromImageReference(canary.Target.ImageReference)
+	swapTo.ImagePullSecret = canary.Target.ImagePullSecret
+	return &Canary{Percent: canary.Percent, SwapTo: swapTo}
+}
+
+// toImageReference splits the image of a SwapRef into name, tag and digest.
+// Images that can't be split into parts valid for v1beta1 and joined back
+// the same way, such as "nginx:" with an empty tag, are rejected.
+func toImageReference(ref SwapRef) (v1beta1.ImageReference, error) {
+	imageRef := v1beta1.ImageReference{Registry: ref.Registry, Project: ref.Project}
+
+	name, digest, _ := strings.Cut(ref.Image, "@")
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name, imageRef.Tag = name[:i], name[i+1:]
+	}
+	imageRef.Name, imageRef.Digest = name, digest
+	if strings.ContainsAny(imageRef.Name, ":@") || strings.Contains(imageRef.Digest, "@") || joinImage(imageRef) != ref.Image {
+		return v1beta1.ImageReference{}, fmt.Errorf("image %q isn't a name with an optional tag and digest", ref.Image)
+	}
+	return imageRef, nil
+}
+
+// fromImageReference joins the name, tag and digest of an ImageReference
+// into the image of a SwapRef
+func fromImageReference(imageRef v1beta1.ImageReference) SwapRef {
+	return SwapRef{Registry: imageRef.Registry, Project: imageRef.Project, Image: joinImage(imageRef)}
+}
+
+func joinImage(imageRef v1beta1.ImageReference) string {
+	image := imageRef.Name
+	if imageRef.Tag != "" {
+		image += ":" + imageRef.Tag
+	}
+	if imageRef.Digest != "" {
+		image += "@" + imageRef.Digest
+	}
+	return image
+}
+
+func toContainerSelector(selector *ContainerSelector) *v1beta1.ContainerSelector {
+	if selector == nil {
+		return nil
+	}
+	dst := &v1beta1.ContainerSelector{
+		Names:        selector.Names,
+		ExcludeNames: selector.ExcludeNames,
+		PullPolicies: selector.PullPolicies,
+	}
+	if selector.Kinds != nil {
+		dst.Kinds = make([]v1beta1.ContainerKind, 0, len(selector.Kinds))
+		for _, kind := range selector.Kinds {
+			dst.Kinds = append(dst.Kinds, v1beta1.ContainerKind(kind))
+		}
+	}
+	return dst
+}
+
+func fromContainerSelector(selector *v1beta1.ContainerSelector) *ContainerSelector {
+	if selector == nil {
+		return nil
+	}
+	dst := &ContainerSelector{
+		Names:        selector.Names,
+		ExcludeNames: selector.ExcludeNames,
+		PullPolicies: selector.PullPolicies,
+	}
+	if selector.Kinds != nil {
+		dst.Kinds = make([]ContainerKind, 0, len(selector.Kinds))
+		for _, kind := range selector.Kinds {
+			dst.Kinds = append(dst.Kinds, ContainerKind(kind))
+		}
+	}
+	return dst
+}
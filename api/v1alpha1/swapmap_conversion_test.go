@@ -0,0 +1,203 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	fuzz "github.com/google/gofuzz"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"twr.dev/imgswap/api/v1beta1"
+)
+
+const conversionFuzzIterations = 1000
+
+// swapMapFuzzer fills SwapMaps of both versions with values valid for their
+// schema, so the conversion has to preserve everything it is given
+func swapMapFuzzer() *fuzz.Fuzzer {
+	return fuzz.New().NilChance(0.2).NumElements(0, 4).Funcs(
+		func(typeMeta *metav1.TypeMeta, c fuzz.Continue) {
+			// Conversion doesn't carry the apiVersion and kind, the scheme sets them
+			*typeMeta = metav1.TypeMeta{}
+		},
+		func(spec *SwapMapSpec, c fuzz.Continue) {
+			c.FuzzNoCustom(spec)
+			// Maps are keyed by name
+			for i := range spec.Maps {
+				spec.Maps[i].Name += "-" + strconv.Itoa(i)
+			}
+		},
+		func(mapSpec *Map, c fuzz.Continue) {
+			c.FuzzNoCustom(mapSpec)
+			mapSpec.Type = []string{"default", "swap", "exact", "replace"}[c.Intn(4)]
+		},
+		func(ref *SwapRef, c fuzz.Continue) {
+			c.FuzzNoCustom(ref)
+			// Exercise images with and without tags and digests, as allowed
+			// by the schema
+			ref.Image = strings.NewReplacer(":", "", "@", "").Replace(ref.Image)
+			if c.RandBool() {
+				ref.Image += ":" + strings.NewReplacer(":", "", "@", "").Replace(c.RandString()) + "t"
+			}
+			if c.RandBool() {
+				ref.Image += "@sha256:" + strings.ReplaceAll(c.RandString(), "@", "")
+			}
+		},
+		func(mapSpec *v1beta1.Map, c fuzz.Continue) {
+			c.FuzzNoCustom(mapSpec)
+			mapSpec.Match.Type = []v1beta1.MatchType{
+				v1beta1.MatchDefault, v1beta1.MatchPrefix, v1beta1.MatchExact, v1beta1.MatchReplace,
+			}[c.Intn(4)]
+			mapSpec.Action = []v1beta1.Action{v1beta1.ActionSwap, v1beta1.ActionNoSwap}[c.Intn(2)]
+		},
+		func(imageRef *v1beta1.ImageReference, c fuzz.Continue) {
+			c.FuzzNoCustom(imageRef)
+			// The schema forbids the separators within the parts
+			imageRef.Name = strings.NewReplacer(":", "", "@", "").Replace(imageRef.Name)
+			imageRef.Tag = strings.NewReplacer(":", "", "@", "").Replace(imageRef.Tag)
+			imageRef.Digest = strings.ReplaceAll(imageRef.Digest, "@", "")
+		},
+	)
+}
+
+func TestSwapMapConversionRoundTripFromSpoke(t *testing.T) {
+	fuzzer := swapMapFuzzer()
+	for i := 0; i < conversionFuzzIterations; i++ {
+		original := &SwapMap{}
+		fuzzer.Fuzz(original)
+
+		hub := &v1beta1.SwapMap{}
+		if err := original.DeepCopy().ConvertTo(hub); err != nil {
+			t.Fatalf("ConvertTo: %v", err)
+		}
+		converted := &SwapMap{}
+		if err := converted.ConvertFrom(hub); err != nil {
+			t.Fatalf("ConvertFrom: %v", err)
+		}
+
+		if !apiequality.Semantic.DeepEqual(original, converted) {
+			t.Fatalf("v1alpha1 -> v1beta1 -> v1alpha1 changed the SwapMap (-original +converted):\n%s", cmp.Diff(original, converted))
+		}
+	}
+}
+
+func TestSwapMapConversionRoundTripFromHub(t *testing.T) {
+	fuzzer := swapMapFuzzer()
+	for i := 0; i < conversionFuzzIterations; i++ {
+		original := &v1beta1.SwapMap{}
+		fuzzer.Fuzz(original)
+
+		spoke := &SwapMap{}
+		if err := spoke.ConvertFrom(original.DeepCopy()); err != nil {
+			t.Fatalf("ConvertFrom: %v", err)
+		}
+		converted := &v1beta1.SwapMap{}
+		if err := spoke.ConvertTo(converted); err != nil {
+			t.Fatalf("ConvertTo: %v", err)
+		}
+
+		if !apiequality.Semantic.DeepEqual(original, converted) {
+			t.Fatalf("v1beta1 -> v1alpha1 -> v1beta1 changed the SwapMap (-original +converted):\n%s", cmp.Diff(original, converted))
+		}
+	}
+}
+
+func TestSwapMapConversion(t *testing.T) {
+	spoke := &SwapMap{
+		Spec: SwapMapSpec{
+			Maps: []Map{
+				{Name: "default", Type: "default", NoSwap: true},
+				{
+					Name:              "nginx",
+					Type:              "exact",
+					SwapFrom:          SwapRef{Registry: "docker.io", Project: "library", Image: "nginx:1.25", ImagePullSecret: "unused"},
+					SwapTo:            SwapRef{Registry: "harbor.example.com", Project: "dockerhub", Image: "nginx@sha256:abc", ImagePullSecret: "harbor"},
+					Priority:          10,
+					NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "web"}},
+					PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}},
+				},
+			},
+		},
+	}
+
+	hub := &v1beta1.SwapMap{}
+	if err := spoke.ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+
+	want := []v1beta1.Map{
+		{
+			Name:   "default",
+			Match:  v1beta1.Match{Type: v1beta1.MatchDefault},
+			Action: v1beta1.ActionNoSwap,
+		},
+		{
+			Name: "nginx",
+			Match: v1beta1.Match{
+				Type:              v1beta1.MatchExact,
+				ImageReference:    v1beta1.ImageReference{Registry: "docker.io", Project: "library", Name: "nginx", Tag: "1.25"},
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "web"}},
+				PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}},
+			},
+			Action: v1beta1.ActionSwap,
+			Target: v1beta1.Target{
+				ImageReference:  v1beta1.ImageReference{Registry: "harbor.example.com", Project: "dockerhub", Name: "nginx", Digest: "sha256:abc"},
+				ImagePullSecret: "harbor",
+			},
+			Priority: 10,
+		},
+	}
+	if diff := cmp.Diff(want, hub.Spec.Maps); diff != "" {
+		t.Errorf("unexpected v1beta1 maps (-want +got):\n%s", diff)
+	}
+	if got := hub.Annotations[SwapFromPullSecretsAnnotation]; got != `{"nginx":"unused"}` {
+		t.Errorf("%s annotation = %q, want the swapFrom.imagePullSecret of the nginx map", SwapFromPullSecretsAnnotation, got)
+	}
+}
+
+func FuzzImageReference(f *testing.F) {
+	for _, image := range []string{"", "nginx", "nginx:1.25", "nginx@sha256:abc", "nginx:1.25@sha256:abc", ":1.25", "nginx:", "nginx@", "nginx:@sha256:abc", "nginx:1:2", "nginx@sha256@abc"} {
+		f.Add(image)
+	}
+	f.Fuzz(func(t *testing.T, image string) {
+		imageRef, err := toImageReference(SwapRef{Image: image})
+		if err != nil {
+			return
+		}
+		// Anything converted has to be valid for v1beta1 and convert back unchanged
+		if strings.ContainsAny(imageRef.Name, ":@") || strings.ContainsAny(imageRef.Tag, ":@") || strings.Contains(imageRef.Digest, "@") {
+			t.Errorf("%q converted to %+v, invalid for v1beta1", image, imageRef)
+		}
+		if back := fromImageReference(imageRef).Image; back != image {
+			t.Errorf("%q converted to %+v and back to %q", image, imageRef, back)
+		}
+	})
+}
+
+func TestSwapMapConversionInvalidImage(t *testing.T) {
+	for _, image := range []string{"nginx:", "nginx@", "nginx:1:2", "nginx@sha256@abc"} {
+		spoke := &SwapMap{Spec: SwapMapSpec{Maps: []Map{{Name: "nginx", Type: "exact", SwapFrom: SwapRef{Image: image}}}}}
+		if err := spoke.ConvertTo(&v1beta1.SwapMap{}); err == nil {
+			t.Errorf("converted a map with image %q to v1beta1", image)
+		}
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -25,18 +26,32 @@ import (
 
 // SwapRef defines the information to reference one or more images to be swapped
 type SwapRef struct {
-	// Registry is the registry to target (e.g. "docker.io", "quay.io", "ghcr.io")
+	// Registry is the registry to target (e.g. "docker.io", "quay.io", "ghcr.io"), a hostname with an
+	// optional port. On replace maps it is the string to replace, or to replace it with, instead.
+	// +kubebuilder:validation:MaxLength=255
 	// +kubebuilder:validation:Optional
 	Registry string `json:"registry"`
 	// Project is the project to target (e.g. "nginx", "library", "team1/project2")
 	// +kubebuilder:validation:Optional
 	Project string `json:"project"`
 	// Image is the image to target (e.g. "nginx", "nginx:latest", "nginx:1.19.6")
+	// +kubebuilder:validation:Pattern=`^[^:@]*(:[^:@]+)?(@[^@]+)?$`
 	// +kubebuilder:validation:Optional
 	Image string `json:"image"`
+	// ImagePullSecret is the name of a Secret holding credentials for the target registry. When set on
+	// swapTo it is added to the imagePullSecrets of every pod with an image swapped by the map.
+	// Only used on swapTo.
+	// +kubebuilder:validation:Optional
+	ImagePullSecret string `json:"imagePullSecret,omitempty"`
 }
 
 // Map defines a single swap map
+// +kubebuilder:validation:XValidation:rule="self.type == 'replace' || !has(self.swapFrom) || !has(self.swapFrom.registry) || size(self.swapFrom.registry) == 0 || self.swapFrom.registry.matches('^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?([.][a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?$')",message="swapFrom.registry must be a hostname with an optional port (e.g. \"registry.example.com:5000\")"
+// +kubebuilder:validation:XValidation:rule="self.type == 'replace' || !has(self.swapTo) || !has(self.swapTo.registry) || size(self.swapTo.registry) == 0 || self.swapTo.registry.matches('^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?([.][a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?$')",message="swapTo.registry must be a hostname with an optional port (e.g. \"registry.example.com:5000\")"
+// +kubebuilder:validation:XValidation:rule="self.type == 'replace' || !has(self.canary) || !has(self.canary.swapTo) || !has(self.canary.swapTo.registry) || size(self.canary.swapTo.registry) == 0 || self.canary.swapTo.registry.matches('^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?([.][a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?$')",message="canary.swapTo.registry must be a hostname with an optional port (e.g. \"registry.example.com:5000\")"
+// +kubebuilder:validation:XValidation:rule="self.type != 'swap' || (has(self.swapFrom) && has(self.swapFrom.registry) && size(self.swapFrom.registry) > 0)",message="swap maps require swapFrom.registry"
+// +kubebuilder:validation:XValidation:rule="self.type != 'default' || self.name == 'default'",message="default maps must be named \"default\""
+// +kubebuilder:validation:XValidation:rule="!has(self.noSwap) || !self.noSwap || !has(self.swapTo) || ((!has(self.swapTo.registry) || size(self.swapTo.registry) == 0) && (!has(self.swapTo.project) || size(self.swapTo.project) == 0) && (!has(self.swapTo.image) || size(self.swapTo.image) == 0) && (!has(self.swapTo.imagePullSecret) || size(self.swapTo.imagePullSecret) == 0))",message="noSwap and swapTo are mutually exclusive"
 type Map struct {
 	// Name is the name of the swap map
 	// +kubebuilder:validation:Required
@@ -59,6 +74,123 @@ type Map struct {
 	// NoSwap is a boolean that, when true, prevents swapping of the target image(s)
 	// +kubebuilder:validation:Optional
 	NoSwap bool `json:"noSwap,omitempty"`
+	// Priority orders "replace" and wildcard maps when more than one matches an
+	// image, highest first. Maps with the same priority are tried in key order.
+	// +kubebuilder:validation:Optional
+	Priority int32 `json:"priority,omitempty"`
+	// ActiveFrom is when the map starts being used. The map is ignored before then.
+	// +kubebuilder:validation:Optional
+	ActiveFrom *metav1.Time `json:"activeFrom,omitempty"`
+	// ActiveUntil is when the map stops being used. The map is ignored from then on.
+	// +kubebuilder:validation:Optional
+	ActiveUntil *metav1.Time `json:"activeUntil,omitempty"`
+	// Schedule limits the map to recurring windows, such as maintenance windows.
+	// It applies within activeFrom and activeUntil when they are set.
+	// +kubebuilder:validation:Optional
+	Schedule *Schedule `json:"schedule,omitempty"`
+	// Canary rolls the map out to a share of pods only
+	// +kubebuilder:validation:Optional
+	Canary *Canary `json:"canary,omitempty"`
+	// Containers limits the map to some of a pod's containers, for example to
+	// leave sidecars alone. Images the map matches in other containers, or
+	// outside pod containers such as in custom resources, aren't swapped.
+	// +kubebuilder:validation:Optional
+	Containers *ContainerSelector `json:"containers,omitempty"`
+	// NamespaceSelector limits the map to pods in namespaces with matching
+	// labels. Images the map matches in other namespaces, or outside pods such
+	// as in custom resources, aren't swapped.
+	// +kubebuilder:validation:Optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// PodSelector limits the map to pods, and the pod templates of workloads,
+	// with matching labels. Images the map matches in other pods, or outside
+	// pods such as in custom resources, aren't swapped.
+	// +kubebuilder:validation:Optional
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+}
+
+// Schedule defines recurring windows during which a map is used
+type Schedule struct {
+	// Cron is a standard five field cron expression (minute, hour, day of month,
+	// month, day of week), evaluated in UTC, giving the start of each window
+	// (e.g. "0 2 * * 6" for 02:00 every Saturday)
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:Required
+	Cron string `json:"cron"`
+	// Duration is how long each window lasts (e.g. "4h")
+	// +kubebuilder:validation:Required
+	Duration metav1.Duration `json:"duration"`
+}
+
+const (
+	// SwapMapModeEnforce swaps the images matched by a SwapMap's maps
+	SwapMapModeEnforce = "Enforce"
+	// SwapMapModeAudit only reports what a SwapMap's maps would swap
+	SwapMapModeAudit = "Audit"
+)
+
+// ContainerKind is the kind of a container in a pod
+// +kubebuilder:validation:Enum=Init;Regular;Ephemeral
+type ContainerKind string
+
+const (
+	// ContainerKindInit is a container in spec.initContainers
+	ContainerKindInit ContainerKind = "Init"
+	// ContainerKindRegular is a container in spec.containers
+	ContainerKindRegular ContainerKind = "Regular"
+	// ContainerKindEphemeral is a container in spec.ephemeralContainers
+	ContainerKindEphemeral ContainerKind = "Ephemeral"
+)
+
+// ContainerSelector limits a map to some of the containers of a pod. A
+// container must meet every criterion that is set.
+type ContainerSelector struct {
+	// Names are glob patterns (e.g. "app-*") matched against container names.
+	// When set the map only applies to containers matching one of them.
+	// +kubebuilder:validation:MaxItems=64
+	// +kubebuilder:validation:Optional
+	Names []string `json:"names,omitempty"`
+	// ExcludeNames are glob patterns of containers the map doesn't apply to,
+	// such as injected sidecars (e.g. "istio-proxy", "vault-agent*")
+	// +kubebuilder:validation:MaxItems=64
+	// +kubebuilder:validation:Optional
+	ExcludeNames []string `json:"excludeNames,omitempty"`
+	// Kinds limits the map to init, regular or ephemeral containers
+	// +kubebuilder:validation:MaxItems=3
+	// +kubebuilder:validation:Optional
+	Kinds []ContainerKind `json:"kinds,omitempty"`
+	// PullPolicies limits the map to containers with one of these image pull
+	// policies. Containers without a pull policy get the Kubernetes default:
+	// Always for untagged and "latest" images, IfNotPresent otherwise.
+	// +kubebuilder:validation:XValidation:rule="self.all(p, p in ['Always', 'IfNotPresent', 'Never'])",message="pull policies must be Always, IfNotPresent or Never"
+	// +kubebuilder:validation:MaxItems=3
+	// +kubebuilder:validation:Optional
+	PullPolicies []corev1.PullPolicy `json:"pullPolicies,omitempty"`
+}
+
+// Canary defines a gradual rollout of a map to a share of pods
+type Canary struct {
+	// Percent is the share of pods, from 0 to 100, in the canary group. Pods
+	// are assigned by hashing the UID of their controller, such as a ReplicaSet,
+	// or the namespace and name of pods without one, so every pod of a
+	// controller is in the same group, and raising the percentage only moves
+	// pods from the control group to the canary group.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	// +kubebuilder:validation:Required
+	Percent int32 `json:"percent"`
+	// SwapTo is the new target canary pods are swapped to, while the control
+	// pods are still swapped to the map's swapTo. When empty canary pods are
+	// swapped to the map's swapTo and control pods are left unchanged.
+	// +kubebuilder:validation:Optional
+	SwapTo SwapRef `json:"swapTo,omitempty"`
+}
+
+// CanaryStatus is the rollout of a map with a canary
+type CanaryStatus struct {
+	// Map is the name of the map
+	Map string `json:"map"`
+	// Percent is the share of pods in the canary group
+	Percent int32 `json:"percent"`
 }
 
 // SwapMapSpec defines the desired state of SwapMap
@@ -68,19 +200,85 @@ type SwapMapSpec struct {
 
 	// Maps is a list of Swap mappings to control how ImageSwap operates
 	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MaxItems=1000
 	// +listType=map
 	// +listMapKey=name
 	Maps []Map `json:"maps"`
+
+	// RestartPolicy controls whether workloads already running images the maps
+	// would now swap are restarted after the SwapMap changes
+	// +kubebuilder:validation:Optional
+	RestartPolicy *RestartPolicy `json:"restartPolicy,omitempty"`
+
+	// Mode is "Enforce" to swap the images the maps match or "Audit" to only
+	// report what would be swapped, through metrics, the audit log and
+	// imgswapctl, without changing any image
+	// +kubebuilder:default="Enforce"
+	// +kubebuilder:validation:Enum={"Enforce","Audit"}
+	// +kubebuilder:validation:Optional
+	Mode string `json:"mode,omitempty"`
+}
+
+// RestartPolicy defines how workloads are restarted to pick up a SwapMap's maps
+type RestartPolicy struct {
+	// Mode is "Never" to leave running workloads alone or "Rollout" to rollout
+	// restart the Deployments, StatefulSets and DaemonSets owning pods with images
+	// the SwapMap's maps would now swap
+	// +kubebuilder:default="Never"
+	// +kubebuilder:validation:Enum={"Never","Rollout"}
+	// +kubebuilder:validation:Optional
+	Mode string `json:"mode,omitempty"`
+	// MaxRestartsPerMinute limits how many workloads are restarted each minute
+	// +kubebuilder:default=5
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Optional
+	MaxRestartsPerMinute int32 `json:"maxRestartsPerMinute,omitempty"`
 }
 
 // SwapMapStatus defines the observed state of SwapMap
 type SwapMapStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// ObservedGeneration is the generation of the SwapMap last loaded
+	// +kubebuilder:validation:Optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Maps is how many of the SwapMap's maps are loaded
+	// +kubebuilder:validation:Optional
+	Maps int32 `json:"maps"`
+	// Conflicts is how many of the SwapMap's maps lost their key to a map
+	// loaded from another source
+	// +kubebuilder:validation:Optional
+	Conflicts int32 `json:"conflicts"`
+	// ActiveMaps is how many of the SwapMap's maps were within their
+	// activeFrom, activeUntil and schedule when it was last reconciled
+	// +kubebuilder:validation:Optional
+	ActiveMaps int32 `json:"activeMaps"`
+	// Canaries is the current rollout percentage of each map with a canary
+	// +kubebuilder:validation:Optional
+	Canaries []CanaryStatus `json:"canaries,omitempty"`
+	// Mode is the mode the maps were loaded in, "Enforce" or "Audit"
+	// +kubebuilder:validation:Optional
+	Mode string `json:"mode,omitempty"`
+	// LastReconcileTime is when the maps were last loaded
+	// +kubebuilder:validation:Optional
+	LastReconcileTime *metav1.Time `json:"lastReconcileTime,omitempty"`
+	// Conditions holds the "Ready" condition, true when every map is loaded
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Maps",type=integer,JSONPath=`.status.maps`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Conflicts",type=integer,JSONPath=`.status.conflicts`
+//+kubebuilder:printcolumn:name="Mode",type=string,JSONPath=`.status.mode`
+//+kubebuilder:printcolumn:name="Last Reconcile",type=date,JSONPath=`.status.lastReconcileTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+//+kubebuilder:storageversion
 
 // SwapMap is the Schema for the swapmaps API
 // +kubebuilder:resource:shortName=sm,singular=swapmap,scope=Namespaced,categories={"all","imageswap","imgswap","imgswp"}
@@ -0,0 +1,97 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SwapReportSpec defines the desired state of SwapReport
+type SwapReportSpec struct {
+}
+
+// DriftedContainer is a running container whose image the loaded maps would swap
+type DriftedContainer struct {
+	// Name is the name of the container
+	Name string `json:"name"`
+	// Image is the image the container is running
+	Image string `json:"image"`
+	// ExpectedImage is the image the loaded maps would swap Image to
+	ExpectedImage string `json:"expectedImage"`
+	// Map is the name of the map that would swap the image
+	Map string `json:"map"`
+}
+
+// DriftedPod is a running pod with at least one drifted container
+type DriftedPod struct {
+	// Namespace is the namespace of the pod
+	Namespace string `json:"namespace"`
+	// Name is the name of the pod
+	Name string `json:"name"`
+	// Owner is the "Kind/name" of the pod's controller, if any
+	// +optional
+	Owner string `json:"owner,omitempty"`
+	// Containers are the pod's drifted containers
+	Containers []DriftedContainer `json:"containers"`
+}
+
+// SwapReportStatus defines the observed state of SwapReport
+type SwapReportStatus struct {
+	// LastScanTime is when the last drift scan finished
+	// +optional
+	LastScanTime *metav1.Time `json:"lastScanTime,omitempty"`
+	// ScannedPods is the number of pods checked by the last scan
+	ScannedPods int32 `json:"scannedPods"`
+	// DriftedPods is the number of pods found running images the loaded maps would swap
+	DriftedPods int32 `json:"driftedPods"`
+	// Pods lists the drifted pods, up to a limit
+	// +optional
+	Pods []DriftedPod `json:"pods,omitempty"`
+	// Truncated is true when more pods drifted than are listed in Pods
+	// +optional
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// SwapReport is the Schema for the swapreports API. Its status is written by
+// the drift scanner and lists running pods whose images don't match the maps.
+// +kubebuilder:resource:shortName=swr,singular=swapreport,scope=Cluster,categories={"imageswap","imgswap","imgswp"}
+// +kubebuilder:printcolumn:name="Scanned",type=integer,JSONPath=`.status.scannedPods`
+// +kubebuilder:printcolumn:name="Drifted",type=integer,JSONPath=`.status.driftedPods`
+// +kubebuilder:printcolumn:name="Last Scan",type=date,JSONPath=`.status.lastScanTime`
+type SwapReport struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SwapReportSpec   `json:"spec,omitempty"`
+	Status SwapReportStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SwapReportList contains a list of SwapReport
+type SwapReportList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SwapReport `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SwapReport{}, &SwapReportList{})
+}
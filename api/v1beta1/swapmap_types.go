@@ -0,0 +1,335 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MatchType is how a map matches images
+// +kubebuilder:validation:Enum=Default;Prefix;Exact;Replace
+type MatchType string
+
+const (
+	// MatchDefault matches every image no other map matched
+	MatchDefault MatchType = "Default"
+	// MatchPrefix matches images starting with the registry, project and name
+	MatchPrefix MatchType = "Prefix"
+	// MatchExact matches the whole image reference
+	MatchExact MatchType = "Exact"
+	// MatchReplace matches images containing the reference and replaces just that part
+	MatchReplace MatchType = "Replace"
+)
+
+// Action is what a map does to the images it matches
+// +kubebuilder:validation:Enum=Swap;NoSwap
+type Action string
+
+const (
+	// ActionSwap rewrites matched images to the target
+	ActionSwap Action = "Swap"
+	// ActionNoSwap leaves matched images untouched
+	ActionNoSwap Action = "NoSwap"
+)
+
+// ImageReference identifies an image, or a group of images when trailing
+// parts are left empty, by the parts of its reference
+type ImageReference struct {
+	// Registry is the registry host and optional port (e.g. "docker.io", "registry.example.com:5000").
+	// On Replace maps it is the string to replace, or to replace it with, instead.
+	// +kubebuilder:validation:MaxLength=255
+	// +kubebuilder:validation:Optional
+	Registry string `json:"registry,omitempty"`
+	// Project is the path between the registry and the image name (e.g. "library", "team1/project2")
+	// +kubebuilder:validation:Optional
+	Project string `json:"project,omitempty"`
+	// Name is the image name without tag or digest (e.g. "nginx")
+	// +kubebuilder:validation:Pattern=`^[^:@]*$`
+	// +kubebuilder:validation:Optional
+	Name string `json:"name,omitempty"`
+	// Tag is the image tag (e.g. "1.25")
+	// +kubebuilder:validation:Pattern=`^[^:@]*$`
+	// +kubebuilder:validation:Optional
+	Tag string `json:"tag,omitempty"`
+	// Digest is the image digest (e.g. "sha256:...")
+	// +kubebuilder:validation:Pattern=`^[^@]*$`
+	// +kubebuilder:validation:Optional
+	Digest string `json:"digest,omitempty"`
+}
+
+// Match selects the images a map applies to
+type Match struct {
+	// Type is how the map matches images
+	// +kubebuilder:default="Prefix"
+	// +kubebuilder:validation:Required
+	Type MatchType `json:"type"`
+	// The image or images to match. Not used by "Default" maps.
+	ImageReference `json:",inline"`
+	// Wildcards are glob patterns (e.g. "*.example.com/*") matched against the
+	// registry and repository of images no more specific map matched
+	// +kubebuilder:validation:Optional
+	Wildcards []string `json:"wildcards,omitempty"`
+	// Containers limits the map to some of a pod's containers, for example to
+	// leave sidecars alone. Images the map matches in other containers, or
+	// outside pod containers such as in custom resources, aren't swapped.
+	// +kubebuilder:validation:Optional
+	Containers *ContainerSelector `json:"containers,omitempty"`
+	// NamespaceSelector limits the map to pods in namespaces with matching
+	// labels. Images the map matches in other namespaces, or outside pods such
+	// as in custom resources, aren't swapped.
+	// +kubebuilder:validation:Optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// PodSelector limits the map to pods, and the pod templates of workloads,
+	// with matching labels. Images the map matches in other pods, or outside
+	// pods such as in custom resources, aren't swapped.
+	// +kubebuilder:validation:Optional
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+}
+
+// Target is where matched images are swapped to
+type Target struct {
+	// The image or image prefix matched images are rewritten to
+	ImageReference `json:",inline"`
+	// ImagePullSecret is the name of a Secret holding credentials for the
+	// target registry. It is added to the imagePullSecrets of every pod with an
+	// image swapped by the map.
+	// +kubebuilder:validation:Optional
+	ImagePullSecret string `json:"imagePullSecret,omitempty"`
+}
+
+// Map defines a single swap map
+// +kubebuilder:validation:XValidation:rule="self.match.type == 'Replace' || !has(self.match.registry) || size(self.match.registry) == 0 || self.match.registry.matches('^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?([.][a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?$')",message="match.registry must be a hostname with an optional port (e.g. \"registry.example.com:5000\")"
+// +kubebuilder:validation:XValidation:rule="self.match.type == 'Replace' || !has(self.target) || !has(self.target.registry) || size(self.target.registry) == 0 || self.target.registry.matches('^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?([.][a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?$')",message="target.registry must be a hostname with an optional port (e.g. \"registry.example.com:5000\")"
+// +kubebuilder:validation:XValidation:rule="self.match.type == 'Replace' || !has(self.canary) || !has(self.canary.target) || !has(self.canary.target.registry) || size(self.canary.target.registry) == 0 || self.canary.target.registry.matches('^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?([.][a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?$')",message="canary.target.registry must be a hostname with an optional port (e.g. \"registry.example.com:5000\")"
+// +kubebuilder:validation:XValidation:rule="self.match.type != 'Prefix' || (has(self.match.registry) && size(self.match.registry) > 0)",message="Prefix maps require match.registry"
+// +kubebuilder:validation:XValidation:rule="self.match.type != 'Default' || self.name == 'default'",message="Default maps must be named \"default\""
+// +kubebuilder:validation:XValidation:rule="!has(self.action) || self.action != 'NoSwap' || !has(self.target) || ((!has(self.target.registry) || size(self.target.registry) == 0) && (!has(self.target.project) || size(self.target.project) == 0) && (!has(self.target.name) || size(self.target.name) == 0) && (!has(self.target.tag) || size(self.target.tag) == 0) && (!has(self.target.digest) || size(self.target.digest) == 0) && (!has(self.target.imagePullSecret) || size(self.target.imagePullSecret) == 0))",message="the NoSwap action and target are mutually exclusive"
+type Map struct {
+	// Name is the name of the swap map
+	// +kubebuilder:default="default"
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// Match selects the images the map applies to
+	// +kubebuilder:validation:Required
+	Match Match `json:"match"`
+	// Action is what the map does to matched images
+	// +kubebuilder:default="Swap"
+	// +kubebuilder:validation:Optional
+	Action Action `json:"action,omitempty"`
+	// Target is where matched images are swapped to. Not used when the action is "NoSwap".
+	// +kubebuilder:validation:Optional
+	Target Target `json:"target,omitempty"`
+	// Priority orders Replace and wildcard maps when more than one matches an
+	// image, highest first. Maps with the same priority are tried in key order.
+	// +kubebuilder:validation:Optional
+	Priority int32 `json:"priority,omitempty"`
+	// ActiveFrom is when the map starts being used. The map is ignored before then.
+	// +kubebuilder:validation:Optional
+	ActiveFrom *metav1.Time `json:"activeFrom,omitempty"`
+	// ActiveUntil is when the map stops being used. The map is ignored from then on.
+	// +kubebuilder:validation:Optional
+	ActiveUntil *metav1.Time `json:"activeUntil,omitempty"`
+	// Schedule limits the map to recurring windows, such as maintenance windows.
+	// It applies within activeFrom and activeUntil when they are set.
+	// +kubebuilder:validation:Optional
+	Schedule *Schedule `json:"schedule,omitempty"`
+	// Canary rolls the map out to a share of pods only
+	// +kubebuilder:validation:Optional
+	Canary *Canary `json:"canary,omitempty"`
+}
+
+// Schedule defines recurring windows during which a map is used
+type Schedule struct {
+	// Cron is a standard five field cron expression (minute, hour, day of month,
+	// month, day of week), evaluated in UTC, giving the start of each window
+	// (e.g. "0 2 * * 6" for 02:00 every Saturday)
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:Required
+	Cron string `json:"cron"`
+	// Duration is how long each window lasts (e.g. "4h")
+	// +kubebuilder:validation:Required
+	Duration metav1.Duration `json:"duration"`
+}
+
+// ContainerKind is the kind of a container in a pod
+// +kubebuilder:validation:Enum=Init;Regular;Ephemeral
+type ContainerKind string
+
+const (
+	// ContainerKindInit is a container in spec.initContainers
+	ContainerKindInit ContainerKind = "Init"
+	// ContainerKindRegular is a container in spec.containers
+	ContainerKindRegular ContainerKind = "Regular"
+	// ContainerKindEphemeral is a container in spec.ephemeralContainers
+	ContainerKindEphemeral ContainerKind = "Ephemeral"
+)
+
+// ContainerSelector limits a map to some of the containers of a pod. A
+// container must meet every criterion that is set.
+type ContainerSelector struct {
+	// Names are glob patterns (e.g. "app-*") matched against container names.
+	// When set the map only applies to containers matching one of them.
+	// +kubebuilder:validation:MaxItems=64
+	// +kubebuilder:validation:Optional
+	Names []string `json:"names,omitempty"`
+	// ExcludeNames are glob patterns of containers the map doesn't apply to,
+	// such as injected sidecars (e.g. "istio-proxy", "vault-agent*")
+	// +kubebuilder:validation:MaxItems=64
+	// +kubebuilder:validation:Optional
+	ExcludeNames []string `json:"excludeNames,omitempty"`
+	// Kinds limits the map to init, regular or ephemeral containers
+	// +kubebuilder:validation:MaxItems=3
+	// +kubebuilder:validation:Optional
+	Kinds []ContainerKind `json:"kinds,omitempty"`
+	// PullPolicies limits the map to containers with one of these image pull
+	// policies. Containers without a pull policy get the Kubernetes default:
+	// Always for untagged and "latest" images, IfNotPresent otherwise.
+	// +kubebuilder:validation:XValidation:rule="self.all(p, p in ['Always', 'IfNotPresent', 'Never'])",message="pull policies must be Always, IfNotPresent or Never"
+	// +kubebuilder:validation:MaxItems=3
+	// +kubebuilder:validation:Optional
+	PullPolicies []corev1.PullPolicy `json:"pullPolicies,omitempty"`
+}
+
+// Canary defines a gradual rollout of a map to a share of pods
+type Canary struct {
+	// Percent is the share of pods, from 0 to 100, in the canary group. Pods
+	// are assigned by hashing the UID of their controller, such as a ReplicaSet,
+	// or the namespace and name of pods without one, so every pod of a
+	// controller is in the same group, and raising the percentage only moves
+	// pods from the control group to the canary group.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	// +kubebuilder:validation:Required
+	Percent int32 `json:"percent"`
+	// Target is the new target canary pods are swapped to, while the control
+	// pods are still swapped to the map's target. When empty canary pods are
+	// swapped to the map's target and control pods are left unchanged.
+	// +kubebuilder:validation:Optional
+	Target Target `json:"target,omitempty"`
+}
+
+// CanaryStatus is the rollout of a map with a canary
+type CanaryStatus struct {
+	// Map is the name of the map
+	Map string `json:"map"`
+	// Percent is the share of pods in the canary group
+	Percent int32 `json:"percent"`
+}
+
+// RestartPolicy defines how workloads are restarted to pick up a SwapMap's maps
+type RestartPolicy struct {
+	// Mode is "Never" to leave running workloads alone or "Rollout" to rollout
+	// restart the Deployments, StatefulSets and DaemonSets owning pods with images
+	// the SwapMap's maps would now swap
+	// +kubebuilder:default="Never"
+	// +kubebuilder:validation:Enum={"Never","Rollout"}
+	// +kubebuilder:validation:Optional
+	Mode string `json:"mode,omitempty"`
+	// MaxRestartsPerMinute limits how many workloads are restarted each minute
+	// +kubebuilder:default=5
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Optional
+	MaxRestartsPerMinute int32 `json:"maxRestartsPerMinute,omitempty"`
+}
+
+// SwapMapSpec defines the desired state of SwapMap
+type SwapMapSpec struct {
+	// Maps is a list of Swap mappings to control how ImageSwap operates
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MaxItems=1000
+	// +listType=map
+	// +listMapKey=name
+	Maps []Map `json:"maps"`
+
+	// RestartPolicy controls whether workloads already running images the maps
+	// would now swap are restarted after the SwapMap changes
+	// +kubebuilder:validation:Optional
+	RestartPolicy *RestartPolicy `json:"restartPolicy,omitempty"`
+
+	// Mode is "Enforce" to swap the images the maps match or "Audit" to only
+	// report what would be swapped, through metrics, the audit log and
+	// imgswapctl, without changing any image
+	// +kubebuilder:default="Enforce"
+	// +kubebuilder:validation:Enum={"Enforce","Audit"}
+	// +kubebuilder:validation:Optional
+	Mode string `json:"mode,omitempty"`
+}
+
+// SwapMapStatus defines the observed state of SwapMap
+type SwapMapStatus struct {
+	// ObservedGeneration is the generation of the SwapMap last loaded
+	// +kubebuilder:validation:Optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Maps is how many of the SwapMap's maps are loaded
+	// +kubebuilder:validation:Optional
+	Maps int32 `json:"maps"`
+	// Conflicts is how many of the SwapMap's maps lost their key to a map
+	// loaded from another source
+	// +kubebuilder:validation:Optional
+	Conflicts int32 `json:"conflicts"`
+	// ActiveMaps is how many of the SwapMap's maps were within their
+	// activeFrom, activeUntil and schedule when it was last reconciled
+	// +kubebuilder:validation:Optional
+	ActiveMaps int32 `json:"activeMaps"`
+	// Canaries is the current rollout percentage of each map with a canary
+	// +kubebuilder:validation:Optional
+	Canaries []CanaryStatus `json:"canaries,omitempty"`
+	// Mode is the mode the maps were loaded in, "Enforce" or "Audit"
+	// +kubebuilder:validation:Optional
+	Mode string `json:"mode,omitempty"`
+	// LastReconcileTime is when the maps were last loaded
+	// +kubebuilder:validation:Optional
+	LastReconcileTime *metav1.Time `json:"lastReconcileTime,omitempty"`
+	// Conditions holds the "Ready" condition, true when every map is loaded
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Maps",type=integer,JSONPath=`.status.maps`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Conflicts",type=integer,JSONPath=`.status.conflicts`
+//+kubebuilder:printcolumn:name="Mode",type=string,JSONPath=`.status.mode`
+//+kubebuilder:printcolumn:name="Last Reconcile",type=date,JSONPath=`.status.lastReconcileTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// SwapMap is the Schema for the swapmaps API
+// +kubebuilder:resource:shortName=sm,singular=swapmap,scope=Namespaced,categories={"all","imageswap","imgswap","imgswp"}
+type SwapMap struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SwapMapSpec   `json:"spec,omitempty"`
+	Status SwapMapStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SwapMapList contains a list of SwapMap
+type SwapMapList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SwapMap `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SwapMap{}, &SwapMapList{})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	"twr.dev/imgswap/pkg/legacy"
+)
+
+// runConvert converts a legacy imageswap maps file into a SwapMap
+func runConvert(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("convert", stderr)
+	file := fs.String("f", "", "Legacy maps file, or a ConfigMap holding one, or - for standard input")
+	key := fs.String("key", "maps", "Key of the maps file when -f is a ConfigMap")
+	name := fs.String("name", "legacy", "Name of the SwapMap to create")
+	namespace := fs.String("namespace", "", "Namespace of the SwapMap to create")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("no maps file given, use -f")
+	}
+
+	var data []byte
+	var err error
+	if *file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+
+	maps, err := mapsFileFromConfigMap(data, *key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *file, err)
+	}
+
+	swapMap, warnings, err := legacy.Convert(strings.NewReader(maps), *name, *namespace)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(stderr, "warning: %s\n", warning)
+	}
+
+	out, err := yaml.Marshal(swapMap)
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(out)
+	return err
+}
+
+// mapsFileFromConfigMap returns the maps file under key when data is a
+// ConfigMap manifest, or data itself when it's a plain maps file
+func mapsFileFromConfigMap(data []byte, key string) (string, error) {
+	if !bytes.Contains(data, []byte("kind:")) && !bytes.Contains(data, []byte(`"kind"`)) {
+		return string(data), nil
+	}
+
+	var configMap struct {
+		Kind string            `json:"kind"`
+		Data map[string]string `json:"data"`
+	}
+	if err := yaml.Unmarshal(data, &configMap); err != nil || configMap.Kind != "ConfigMap" {
+		return string(data), nil
+	}
+
+	maps, ok := configMap.Data[key]
+	if !ok {
+		return "", fmt.Errorf("ConfigMap has no %q key", key)
+	}
+	return maps, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+// runDiff compares the maps loaded from two versions of SwapMaps and what they do to images
+func runDiff(args []string, stdout, stderr io.Writer) error {
+	var oldFiles, newFiles, images fileList
+	fs := newFlagSet("diff", stderr)
+	fs.Var(&oldFiles, "old", "SwapMap YAML file of the old version, may be repeated")
+	fs.Var(&newFiles, "new", "SwapMap YAML file of the new version, may be repeated")
+	fs.Var(&images, "i", "Image to compare the resolution of, may be repeated")
+	manifest := fs.String("f", "", "Manifest whose images to compare the resolution of")
+	exitCode := fs.Bool("exit-code", false, "Exit with status 1 when there are differences")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	oldStore, err := loadFiles(oldFiles, stderr)
+	if err != nil {
+		return fmt.Errorf("old: %w", err)
+	}
+	newStore, err := loadFiles(newFiles, stderr)
+	if err != nil {
+		return fmt.Errorf("new: %w", err)
+	}
+
+	if *manifest != "" {
+		manifestImages, err := collectImages(*manifest)
+		if err != nil {
+			return err
+		}
+		images = append(images, manifestImages...)
+	}
+
+	differences := diffMaps(oldStore.Entries(), newStore.Entries(), stdout)
+	differences += diffImages(oldStore, newStore, images, stdout)
+
+	if differences == 0 {
+		fmt.Fprintln(stdout, "no differences")
+		return nil
+	}
+	if *exitCode {
+		return errFailed
+	}
+	return nil
+}
+
+// diffMaps prints the maps added, removed or changed between two MapStores and returns how many there were
+func diffMaps(oldEntries, newEntries []mapstore.Entry, w io.Writer) int {
+	oldByKey := map[string]mapstore.Entry{}
+	for _, entry := range oldEntries {
+		oldByKey[entry.Key] = entry
+	}
+	newByKey := map[string]mapstore.Entry{}
+	for _, entry := range newEntries {
+		newByKey[entry.Key] = entry
+	}
+
+	differences := 0
+	for _, entry := range oldEntries {
+		if _, ok := newByKey[entry.Key]; !ok {
+			fmt.Fprintf(w, "- %s\n", describeEntry(entry))
+			differences++
+		}
+	}
+	for _, entry := range newEntries {
+		old, ok := oldByKey[entry.Key]
+		switch {
+		case !ok:
+			fmt.Fprintf(w, "+ %s\n", describeEntry(entry))
+			differences++
+		case old.Source != entry.Source || !reflect.DeepEqual(old.Map, entry.Map):
+			fmt.Fprintf(w, "~ %s\n  was %s\n", describeEntry(entry), describeEntry(old))
+			differences++
+		}
+	}
+	return differences
+}
+
+// describeEntry returns a one line description of a loaded map
+func describeEntry(entry mapstore.Entry) string {
+	target := mapstore.GetSwapTarget(entry.Map.SwapTo)
+	if entry.Map.NoSwap || target == "" {
+		target = "(no swap)"
+	}
+	return fmt.Sprintf("%s -> %s [%s map %q from SwapMap %s]", entry.Key, target, entry.Type, entry.Map.Name, entry.Source)
+}
+
+// diffImages prints the images that resolve differently and returns how many there were
+func diffImages(oldStore, newStore *mapstore.MapStore, images []string, w io.Writer) int {
+	differences := 0
+	seen := map[string]bool{}
+	for _, image := range images {
+		if seen[image] {
+			continue
+		}
+		seen[image] = true
+
+		oldDecision, newDecision := oldStore.Resolve(image), newStore.Resolve(image)
+		if oldDecision.SwappedImage == newDecision.SwappedImage && oldDecision.Action == newDecision.Action {
+			continue
+		}
+		fmt.Fprintf(w, "image %s: %s (%s) -> %s (%s)\n", image, oldDecision.SwappedImage, oldDecision.Action, newDecision.SwappedImage, newDecision.Action)
+		differences++
+	}
+	return differences
+}
+
+// collectImages returns the images of the containers in a manifest's pods and workloads
+func collectImages(file string) ([]string, error) {
+	objects, err := readObjects(file)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []string{}
+	for _, obj := range objects {
+		path, ok := podSpecPaths[obj.GetKind()]
+		if !ok {
+			continue
+		}
+		for _, field := range []string{"initContainers", "containers", "ephemeralContainers"} {
+			containers, _, _ := unstructured.NestedSlice(obj.Object, append(path[:len(path):len(path)], field)...)
+			for _, container := range containers {
+				if c, ok := container.(map[string]interface{}); ok {
+					if image, ok := c["image"].(string); ok {
+						images = append(images, image)
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(images)
+	return images, nil
+}
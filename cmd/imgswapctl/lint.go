@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+// registryPattern matches a hostname with an optional port, as the SwapMap
+// CRD requires of registries
+var registryPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?([.][a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?$`)
+
+// lintFinding is a problem found in a map
+type lintFinding struct {
+	severity string
+	source   string
+	mapName  string
+	message  string
+}
+
+func (f lintFinding) String() string {
+	if f.mapName == "" {
+		return fmt.Sprintf("%s: SwapMap %s: %s", f.severity, f.source, f.message)
+	}
+	return fmt.Sprintf("%s: SwapMap %s map %q: %s", f.severity, f.source, f.mapName, f.message)
+}
+
+// runLint checks SwapMaps for maps that can't be loaded, conflict or won't do what they look like
+func runLint(args []string, stdout, stderr io.Writer) error {
+	var files fileList
+	fs := newFlagSet("lint", stderr)
+	fs.Var(&files, "m", "SwapMap YAML file to check, may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	files = append(files, fs.Args()...)
+	if len(files) == 0 {
+		return fmt.Errorf("no SwapMap files given, use -m")
+	}
+
+	swapMaps, err := readSwapMaps(files)
+	if err != nil {
+		return err
+	}
+
+	findings := lintSwapMaps(swapMaps)
+	errors := 0
+	for _, finding := range findings {
+		if finding.severity == "error" {
+			errors++
+		}
+		fmt.Fprintln(stdout, finding)
+	}
+
+	maps := 0
+	for _, swapMap := range swapMaps {
+		maps += len(swapMap.Spec.Maps)
+	}
+	fmt.Fprintf(stdout, "%d SwapMaps, %d maps, %d errors, %d warnings\n", len(swapMaps), maps, errors, len(findings)-errors)
+
+	if errors > 0 {
+		return errFailed
+	}
+	return nil
+}
+
+// lintSwapMaps returns the problems found in the SwapMaps, loaded in the order given
+func lintSwapMaps(swapMaps []*mapsv1alpha1.SwapMap) []lintFinding {
+	findings := []lintFinding{}
+	owners := map[string]string{}
+
+	for _, swapMap := range swapMaps {
+		source := client.ObjectKeyFromObject(swapMap).String()
+		names := map[string]bool{}
+		keys := map[string]string{}
+
+		add := func(severity, mapName, format string, args ...interface{}) {
+			findings = append(findings, lintFinding{severity: severity, source: source, mapName: mapName, message: fmt.Sprintf(format, args...)})
+		}
+
+		if len(swapMap.Spec.Maps) == 0 {
+			add("warning", "", "has no maps")
+		}
+
+		for _, mapSpec := range swapMap.Spec.Maps {
+			if names[mapSpec.Name] {
+				add("error", mapSpec.Name, "duplicate map name")
+			}
+			names[mapSpec.Name] = true
+
+			switch mapSpec.Type {
+			case "default", "swap", "exact", "replace":
+			default:
+				add("error", mapSpec.Name, "unknown type %q", mapSpec.Type)
+			}
+
+			for _, pattern := range mapSpec.Wildcards {
+				if _, err := path.Match(pattern, ""); err != nil {
+					add("error", mapSpec.Name, "invalid wildcard %q: %v", pattern, err)
+				}
+			}
+
+			if mapSpec.Type == "default" && mapSpec.Name != "default" {
+				add("error", mapSpec.Name, "default maps must be named \"default\"")
+				continue
+			}
+			if mapSpec.Type == "swap" && mapSpec.SwapFrom.Registry == "" {
+				add("error", mapSpec.Name, "swap maps require swapFrom.registry")
+			}
+			// Replace maps hold the strings to replace rather than registries
+			if mapSpec.Type != "replace" && !validRegistry(mapSpec.SwapFrom.Registry) {
+				add("error", mapSpec.Name, "swapFrom.registry %q must be a hostname with an optional port", mapSpec.SwapFrom.Registry)
+			}
+			if mapSpec.Type != "replace" && !validRegistry(mapSpec.SwapTo.Registry) {
+				add("error", mapSpec.Name, "swapTo.registry %q must be a hostname with an optional port", mapSpec.SwapTo.Registry)
+			}
+
+			mapKey, err := mapstore.GetMapKey(mapSpec)
+			if err != nil {
+				add("error", mapSpec.Name, "%v, swapFrom needs a registry, project or image", err)
+				continue
+			}
+			if other, ok := keys[mapKey]; ok {
+				add("error", mapSpec.Name, "key %q is also used by map %q, only one of them is loaded", mapKey, other)
+			}
+			keys[mapKey] = mapSpec.Name
+			if owner, ok := owners[mapKey]; ok && owner != source {
+				add("error", mapSpec.Name, "key %q is already loaded from SwapMap %s", mapKey, owner)
+			} else {
+				owners[mapKey] = source
+			}
+
+			target := mapstore.GetSwapTarget(mapSpec.SwapTo)
+			switch {
+			case mapSpec.NoSwap && (target != "" || mapSpec.SwapTo.ImagePullSecret != ""):
+				add("error", mapSpec.Name, "noSwap and swapTo are mutually exclusive")
+			case !mapSpec.NoSwap && target == "":
+				add("warning", mapSpec.Name, "swapTo is empty so matching images are left alone, set noSwap to make that explicit")
+			}
+			if mapSpec.Type == "default" && mapstore.GetSwapTarget(mapSpec.SwapFrom) != "" {
+				add("warning", mapSpec.Name, "swapFrom is ignored on the default map")
+			}
+			if err := mapstore.ValidateMap(&mapSpec); err != nil {
+				add("error", mapSpec.Name, "%v", err)
+			}
+			if mapSpec.ActiveFrom != nil && mapSpec.ActiveUntil != nil && !mapSpec.ActiveFrom.Before(mapSpec.ActiveUntil) {
+				add("warning", mapSpec.Name, "activeUntil isn't after activeFrom so the map is never used")
+			}
+			if mapSpec.Canary != nil && mapSpec.NoSwap {
+				add("warning", mapSpec.Name, "noSwap is set so the canary is ignored")
+			}
+			if mapSpec.Canary != nil && mapSpec.Type != "replace" && !validRegistry(mapSpec.Canary.SwapTo.Registry) {
+				add("error", mapSpec.Name, "canary.swapTo.registry %q must be a hostname with an optional port", mapSpec.Canary.SwapTo.Registry)
+			}
+			if mapSpec.Containers != nil {
+				for _, kind := range mapSpec.Containers.Kinds {
+					switch kind {
+					case mapsv1alpha1.ContainerKindInit, mapsv1alpha1.ContainerKindRegular, mapsv1alpha1.ContainerKindEphemeral:
+					default:
+						add("error", mapSpec.Name, "unknown container kind %q, expected Init, Regular or Ephemeral", kind)
+					}
+				}
+				for _, pullPolicy := range mapSpec.Containers.PullPolicies {
+					switch pullPolicy {
+					case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+					default:
+						add("error", mapSpec.Name, "unknown pull policy %q, expected Always, IfNotPresent or Never", pullPolicy)
+					}
+				}
+			}
+			if mapSpec.SwapFrom.ImagePullSecret != "" {
+				add("warning", mapSpec.Name, "imagePullSecret is only used on swapTo")
+			}
+		}
+	}
+	return findings
+}
+
+// validRegistry reports whether the registry is empty or passes the SwapMap
+// CRD's hostname[:port] rule
+func validRegistry(registry string) bool {
+	return registry == "" || registryPattern.MatchString(registry)
+}
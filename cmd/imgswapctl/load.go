@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	mapsv1beta1 "twr.dev/imgswap/api/v1beta1"
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+// readObjects reads every object from a YAML or JSON file holding one or more
+// documents, expanding Lists. "-" reads from standard input.
+func readObjects(file string) ([]*unstructured.Unstructured, error) {
+	var r io.Reader
+	if file == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	objects := []*unstructured.Unstructured{}
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := utilyaml.Unmarshal(doc, &obj.Object); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+
+		if obj.IsList() {
+			err := obj.EachListItem(func(item runtime.Object) error {
+				objects = append(objects, item.(*unstructured.Unstructured))
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			continue
+		}
+		objects = append(objects, obj)
+	}
+}
+
+// readSwapMaps reads the SwapMaps from the files, ignoring any other kind of object
+func readSwapMaps(files []string) ([]*mapsv1alpha1.SwapMap, error) {
+	swapMaps := []*mapsv1alpha1.SwapMap{}
+	for _, file := range files {
+		objects, err := readObjects(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			gvk := obj.GroupVersionKind()
+			if gvk.Group != mapsv1alpha1.GroupVersion.Group || gvk.Kind != "SwapMap" {
+				continue
+			}
+
+			swapMap := &mapsv1alpha1.SwapMap{}
+			switch gvk.Version {
+			case mapsv1alpha1.GroupVersion.Version:
+				if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, swapMap); err != nil {
+					return nil, fmt.Errorf("%s: SwapMap %s: %w", file, obj.GetName(), err)
+				}
+			case mapsv1beta1.GroupVersion.Version:
+				hub := &mapsv1beta1.SwapMap{}
+				if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, hub); err != nil {
+					return nil, fmt.Errorf("%s: SwapMap %s: %w", file, obj.GetName(), err)
+				}
+				if err := swapMap.ConvertFrom(hub); err != nil {
+					return nil, fmt.Errorf("%s: SwapMap %s: %w", file, obj.GetName(), err)
+				}
+			default:
+				return nil, fmt.Errorf("%s: SwapMap %s has unsupported version %s", file, obj.GetName(), gvk.Version)
+			}
+			if swapMap.Namespace == "" {
+				swapMap.Namespace = "default"
+			}
+			swapMaps = append(swapMaps, swapMap)
+		}
+	}
+	return swapMaps, nil
+}
+
+// loadResult describes what happened loading SwapMaps into a MapStore
+type loadResult struct {
+	// rejected holds the errors of maps that couldn't be loaded
+	rejected []string
+	// conflicts holds the map keys already loaded from another SwapMap
+	conflicts []string
+}
+
+// loadMapStore loads the SwapMaps into a new MapStore the same way the
+// SwapMap controller does, in the order given
+func loadMapStore(swapMaps []*mapsv1alpha1.SwapMap) (*mapstore.MapStore, loadResult) {
+	store := mapstore.NewMapStore()
+	result := loadResult{}
+
+	for _, swapMap := range swapMaps {
+		source := client.ObjectKeyFromObject(swapMap).String()
+		maps := make(map[string]*mapsv1alpha1.Map, len(swapMap.Spec.Maps))
+		for i := range swapMap.Spec.Maps {
+			mapSpec := swapMap.Spec.Maps[i]
+			mapKey, err := mapstore.GetMapKey(mapSpec)
+			if err == nil {
+				err = mapstore.ValidateMap(&mapSpec)
+			}
+			if err != nil {
+				result.rejected = append(result.rejected, fmt.Sprintf("SwapMap %s map %q: %v", source, mapSpec.Name, err))
+				continue
+			}
+			maps[mapKey] = &mapSpec
+		}
+
+		for _, mapKey := range store.LoadSource(source, 0, swapMap.Generation, swapMap.Spec.Mode == mapsv1alpha1.SwapMapModeAudit, maps) {
+			owner, _ := store.Owner(mapKey)
+			result.conflicts = append(result.conflicts, fmt.Sprintf("SwapMap %s key %q is already loaded from SwapMap %s", source, mapKey, owner))
+		}
+	}
+	store.MarkSynced()
+
+	return store, result
+}
+
+// loadFiles reads the SwapMaps from the files and loads them, printing any
+// problems as warnings
+func loadFiles(files []string, stderr io.Writer) (*mapstore.MapStore, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no SwapMap files given, use -m")
+	}
+
+	swapMaps, err := readSwapMaps(files)
+	if err != nil {
+		return nil, err
+	}
+	if len(swapMaps) == 0 {
+		return nil, fmt.Errorf("no SwapMaps found in %s", strings.Join(files, ", "))
+	}
+
+	store, result := loadMapStore(swapMaps)
+	for _, warning := range append(result.rejected, result.conflicts...) {
+		fmt.Fprintf(stderr, "warning: %s\n", warning)
+	}
+	return store, nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// imgswapctl tests SwapMaps offline by loading them from YAML files into a
+// MapStore and reporting what the webhook would do with images and manifests.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// command is an imgswapctl subcommand
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string, stdout, stderr io.Writer) error
+}
+
+// commands is set in init as the subcommands refer back to it for their usage
+var commands []command
+
+func init() {
+	commands = []command{
+		{"resolve", "resolve -m FILE [-m FILE]... [-trace] IMAGE...", "Show what the maps do to images", runResolve},
+		{"mutate", "mutate -m FILE [-m FILE]... -f MANIFEST", "Swap the images in pod and workload manifests", runMutate},
+		{"lint", "lint -m FILE [-m FILE]...", "Check SwapMaps for invalid or conflicting maps", runLint},
+		{"diff", "diff -old FILE -new FILE [-i IMAGE]...", "Compare two versions of SwapMaps", runDiff},
+		{"convert", "convert -f MAPS_FILE [-name NAME] [-namespace NAMESPACE]", "Convert a legacy imageswap maps file into a SwapMap", runConvert},
+	}
+}
+
+// errFailed reports that a subcommand already printed why it failed
+var errFailed = fmt.Errorf("failed")
+
+func main() {
+	// The webhook packages log through controller-runtime, which isn't wanted on the command line
+	logf.SetLogger(zap.New(zap.WriteTo(io.Discard)))
+
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != os.Args[1] {
+			continue
+		}
+		err := cmd.run(os.Args[2:], os.Stdout, os.Stderr)
+		if err == flag.ErrHelp {
+			return
+		}
+		if err != nil {
+			if err != errFailed {
+				fmt.Fprintf(os.Stderr, "imgswapctl %s: %v\n", cmd.name, err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	if os.Args[1] != "help" && os.Args[1] != "-h" && os.Args[1] != "--help" {
+		fmt.Fprintf(os.Stderr, "imgswapctl: unknown command %q\n", os.Args[1])
+	}
+	usage(os.Stderr)
+	os.Exit(2)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: imgswapctl COMMAND [OPTIONS]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+// newFlagSet returns the flag set of a subcommand
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	for _, cmd := range commands {
+		cmd := cmd
+		if cmd.name == name {
+			fs.Usage = func() {
+				fmt.Fprintf(stderr, "Usage: imgswapctl %s\n\n%s.\n\nOptions:\n", cmd.usage, cmd.summary)
+				fs.PrintDefaults()
+			}
+		}
+	}
+	return fs
+}
+
+// fileList is a flag that can be repeated to name several files
+type fileList []string
+
+func (f *fileList) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fileList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
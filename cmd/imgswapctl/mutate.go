@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/audit"
+	"twr.dev/imgswap/pkg/fieldpolicy"
+	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/webhooks"
+)
+
+// podSpecPaths are the paths to the pod spec of the kinds the webhooks swap images in
+var podSpecPaths = map[string][]string{
+	"Pod":                   {"spec"},
+	"Deployment":            {"spec", "template", "spec"},
+	"StatefulSet":           {"spec", "template", "spec"},
+	"DaemonSet":             {"spec", "template", "spec"},
+	"ReplicaSet":            {"spec", "template", "spec"},
+	"ReplicationController": {"spec", "template", "spec"},
+	"Job":                   {"spec", "template", "spec"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// runMutate swaps the images in every pod, workload and custom resource
+// covered by an ImageFieldPolicy in a manifest and prints the result
+func runMutate(args []string, stdout, stderr io.Writer) error {
+	var files fileList
+	fs := newFlagSet("mutate", stderr)
+	fs.Var(&files, "m", "SwapMap or ImageFieldPolicy YAML file to load, may be repeated")
+	manifest := fs.String("f", "", "Manifest to mutate, such as the output of helm template, or - for standard input")
+	namespaceLabels := fs.String("namespace-labels", "", "Labels of the namespace the manifest is deployed to, such as team=web,env=prod, for maps with a namespaceSelector")
+	quiet := fs.Bool("q", false, "Don't print the summary of swapped images")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *manifest == "" {
+		return fmt.Errorf("no manifest given, use -f")
+	}
+	nsLabels, err := labels.ConvertSelectorToLabelsMap(*namespaceLabels)
+	if err != nil {
+		return fmt.Errorf("invalid -namespace-labels: %w", err)
+	}
+
+	store, err := loadFiles(files, stderr)
+	if err != nil {
+		return err
+	}
+	policies, err := loadPolicies(files)
+	if err != nil {
+		return err
+	}
+
+	objects, err := readObjects(*manifest)
+	if err != nil {
+		return err
+	}
+
+	summary := tabwriter.NewWriter(stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(summary, "OBJECT\tCONTAINER\tIMAGE\tRESULT\tMAP\tACTION")
+	for i, obj := range objects {
+		containers, err := mutateObject(store, policies, nsLabels, obj)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", obj.GetKind(), obj.GetName(), err)
+		}
+		for _, c := range containers {
+			fmt.Fprintf(summary, "%s/%s\t%s\t%s\t%s\t%s\t%s\n", obj.GetKind(), obj.GetName(), c.Name, c.OriginalImage, c.FinalImage, orDash(c.Map), c.Action)
+		}
+
+		out, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(stdout, "---")
+		}
+		if _, err := stdout.Write(out); err != nil {
+			return err
+		}
+	}
+
+	if *quiet {
+		return nil
+	}
+	return summary.Flush()
+}
+
+// loadPolicies reads the ImageFieldPolicies from the files
+func loadPolicies(files []string) (*fieldpolicy.Store, error) {
+	policies := fieldpolicy.NewStore()
+	for _, file := range files {
+		objects, err := readObjects(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			gvk := obj.GroupVersionKind()
+			if gvk.Group != mapsv1alpha1.GroupVersion.Group || gvk.Kind != "ImageFieldPolicy" {
+				continue
+			}
+			policy := &mapsv1alpha1.ImageFieldPolicy{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, policy); err != nil {
+				return nil, fmt.Errorf("%s: ImageFieldPolicy %s: %w", file, obj.GetName(), err)
+			}
+			policies.AddOrUpdate(policy.Name, policy.Spec)
+		}
+	}
+	return policies, nil
+}
+
+// mutateObject swaps the images in an object deployed to a namespace with the
+// given labels the way the webhooks would and returns the decision taken for
+// each image
+func mutateObject(store *mapstore.MapStore, policies *fieldpolicy.Store, namespaceLabels map[string]string, obj *unstructured.Unstructured) ([]audit.Container, error) {
+	path, ok := podSpecPaths[obj.GetKind()]
+	if !ok {
+		return mutateCustomResource(store, policies, obj)
+	}
+
+	// Templates inherit the workload's annotations, as in the workload webhook
+	annotations := map[string]string{}
+	for k, v := range obj.GetAnnotations() {
+		annotations[k] = v
+	}
+	if len(path) > 1 {
+		templateAnnotations, _, _ := unstructured.NestedStringMap(obj.Object, append(path[:len(path)-1:len(path)-1], "metadata", "annotations")...)
+		for k, v := range templateAnnotations {
+			annotations[k] = v
+		}
+	}
+	if webhooks.PodSkipped(annotations) {
+		return nil, nil
+	}
+
+	// Selectors match the labels of the pod template rather than the workload
+	podLabels := mapstore.PodLabels{Pod: obj.GetLabels(), Namespace: namespaceLabels}
+	if len(path) > 1 {
+		podLabels.Pod, _, _ = unstructured.NestedStringMap(obj.Object, append(path[:len(path)-1:len(path)-1], "metadata", "labels")...)
+	}
+
+	rawSpec, found, err := unstructured.NestedMap(obj.Object, path...)
+	if err != nil || !found {
+		return nil, err
+	}
+	spec := &corev1.PodSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(rawSpec, spec); err != nil {
+		return nil, err
+	}
+
+	containers := webhooks.SwapPodSpec(store, annotations, podLabels, "", spec)
+
+	// Write back only what the webhook changes so the rest of the manifest is untouched
+	setImages(rawSpec, "initContainers", spec.InitContainers)
+	setImages(rawSpec, "containers", spec.Containers)
+	ephemeral := make([]corev1.Container, len(spec.EphemeralContainers))
+	for i := range spec.EphemeralContainers {
+		ephemeral[i] = corev1.Container(spec.EphemeralContainers[i].EphemeralContainerCommon)
+	}
+	setImages(rawSpec, "ephemeralContainers", ephemeral)
+	if len(spec.ImagePullSecrets) > 0 {
+		pullSecrets := make([]interface{}, 0, len(spec.ImagePullSecrets))
+		for _, ref := range spec.ImagePullSecrets {
+			pullSecrets = append(pullSecrets, map[string]interface{}{"name": ref.Name})
+		}
+		rawSpec["imagePullSecrets"] = pullSecrets
+	}
+
+	return containers, unstructured.SetNestedMap(obj.Object, rawSpec, path...)
+}
+
+// setImages copies the container images into a raw list of containers
+func setImages(rawSpec map[string]interface{}, field string, containers []corev1.Container) {
+	rawContainers, ok := rawSpec[field].([]interface{})
+	if !ok {
+		return
+	}
+	for i, rawContainer := range rawContainers {
+		if c, ok := rawContainer.(map[string]interface{}); ok && i < len(containers) {
+			c["image"] = containers[i].Image
+		}
+	}
+}
+
+// mutateCustomResource swaps the images at the paths of the ImageFieldPolicy for the object's kind
+func mutateCustomResource(store *mapstore.MapStore, policies *fieldpolicy.Store, obj *unstructured.Unstructured) ([]audit.Container, error) {
+	paths := policies.Paths(obj.GroupVersionKind())
+	if len(paths) == 0 || webhooks.PodSkipped(obj.GetAnnotations()) {
+		return nil, nil
+	}
+
+	containers := []audit.Container{}
+	for _, path := range paths {
+		err := fieldpolicy.SwapFields(obj.Object, path, func(location, image string) string {
+			decision := store.Resolve(image)
+			result := audit.Container{Name: location, OriginalImage: image, FinalImage: decision.SwappedImage, Action: decision.Action, AuditImage: decision.AuditImage}
+			if decision.Map != nil {
+				result.Map = decision.Map.Name
+			}
+			containers = append(containers, result)
+			return result.FinalImage
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return containers, nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+// runResolve prints what the maps do to each image
+func runResolve(args []string, stdout, stderr io.Writer) error {
+	var files fileList
+	fs := newFlagSet("resolve", stderr)
+	fs.Var(&files, "m", "SwapMap YAML file to load, may be repeated")
+	trace := fs.Bool("trace", false, "Print the maps consulted for each image")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no images given")
+	}
+
+	store, err := loadFiles(files, stderr)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tACTION\tRESULT\tMAP\tSOURCE")
+	for _, image := range fs.Args() {
+		decision, steps := store.Trace(image)
+
+		mapName, source := "-", "-"
+		if decision.Map != nil {
+			mapName = decision.Map.Name
+			source, _ = store.Owner(decision.MapKey)
+		}
+		result := decision.SwappedImage
+		if decision.Action == mapstore.ActionAudit {
+			result = decision.AuditImage
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", image, decision.Action, result, mapName, source)
+
+		if *trace {
+			for _, step := range steps {
+				fmt.Fprintf(w, "  %s\n", step)
+			}
+		}
+	}
+	return w.Flush()
+}
@@ -18,22 +18,39 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	mapsv1beta1 "twr.dev/imgswap/api/v1beta1"
 	"twr.dev/imgswap/internal/controller"
+	"twr.dev/imgswap/pkg/audit"
+	"twr.dev/imgswap/pkg/debug"
+	"twr.dev/imgswap/pkg/fieldpolicy"
 	"twr.dev/imgswap/pkg/mapstore"
 	"twr.dev/imgswap/pkg/webhooks"
 	//+kubebuilder:scaffold:imports
@@ -47,8 +64,10 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
 
 	utilruntime.Must(mapsv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(mapsv1beta1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 
 	ImgSwapMapStore = mapstore.NewMapStore()
@@ -58,26 +77,161 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var reconcileTimeout time.Duration
+	var enableWorkloadWebhook bool
+	var enableImageFieldPolicies bool
+	var customResourceWebhookConfig string
+	var enablePullSecretSync bool
+	var pullSecretSourceNamespace string
+	var enableDriftScanner bool
+	var driftScanInterval time.Duration
+	var driftReportName string
+	var driftRestartWorkloads bool
+	var enableDebugEndpoints bool
+	var enableSwapMapSource bool
+	var enableConfigMapSource bool
+	var configMapSourcePrecedence int
+	var mapDir string
+	var mapDirPrecedence int
+	var mode string
+	var webhookCertDir string
+	var enableCertRotation bool
+	var certRotationSecret string
+	var webhookServiceName string
+	var webhookConfig string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.DurationVar(&reconcileTimeout, "reconcile-timeout", controller.DefaultReconcileTimeout,
+		"How long a single SwapMap reconcile may run before the liveness check reports the reconciler as wedged.")
+	flag.BoolVar(&enableWorkloadWebhook, "enable-workload-webhook", false,
+		"Swap images in the pod templates of Deployments, StatefulSets, DaemonSets, Jobs and CronJobs "+
+			"in addition to pods.")
+	flag.BoolVar(&enableImageFieldPolicies, "enable-image-field-policies", true,
+		"Swap images in the custom resources named by ImageFieldPolicies. Turn off on clusters without the "+
+			"ImageFieldPolicy CRD.")
+	flag.StringVar(&customResourceWebhookConfig, "custom-resource-webhook-configuration", "imgswap-custom-resource-webhook-configuration",
+		"The MutatingWebhookConfiguration whose rules are managed from ImageFieldPolicies.")
+	flag.BoolVar(&enablePullSecretSync, "enable-pull-secret-sync", false,
+		"Copy the image pull secrets referenced by swapTo targets into every namespace.")
+	flag.StringVar(&pullSecretSourceNamespace, "pull-secret-source-namespace", os.Getenv("POD_NAMESPACE"),
+		"The namespace image pull secrets are copied from. Defaults to the manager's namespace.")
+	flag.BoolVar(&enableDriftScanner, "enable-drift-scanner", false,
+		"Periodically report running pods with images the loaded maps would swap. Requires the SwapReport CRD.")
+	flag.DurationVar(&driftScanInterval, "drift-scan-interval", controller.DefaultDriftScanInterval,
+		"The time between drift scans.")
+	flag.StringVar(&driftReportName, "drift-report-name", "imgswap",
+		"The SwapReport the drift scanner writes its findings to.")
+	flag.BoolVar(&driftRestartWorkloads, "drift-restart-workloads", false,
+		"Rollout restart the Deployments, StatefulSets and DaemonSets owning pods found by the drift scanner.")
+	flag.BoolVar(&enableDebugEndpoints, "enable-debug-endpoints", false,
+		"Serve the authenticated "+debug.MapStorePath+" and "+debug.ResolvePath+" endpoints on the metrics server.")
+	flag.BoolVar(&enableSwapMapSource, "enable-swapmap-source", true,
+		"Load maps from SwapMaps and serve their conversion webhook. Turn off on clusters without the SwapMap CRD "+
+			"and load maps with --enable-configmap-source or --map-dir instead. Without any imgswap CRDs also pass "+
+			"--enable-image-field-policies=false.")
+	flag.BoolVar(&enableConfigMapSource, "enable-configmap-source", false,
+		"Load maps from ConfigMaps labelled "+controller.ConfigMapSourceLabel+"=true in addition to SwapMaps.")
+	flag.IntVar(&configMapSourcePrecedence, "configmap-source-precedence", controller.DefaultConfigMapSourcePrecedence,
+		"Precedence of maps loaded from ConfigMaps. SwapMaps have precedence 0 and the higher precedence wins "+
+			"when both load the same key.")
+	flag.StringVar(&mapDir, "map-dir", "",
+		"Load maps from the YAML files in this directory, reloading them when they change.")
+	flag.IntVar(&mapDirPrecedence, "map-dir-precedence", controller.DefaultFileSourcePrecedence,
+		"Precedence of maps loaded from --map-dir. SwapMaps have precedence 0 and the higher precedence wins "+
+			"when both load the same key.")
+	flag.StringVar(&mode, "mode", modeManager,
+		"Either \""+modeManager+"\" to run the controllers and webhooks, or \""+modeWebhookOnly+"\" to serve only the pod "+
+			"webhook from the maps in --map-dir, without CRDs, caches or leader election.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "",
+		"The directory holding the webhook server's tls.crt and tls.key. Defaults to "+
+			"<temp-dir>/k8s-webhook-server/serving-certs.")
+	flag.BoolVar(&enableCertRotation, "enable-cert-rotation", false,
+		"Generate and rotate a self-signed webhook serving certificate and inject its CA into the webhook "+
+			"configurations, instead of relying on cert-manager.")
+	flag.StringVar(&certRotationSecret, "cert-rotation-secret", "imgswap-webhook-certs",
+		"The Secret in the manager's namespace holding the generated CA and serving certificate.")
+	flag.StringVar(&webhookServiceName, "webhook-service-name", "imgswap-webhook-service",
+		"The Service in the manager's namespace the API server calls the webhooks through.")
+	flag.StringVar(&webhookConfig, "webhook-configuration", "imgswap-mutating-webhook-configuration",
+		"The MutatingWebhookConfiguration of the pod and workload webhooks.")
 	opts := zap.Options{
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
+	auditOpts := audit.Options{}
+	auditOpts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	ctx := ctrl.SetupSignalHandler()
+
+	if webhookCertDir == "" {
+		webhookCertDir = filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs")
+	}
+
+	switch mode {
+	case modeManager:
+	case modeWebhookOnly:
+		auditLogger, err := auditOpts.NewLogger()
+		if err != nil {
+			setupLog.Error(err, "unable to set up audit logging")
+			os.Exit(1)
+		}
+		setupLog.Info("starting webhook", "mode", mode)
+		if err := runWebhookOnly(ctx, webhookOnlyOptions{
+			MetricsAddr:      metricsAddr,
+			ProbeAddr:        probeAddr,
+			WebhookPort:      9443,
+			CertDir:          webhookCertDir,
+			MapDir:           mapDir,
+			MapDirPrecedence: mapDirPrecedence,
+			AuditLogger:      auditLogger,
+		}); err != nil {
+			setupLog.Error(err, "problem running webhook")
+			os.Exit(1)
+		}
+		return
+	default:
+		setupLog.Error(fmt.Errorf("unknown mode %q", mode), "invalid --mode")
+		os.Exit(1)
+	}
+
+	if !enableSwapMapSource && !enableConfigMapSource && mapDir == "" {
+		setupLog.Error(fmt.Errorf("no map sources"), "--enable-swapmap-source=false requires --enable-configmap-source or --map-dir")
+		os.Exit(1)
+	}
+
+	byObject := map[client.Object]cache.ByObject{}
+	if enableConfigMapSource {
+		// Only ConfigMaps holding maps are watched
+		byObject[&corev1.ConfigMap{}] = cache.ByObject{Label: labels.SelectorFromSet(labels.Set{controller.ConfigMapSourceLabel: "true"})}
+	}
+	if enablePullSecretSync {
+		if pullSecretSourceNamespace == "" {
+			setupLog.Error(fmt.Errorf("no source namespace"), "--enable-pull-secret-sync requires --pull-secret-source-namespace or POD_NAMESPACE")
+			os.Exit(1)
+		}
+		// Only pull secrets in the source namespace are watched, so don't
+		// cache every Secret in the cluster
+		byObject[&corev1.Secret{}] = cache.ByObject{Field: fields.OneTermEqualSelector("metadata.namespace", pullSecretSourceNamespace)}
+	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "e51e86fc.k8s.imgswap.io",
+		WebhookServer: webhook.NewServer(webhook.Options{
+			Port:    9443,
+			CertDir: webhookCertDir,
+		}),
+		Cache: cache.Options{
+			ByObject: byObject,
+		},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -95,30 +249,249 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controller.SwapMapReconciler{
-		Client:   mgr.GetClient(),
-		Scheme:   mgr.GetScheme(),
-		MapStore: ImgSwapMapStore,
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "SwapMap")
+	if err = controller.SetupInitialSync(mgr, ImgSwapMapStore, enableSwapMapSource, enableConfigMapSource); err != nil {
+		setupLog.Error(err, "unable to set up MapStore initial sync")
 		os.Exit(1)
 	}
+	var swapMapReconciler *controller.SwapMapReconciler
+	if enableSwapMapSource {
+		swapMapReconciler = &controller.SwapMapReconciler{
+			Client:           mgr.GetClient(),
+			Scheme:           mgr.GetScheme(),
+			MapStore:         ImgSwapMapStore,
+			Recorder:         mgr.GetEventRecorderFor("imgswap-controller"),
+			ReconcileTimeout: reconcileTimeout,
+		}
+		if err = swapMapReconciler.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "SwapMap")
+			os.Exit(1)
+		}
+	}
+	if enableConfigMapSource {
+		if err = (&controller.ConfigMapSourceReconciler{
+			Client:     mgr.GetClient(),
+			Scheme:     mgr.GetScheme(),
+			MapStore:   ImgSwapMapStore,
+			Recorder:   mgr.GetEventRecorderFor("imgswap-controller"),
+			Precedence: configMapSourcePrecedence,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ConfigMapSource")
+			os.Exit(1)
+		}
+	}
+	if mapDir != "" {
+		fileSource := &controller.FileSource{
+			Dir:        mapDir,
+			MapStore:   ImgSwapMapStore,
+			Precedence: mapDirPrecedence,
+		}
+		// Load before the webhook starts serving so the baseline maps are there from the first request
+		if err := fileSource.Load(); err != nil {
+			setupLog.Error(err, "unable to load maps", "dir", mapDir)
+			os.Exit(1)
+		}
+		if err := mgr.Add(fileSource); err != nil {
+			setupLog.Error(err, "unable to set up map directory watch", "dir", mapDir)
+			os.Exit(1)
+		}
+	}
+	fieldPolicies := fieldpolicy.NewStore()
+	if enableImageFieldPolicies {
+		if err = (&controller.ImageFieldPolicyReconciler{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Policies: fieldPolicies,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ImageFieldPolicy")
+			os.Exit(1)
+		}
+		if err = (&controller.ImageFieldPolicyWebhookReconciler{
+			Client:                   mgr.GetClient(),
+			Recorder:                 mgr.GetEventRecorderFor("imgswap-controller"),
+			WebhookConfigurationName: customResourceWebhookConfig,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ImageFieldPolicyWebhook")
+			os.Exit(1)
+		}
+	}
+	// Rollouts are set on SwapMaps
+	if enableSwapMapSource {
+		if err = (&controller.RolloutRestartReconciler{
+			Client:                mgr.GetClient(),
+			APIReader:             mgr.GetAPIReader(),
+			Scheme:                mgr.GetScheme(),
+			MapStore:              ImgSwapMapStore,
+			Recorder:              mgr.GetEventRecorderFor("imgswap-controller"),
+			ManagerNamespace:      os.Getenv("POD_NAMESPACE"),
+			ManagerServiceAccount: os.Getenv("POD_SERVICE_ACCOUNT"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "RolloutRestart")
+			os.Exit(1)
+		}
+	}
+	if enablePullSecretSync {
+		if err = (&controller.PullSecretReconciler{
+			Client:          mgr.GetClient(),
+			APIReader:       mgr.GetAPIReader(),
+			Scheme:          mgr.GetScheme(),
+			Recorder:        mgr.GetEventRecorderFor("imgswap-controller"),
+			MapStore:        ImgSwapMapStore,
+			SourceNamespace: pullSecretSourceNamespace,
+			WatchSwapMaps:   enableSwapMapSource,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "PullSecret")
+			os.Exit(1)
+		}
+	}
+	if enableDriftScanner {
+		if err = mgr.Add(&controller.DriftScanner{
+			Client:                mgr.GetClient(),
+			APIReader:             mgr.GetAPIReader(),
+			MapStore:              ImgSwapMapStore,
+			Recorder:              mgr.GetEventRecorderFor("imgswap-controller"),
+			Interval:              driftScanInterval,
+			ReportName:            driftReportName,
+			ManagerNamespace:      os.Getenv("POD_NAMESPACE"),
+			ManagerServiceAccount: os.Getenv("POD_SERVICE_ACCOUNT"),
+			RestartWorkloads:      driftRestartWorkloads,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up drift scanner")
+			os.Exit(1)
+		}
+	}
+	if enableCertRotation {
+		namespace := os.Getenv("POD_NAMESPACE")
+		var crds []string
+		if enableSwapMapSource {
+			crds = append(crds, "swapmaps."+mapsv1alpha1.GroupVersion.Group)
+		}
+		certRotator := &controller.CertRotator{
+			Client:    mgr.GetClient(),
+			APIReader: mgr.GetAPIReader(),
+			Secret:    types.NamespacedName{Namespace: namespace, Name: certRotationSecret},
+			CertDir:   webhookCertDir,
+			DNSNames: []string{
+				webhookServiceName + "." + namespace + ".svc",
+				webhookServiceName + "." + namespace + ".svc.cluster.local",
+			},
+			WebhookConfigurations:     []string{webhookConfig, customResourceWebhookConfig},
+			CustomResourceDefinitions: crds,
+		}
+		// The webhook server needs a certificate to start, so create it before the manager starts
+		if err := certRotator.Refresh(ctx); err != nil {
+			setupLog.Error(err, "unable to set up webhook certificates")
+			os.Exit(1)
+		}
+		if err := mgr.Add(certRotator); err != nil {
+			setupLog.Error(err, "unable to set up webhook certificate rotation")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
+	auditLogger, err := auditOpts.NewLogger()
+	if err != nil {
+		setupLog.Error(err, "unable to set up audit logging")
+		os.Exit(1)
+	}
+	if auditLogger != nil {
+		for _, sink := range auditLogger.Sinks {
+			if runnable, ok := sink.(manager.Runnable); ok {
+				if err := mgr.Add(runnable); err != nil {
+					setupLog.Error(err, "unable to set up audit sink")
+					os.Exit(1)
+				}
+			}
+		}
+	}
+
 	// Register PodImageSwapper webhook
-	mgr.GetWebhookServer().Register("/pod-imgswap", &webhook.Admission{Handler: &webhooks.PodImageSwapper{Client: mgr.GetClient()}})
+	podImageSwapper := &webhooks.PodImageSwapper{
+		Client:                mgr.GetClient(),
+		MapStore:              ImgSwapMapStore,
+		ManagerNamespace:      os.Getenv("POD_NAMESPACE"),
+		ManagerServiceAccount: os.Getenv("POD_SERVICE_ACCOUNT"),
+		Recorder:              mgr.GetEventRecorderFor("imgswap-webhook"),
+		AuditLogger:           auditLogger,
+	}
+	if err := podImageSwapper.InjectDecoder(admission.NewDecoder(mgr.GetScheme())); err != nil {
+		setupLog.Error(err, "unable to set up webhook decoder", "webhook", "PodImageSwapper")
+		os.Exit(1)
+	}
+	mgr.GetWebhookServer().Register("/pod-imgswap", &webhook.Admission{Handler: podImageSwapper})
+
+	// Register the SwapMap conversion webhook
+	if enableSwapMapSource {
+		if err := (&mapsv1beta1.SwapMap{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "SwapMap")
+			os.Exit(1)
+		}
+	}
+
+	// Register CustomResourceImageSwapper webhook
+	if enableImageFieldPolicies {
+		mgr.GetWebhookServer().Register("/custom-imgswap", &webhook.Admission{Handler: &webhooks.CustomResourceImageSwapper{
+			MapStore:    ImgSwapMapStore,
+			Policies:    fieldPolicies,
+			Recorder:    mgr.GetEventRecorderFor("imgswap-webhook"),
+			AuditLogger: auditLogger,
+		}})
+	}
+
+	// Register WorkloadImageSwapper webhook
+	if enableWorkloadWebhook {
+		workloadImageSwapper := &webhooks.WorkloadImageSwapper{
+			Client:                mgr.GetClient(),
+			MapStore:              ImgSwapMapStore,
+			ManagerNamespace:      os.Getenv("POD_NAMESPACE"),
+			ManagerServiceAccount: os.Getenv("POD_SERVICE_ACCOUNT"),
+			Recorder:              mgr.GetEventRecorderFor("imgswap-webhook"),
+			AuditLogger:           auditLogger,
+		}
+		if err := workloadImageSwapper.InjectDecoder(admission.NewDecoder(mgr.GetScheme())); err != nil {
+			setupLog.Error(err, "unable to set up webhook decoder", "webhook", "WorkloadImageSwapper")
+			os.Exit(1)
+		}
+		mgr.GetWebhookServer().Register("/workload-imgswap", &webhook.Admission{Handler: workloadImageSwapper})
+	}
+
+	if enableDebugEndpoints {
+		debugHandler := &debug.Handler{
+			MapStore:   ImgSwapMapStore,
+			Reader:     mgr.GetAPIReader(),
+			Authorizer: &debug.Authorizer{Client: mgr.GetClient()},
+		}
+		if err := mgr.AddMetricsExtraHandler(debug.MapStorePath, http.HandlerFunc(debugHandler.ServeMapStore)); err != nil {
+			setupLog.Error(err, "unable to set up debug endpoint", "path", debug.MapStorePath)
+			os.Exit(1)
+		}
+		if err := mgr.AddMetricsExtraHandler(debug.ResolvePath, http.HandlerFunc(debugHandler.ServeResolve)); err != nil {
+			setupLog.Error(err, "unable to set up debug endpoint", "path", debug.ResolvePath)
+			os.Exit(1)
+		}
+	}
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
+	if swapMapReconciler != nil {
+		if err := mgr.AddHealthzCheck("reconciler", swapMapReconciler.HealthzCheck); err != nil {
+			setupLog.Error(err, "unable to set up health check")
+			os.Exit(1)
+		}
+	}
 	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("mapstore", ImgSwapMapStore.ReadyzCheck); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
@@ -0,0 +1,165 @@
+/*
+Copyright 2023 The Webroot, Inc..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"twr.dev/imgswap/internal/controller"
+	"twr.dev/imgswap/pkg/audit"
+	"twr.dev/imgswap/pkg/webhooks"
+)
+
+const (
+	// modeManager runs the controllers and every webhook
+	modeManager = "manager"
+	// modeWebhookOnly runs just the pod webhook from map files
+	modeWebhookOnly = "webhook-only"
+)
+
+// webhookOnlyOptions configures runWebhookOnly
+type webhookOnlyOptions struct {
+	MetricsAddr      string
+	ProbeAddr        string
+	WebhookPort      int
+	CertDir          string
+	MapDir           string
+	MapDirPrecedence int
+	AuditLogger      *audit.Logger
+}
+
+// runWebhookOnly serves the PodImageSwapper from the maps in --map-dir
+// without a controller manager: there are no CRDs, caches, controllers or
+// leader election, and the only thing talking to the API server is the API
+// server calling the webhook. The webhook has its own TLS server, with the
+// metrics and probe endpoints served over plain HTTP as the manager does.
+func runWebhookOnly(ctx context.Context, opts webhookOnlyOptions) error {
+	if opts.MapDir == "" {
+		return errors.New("--map-dir is required in " + modeWebhookOnly + " mode")
+	}
+
+	fileSource := &controller.FileSource{
+		Dir:        opts.MapDir,
+		MapStore:   ImgSwapMapStore,
+		Precedence: opts.MapDirPrecedence,
+	}
+	if err := fileSource.Load(); err != nil {
+		return fmt.Errorf("unable to load maps from %s: %w", opts.MapDir, err)
+	}
+	// The files are the only source, so the MapStore is in sync once they are loaded
+	ImgSwapMapStore.MarkSynced()
+
+	podImageSwapper := &webhooks.PodImageSwapper{
+		MapStore:              ImgSwapMapStore,
+		ManagerNamespace:      os.Getenv("POD_NAMESPACE"),
+		ManagerServiceAccount: os.Getenv("POD_SERVICE_ACCOUNT"),
+		AuditLogger:           opts.AuditLogger,
+	}
+	if err := podImageSwapper.InjectDecoder(admission.NewDecoder(scheme)); err != nil {
+		return fmt.Errorf("unable to set up webhook decoder: %w", err)
+	}
+	webhookServer := webhook.NewServer(webhook.Options{
+		Port:    opts.WebhookPort,
+		CertDir: opts.CertDir,
+	})
+	webhookServer.Register("/pod-imgswap", &webhook.Admission{Handler: podImageSwapper})
+
+	probes := http.NewServeMux()
+	probes.Handle("/healthz", http.StripPrefix("/healthz", &healthz.Handler{Checks: map[string]healthz.Checker{
+		"healthz": healthz.Ping,
+	}}))
+	probes.Handle("/readyz", http.StripPrefix("/readyz", &healthz.Handler{Checks: map[string]healthz.Checker{
+		"readyz":   healthz.Ping,
+		"mapstore": ImgSwapMapStore.ReadyzCheck,
+	}}))
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+
+	runnables := []manager.Runnable{
+		fileSource,
+		webhookServer,
+		httpServerRunnable(opts.ProbeAddr, probes),
+		httpServerRunnable(opts.MetricsAddr, metricsMux),
+	}
+	if opts.AuditLogger != nil {
+		for _, sink := range opts.AuditLogger.Sinks {
+			if runnable, ok := sink.(manager.Runnable); ok {
+				runnables = append(runnables, runnable)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(runnables))
+	for _, runnable := range runnables {
+		runnable := runnable
+		go func() {
+			errs <- runnable.Start(ctx)
+		}()
+	}
+
+	// Stop everything as soon as one runnable fails or the context is cancelled
+	var err error
+	for range runnables {
+		if err = <-errs; err != nil {
+			break
+		}
+	}
+	return err
+}
+
+// httpServerRunnable serves the handler on the address until the context is
+// cancelled. An empty address or "0" disables the server, like the manager's
+// metrics and probe addresses.
+func httpServerRunnable(addr string, handler http.Handler) manager.RunnableFunc {
+	return func(ctx context.Context) error {
+		if addr == "" || addr == "0" {
+			return nil
+		}
+
+		server := &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_ = server.Shutdown(shutdownCtx)
+		}()
+
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("unable to serve %s: %w", addr, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,501 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// CACertKey is the Secret key holding the CA bundle, newest CA first
+	CACertKey = "ca.crt"
+	// CAKeyKey is the Secret key holding the private key of the newest CA
+	CAKeyKey = "ca.key"
+
+	// DefaultCAValidity is how long a generated CA is valid for
+	DefaultCAValidity = 10 * 365 * 24 * time.Hour
+	// DefaultCertValidity is how long a generated serving certificate is valid for
+	DefaultCertValidity = 365 * 24 * time.Hour
+	// DefaultCertRotateBefore is how long before expiry the CA and serving certificate are replaced
+	DefaultCertRotateBefore = 30 * 24 * time.Hour
+	// DefaultCertCheckInterval is how often the certificates are checked
+	DefaultCertCheckInterval = time.Hour
+)
+
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;create;update
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=get;patch
+//+kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;patch
+
+// CertRotator manages the webhook server's TLS certificate without
+// cert-manager. It keeps a self-signed CA and a serving certificate for
+// DNSNames in a Secret, so every replica serves the same certificate, writes
+// the serving certificate to the webhook server's CertDir and sets the CA
+// bundle on the webhook configurations. The CA and serving certificate are
+// replaced RotateBefore their expiry, with the previous CA staying in the
+// bundle until it expires so certificates it issued remain trusted while
+// replicas pick up the new one.
+//
+// It runs on every replica regardless of leader election. Concurrent updates
+// to the Secret are resolved by the API server's optimistic concurrency.
+type CertRotator struct {
+	Client client.Client
+	// APIReader reads the Secret and webhook configurations directly from the
+	// API server, as neither is in the manager's cache and Refresh runs
+	// before the cache is started
+	APIReader client.Reader
+	// Secret is the Secret holding the CA and serving certificate
+	Secret types.NamespacedName
+	// CertDir is the webhook server's certificate directory
+	CertDir string
+	// DNSNames are the names the serving certificate is valid for, usually
+	// the webhook Service's <name>.<namespace>.svc
+	DNSNames []string
+	// WebhookConfigurations are the MutatingWebhookConfigurations whose
+	// webhooks get the CA bundle. Missing configurations are skipped.
+	WebhookConfigurations []string
+	// CustomResourceDefinitions are the CRDs whose conversion webhook gets the
+	// CA bundle. CRDs that are missing or don't use a conversion webhook are
+	// skipped. apiextensions/v1 must be registered with the client's scheme.
+	CustomResourceDefinitions []string
+	// CAValidity defaults to DefaultCAValidity
+	CAValidity time.Duration
+	// CertValidity defaults to DefaultCertValidity
+	CertValidity time.Duration
+	// RotateBefore defaults to DefaultCertRotateBefore
+	RotateBefore time.Duration
+	// CheckInterval defaults to DefaultCertCheckInterval
+	CheckInterval time.Duration
+	// Now returns the current time. Defaults to time.Now, tests can fake it.
+	Now func() time.Time
+}
+
+// Refresh makes sure the Secret holds a valid CA and serving certificate,
+// rotating them if they are about to expire, then sets the CA bundle on the
+// webhook configurations and writes the serving certificate to CertDir. Call
+// it before the webhook server starts so it has a certificate to serve.
+func (r *CertRotator) Refresh(ctx context.Context) error {
+	secret := &corev1.Secret{}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret = &corev1.Secret{}
+		err := r.APIReader.Get(ctx, r.Secret, secret)
+		if apierrors.IsNotFound(err) {
+			secret = &corev1.Secret{}
+			secret.Name = r.Secret.Name
+			secret.Namespace = r.Secret.Namespace
+			secret.Type = corev1.SecretTypeTLS
+			if _, err := r.rotate(secret); err != nil {
+				return err
+			}
+			log.Log.Info("Creating webhook certificates", "secret", r.Secret.String())
+			err = r.Client.Create(ctx, secret)
+			if apierrors.IsAlreadyExists(err) {
+				// Another replica created it first, use theirs
+				return apierrors.NewConflict(corev1.Resource("secrets"), r.Secret.Name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		rotated, err := r.rotate(secret)
+		if err != nil || !rotated {
+			return err
+		}
+		log.Log.Info("Rotating webhook certificates", "secret", r.Secret.String())
+		return r.Client.Update(ctx, secret)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update webhook certificate secret %s: %w", r.Secret, err)
+	}
+
+	// Trust the new CA before serving certificates it issued
+	for _, name := range r.WebhookConfigurations {
+		if err := r.injectCABundle(ctx, name, secret.Data[CACertKey]); err != nil {
+			return err
+		}
+	}
+	for _, name := range r.CustomResourceDefinitions {
+		if err := r.injectConversionCABundle(ctx, name, secret.Data[CACertKey]); err != nil {
+			return err
+		}
+	}
+
+	return r.writeCerts(secret)
+}
+
+// Start refreshes the certificates every CheckInterval until the context is cancelled
+func (r *CertRotator) Start(ctx context.Context) error {
+	interval := r.CheckInterval
+	if interval == 0 {
+		interval = DefaultCertCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.Refresh(ctx); err != nil {
+				log.Log.Error(err, "unable to refresh webhook certificates")
+			}
+		}
+	}
+}
+
+func (r *CertRotator) NeedLeaderElection() bool {
+	return false
+}
+
+// rotate replaces the CA and serving certificate in the Secret if they are
+// missing, invalid or about to expire, and reports whether it changed anything
+func (r *CertRotator) rotate(secret *corev1.Secret) (bool, error) {
+	now := r.now()
+	rotateAt := now.Add(r.rotateBefore())
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	rotated := false
+
+	bundle, _ := parseCertificates(secret.Data[CACertKey])
+	caKey, keyErr := parsePrivateKey(secret.Data[CAKeyKey])
+	if len(bundle) == 0 || keyErr != nil || bundle[0].NotAfter.Before(rotateAt) {
+		ca, key, err := newCA(now, valueOr(r.CAValidity, DefaultCAValidity))
+		if err != nil {
+			return false, err
+		}
+		// Keep trusting the previous CAs until they expire
+		bundle = append([]*x509.Certificate{ca}, bundle...)
+		caKey = key
+		if secret.Data[CAKeyKey], err = encodePrivateKey(key); err != nil {
+			return false, err
+		}
+		rotated = true
+	}
+
+	current := []*x509.Certificate{bundle[0]}
+	for _, ca := range bundle[1:] {
+		if ca.NotAfter.After(now) {
+			current = append(current, ca)
+		}
+	}
+	caBundle := encodeCertificates(current)
+	if !bytes.Equal(caBundle, secret.Data[CACertKey]) {
+		secret.Data[CACertKey] = caBundle
+		rotated = true
+	}
+
+	// servingCertValid fails when the CA was just replaced, as the certificate wasn't issued by it
+	if r.servingCertValid(secret, bundle[0], rotateAt) {
+		return rotated, nil
+	}
+
+	certPEM, keyPEM, err := newServingCert(bundle[0], caKey, r.DNSNames, now, valueOr(r.CertValidity, DefaultCertValidity))
+	if err != nil {
+		return false, err
+	}
+	secret.Data[corev1.TLSCertKey] = certPEM
+	secret.Data[corev1.TLSPrivateKeyKey] = keyPEM
+
+	return true, nil
+}
+
+// servingCertValid reports whether the Secret's serving certificate was issued
+// by the CA for DNSNames and doesn't need rotating yet
+func (r *CertRotator) servingCertValid(secret *corev1.Secret, ca *x509.Certificate, rotateAt time.Time) bool {
+	certs, err := parseCertificates(secret.Data[corev1.TLSCertKey])
+	if err != nil || len(certs) == 0 {
+		return false
+	}
+	if _, err := parsePrivateKey(secret.Data[corev1.TLSPrivateKeyKey]); err != nil {
+		return false
+	}
+
+	cert := certs[0]
+	if cert.NotAfter.Before(rotateAt) || cert.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+
+	want := append([]string{}, r.DNSNames...)
+	have := append([]string{}, cert.DNSNames...)
+	sort.Strings(want)
+	sort.Strings(have)
+	return fmt.Sprint(want) == fmt.Sprint(have)
+}
+
+// injectCABundle sets the CA bundle on every webhook of the named configuration
+func (r *CertRotator) injectCABundle(ctx context.Context, name string, caBundle []byte) error {
+	webhookConfig := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := r.APIReader.Get(ctx, types.NamespacedName{Name: name}, webhookConfig); err != nil {
+		if apierrors.IsNotFound(err) {
+			log.Log.V(1).Info("Webhook configuration not found, skipping CA injection", "name", name)
+			return nil
+		}
+		return fmt.Errorf("unable to get webhook configuration %s: %w", name, err)
+	}
+
+	patch := client.MergeFromWithOptions(webhookConfig.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	changed := false
+	for i := range webhookConfig.Webhooks {
+		if !bytes.Equal(webhookConfig.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			webhookConfig.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	log.Log.Info("Injecting CA bundle", "webhookConfiguration", name)
+	if err := r.Client.Patch(ctx, webhookConfig, patch); err != nil {
+		return fmt.Errorf("unable to inject CA bundle into webhook configuration %s: %w", name, err)
+	}
+	return nil
+}
+
+// injectConversionCABundle sets the CA bundle on the conversion webhook of the named CRD
+func (r *CertRotator) injectConversionCABundle(ctx context.Context, name string, caBundle []byte) error {
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := r.APIReader.Get(ctx, types.NamespacedName{Name: name}, crd); err != nil {
+		if apierrors.IsNotFound(err) {
+			log.Log.V(1).Info("CustomResourceDefinition not found, skipping CA injection", "name", name)
+			return nil
+		}
+		return fmt.Errorf("unable to get CustomResourceDefinition %s: %w", name, err)
+	}
+
+	conversion := crd.Spec.Conversion
+	if conversion == nil || conversion.Strategy != apiextensionsv1.WebhookConverter ||
+		conversion.Webhook == nil || conversion.Webhook.ClientConfig == nil {
+		return nil
+	}
+	if bytes.Equal(conversion.Webhook.ClientConfig.CABundle, caBundle) {
+		return nil
+	}
+
+	patch := client.MergeFromWithOptions(crd.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	conversion.Webhook.ClientConfig.CABundle = caBundle
+	log.Log.Info("Injecting CA bundle", "customResourceDefinition", name)
+	if err := r.Client.Patch(ctx, crd, patch); err != nil {
+		return fmt.Errorf("unable to inject CA bundle into CustomResourceDefinition %s: %w", name, err)
+	}
+	return nil
+}
+
+// writeCerts writes the serving certificate to CertDir if it changed. The
+// webhook server watches the files and picks up the new certificate.
+func (r *CertRotator) writeCerts(secret *corev1.Secret) error {
+	if err := os.MkdirAll(r.CertDir, 0o700); err != nil {
+		return fmt.Errorf("unable to create webhook certificate directory: %w", err)
+	}
+
+	// The key goes first so the certificate never refers to a key that isn't there yet
+	for _, key := range []string{corev1.TLSPrivateKeyKey, corev1.TLSCertKey} {
+		path := filepath.Join(r.CertDir, key)
+		if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, secret.Data[key]) {
+			continue
+		}
+		if err := writeFileAtomic(path, secret.Data[key]); err != nil {
+			return fmt.Errorf("unable to write webhook certificate: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *CertRotator) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+func (r *CertRotator) rotateBefore() time.Duration {
+	return valueOr(r.RotateBefore, DefaultCertRotateBefore)
+}
+
+func valueOr(value, fallback time.Duration) time.Duration {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
+// writeFileAtomic replaces the file in one step so the webhook server never reads a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// newCA generates a self-signed CA certificate and key
+func newCA(now time.Time, validity time.Duration) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate CA key: %w", err)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "imgswap-webhook-ca", Organization: []string{"imgswap"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create CA certificate: %w", err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+// newServingCert issues a serving certificate for the DNS names from the CA,
+// expiring no later than the CA itself
+func newServingCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey, dnsNames []string, now time.Time, validity time.Duration) ([]byte, []byte, error) {
+	if len(dnsNames) == 0 {
+		return nil, nil, errors.New("no DNS names for the webhook serving certificate")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate serving key: %w", err)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notAfter := now.Add(validity)
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create serving certificate: %w", err)
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+// parseCertificates parses every certificate in PEM data
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+func encodeCertificates(certs []*x509.Certificate) []byte {
+	data := []byte{}
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return data
+}
+
+func parsePrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func encodePrivateKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
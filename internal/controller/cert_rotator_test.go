@@ -0,0 +1,162 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+)
+
+var _ = Describe("CertRotator", func() {
+	var (
+		ctx      context.Context
+		now      time.Time
+		rotator  *CertRotator
+		webhook  *admissionregistrationv1.MutatingWebhookConfiguration
+		certDir  string
+		secretNN types.NamespacedName
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		now = time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+		certDir = GinkgoT().TempDir()
+		secretNN = types.NamespacedName{Namespace: "default", Name: "webhook-certs-" + utilrand.String(5)}
+
+		url := "https://imgswap.example.com/pod-imgswap"
+		sideEffects := admissionregistrationv1.SideEffectClassNone
+		webhook = &admissionregistrationv1.MutatingWebhookConfiguration{
+			Webhooks: []admissionregistrationv1.MutatingWebhook{{
+				Name:                    "swap.imgswap.io",
+				ClientConfig:            admissionregistrationv1.WebhookClientConfig{URL: &url},
+				SideEffects:             &sideEffects,
+				AdmissionReviewVersions: []string{"v1"},
+			}},
+		}
+		webhook.Name = "cert-rotator-" + utilrand.String(5)
+		Expect(k8sClient.Create(ctx, webhook)).To(Succeed())
+
+		rotator = &CertRotator{
+			Client:                k8sClient,
+			APIReader:             k8sClient,
+			Secret:                secretNN,
+			CertDir:               certDir,
+			DNSNames:              []string{"webhook-service.default.svc"},
+			WebhookConfigurations: []string{webhook.Name, "missing-webhook-configuration"},
+			CAValidity:            90 * 24 * time.Hour,
+			CertValidity:          30 * 24 * time.Hour,
+			RotateBefore:          7 * 24 * time.Hour,
+			Now:                   func() time.Time { return now },
+		}
+	})
+
+	AfterEach(func() {
+		Expect(k8sClient.Delete(ctx, webhook)).To(Succeed())
+	})
+
+	// served returns the CA bundle on the webhook and the certificate in CertDir
+	served := func() ([]*x509.Certificate, *x509.Certificate) {
+		current := &admissionregistrationv1.MutatingWebhookConfiguration{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: webhook.Name}, current)).To(Succeed())
+		bundle, err := parseCertificates(current.Webhooks[0].ClientConfig.CABundle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bundle).NotTo(BeEmpty())
+
+		data, err := os.ReadFile(filepath.Join(certDir, corev1.TLSCertKey))
+		Expect(err).NotTo(HaveOccurred())
+		certs, err := parseCertificates(data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(certs).To(HaveLen(1))
+		_, err = os.Stat(filepath.Join(certDir, corev1.TLSPrivateKeyKey))
+		Expect(err).NotTo(HaveOccurred())
+		return bundle, certs[0]
+	}
+
+	It("creates the certificates and injects the CA bundle", func() {
+		Expect(rotator.Refresh(ctx)).To(Succeed())
+
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, secretNN, secret)).To(Succeed())
+		Expect(secret.Data).To(HaveKey(CACertKey))
+		Expect(secret.Data).To(HaveKey(CAKeyKey))
+
+		bundle, cert := served()
+		Expect(bundle).To(HaveLen(1))
+		Expect(cert.CheckSignatureFrom(bundle[0])).To(Succeed())
+		Expect(cert.DNSNames).To(ConsistOf("webhook-service.default.svc"))
+
+		By("leaving valid certificates alone")
+		Expect(rotator.Refresh(ctx)).To(Succeed())
+		_, again := served()
+		Expect(again.SerialNumber).To(Equal(cert.SerialNumber))
+	})
+
+	It("rotates the serving certificate before it expires", func() {
+		Expect(rotator.Refresh(ctx)).To(Succeed())
+		bundle, cert := served()
+
+		now = now.Add(24 * 24 * time.Hour)
+		Expect(rotator.Refresh(ctx)).To(Succeed())
+
+		rotatedBundle, rotated := served()
+		Expect(rotated.SerialNumber).NotTo(Equal(cert.SerialNumber))
+		Expect(rotatedBundle[0].Equal(bundle[0])).To(BeTrue())
+		Expect(rotated.CheckSignatureFrom(bundle[0])).To(Succeed())
+	})
+
+	It("rotates the CA before it expires and keeps trusting the old one until it expires", func() {
+		Expect(rotator.Refresh(ctx)).To(Succeed())
+		bundle, _ := served()
+
+		now = now.Add(84 * 24 * time.Hour)
+		Expect(rotator.Refresh(ctx)).To(Succeed())
+
+		rotatedBundle, rotated := served()
+		Expect(rotatedBundle).To(HaveLen(2))
+		Expect(rotatedBundle[0].Equal(bundle[0])).To(BeFalse())
+		Expect(rotatedBundle[1].Equal(bundle[0])).To(BeTrue())
+		Expect(rotated.CheckSignatureFrom(rotatedBundle[0])).To(Succeed())
+
+		By("dropping the old CA once it expires")
+		now = now.Add(7 * 24 * time.Hour)
+		Expect(rotator.Refresh(ctx)).To(Succeed())
+		prunedBundle, _ := served()
+		Expect(prunedBundle).To(HaveLen(1))
+		Expect(prunedBundle[0].Equal(rotatedBundle[0])).To(BeTrue())
+	})
+
+	It("reissues the serving certificate when the DNS names change", func() {
+		Expect(rotator.Refresh(ctx)).To(Succeed())
+
+		rotator.DNSNames = []string{"webhook-service.default.svc", "webhook-service.default.svc.cluster.local"}
+		Expect(rotator.Refresh(ctx)).To(Succeed())
+
+		_, cert := served()
+		Expect(cert.DNSNames).To(ConsistOf(rotator.DNSNames))
+	})
+})
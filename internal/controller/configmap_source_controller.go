@@ -0,0 +1,207 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	mapsv1beta1 "twr.dev/imgswap/api/v1beta1"
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+const (
+	// ConfigMapSourceLabel marks ConfigMaps holding maps to load
+	ConfigMapSourceLabel = "imgswap.io/swapmap"
+	// ConfigMapSourcePrefix prefixes the "namespace/name" of a ConfigMap to form its MapStore source
+	ConfigMapSourcePrefix = "configmap:"
+
+	// ReasonMapsInvalid is the event reason used when a ConfigMap's maps can't be parsed
+	ReasonMapsInvalid = "MapsInvalid"
+
+	// DefaultConfigMapSourcePrecedence puts ConfigMap maps below SwapMaps, so
+	// they act as a baseline SwapMaps can override
+	DefaultConfigMapSourcePrecedence = SwapMapPrecedence - 1
+)
+
+// ConfigMapSourceReconciler loads maps from ConfigMaps labelled
+// ConfigMapSourceLabel=true, for clusters where the SwapMap CRD can't be
+// installed or to bootstrap maps before it is. Every value in the ConfigMap's
+// data holds either SwapMap manifests or SwapMap specs as YAML:
+//
+//	data:
+//	  maps.yaml: |
+//	    maps:
+//	      - name: default
+//	        type: default
+//	        swapTo:
+//	          registry: harbor.example.com
+type ConfigMapSourceReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	MapStore *mapstore.MapStore
+	Recorder record.EventRecorder
+	// Precedence of the ConfigMap maps against SwapMapPrecedence. Higher wins.
+	Precedence int
+}
+
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile loads the maps of a labelled ConfigMap into the MapStore.
+func (r *ConfigMapSourceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var configMap corev1.ConfigMap
+
+	source := ConfigMapSourcePrefix + req.NamespacedName.String()
+	err := r.Client.Get(ctx, req.NamespacedName, &configMap)
+	if apierrors.IsNotFound(err) || (err == nil && configMap.Labels[ConfigMapSourceLabel] != "true") {
+		log.Log.Info("ConfigMap deleted or unlabelled, removing its maps", "namespace", req.Namespace, "name", req.Name)
+		r.MapStore.DeleteSource(source)
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		log.Log.Error(err, "unable to fetch ConfigMap")
+		return ctrl.Result{}, err
+	}
+
+	maps, err := parseSourceMaps(configMap.Data)
+	if err != nil {
+		// Keep serving the maps last loaded from the ConfigMap until it's fixed
+		log.Log.Error(err, "unable to parse ConfigMap maps", "namespace", req.Namespace, "name", req.Name)
+		r.Recorder.Eventf(&configMap, corev1.EventTypeWarning, ReasonMapsInvalid, "Maps not loaded: %v", err)
+		if _, loaded := r.MapStore.SourceGeneration(source); !loaded {
+			// Nothing was loaded before, so load no maps rather than hold up the initial sync
+			r.MapStore.LoadSource(source, r.Precedence, configMap.Generation, false, nil)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	log.Log.Info("Got ConfigMap", "namespace", req.Namespace, "name", req.Name, "maps", len(maps))
+	loadMaps(r.MapStore, r.Recorder, &configMap, source, r.Precedence, configMap.Generation, false, maps)
+
+	return ctrl.Result{}, nil
+}
+
+// parseSourceMaps returns the maps in every value of a ConfigMap's data, or
+// of a map file keyed by its name, in key order
+func parseSourceMaps(data map[string]string) ([]mapsv1alpha1.Map, error) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	maps := []mapsv1alpha1.Map{}
+	for _, key := range keys {
+		reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewBufferString(data[key])))
+		for {
+			doc, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+
+			var header struct {
+				APIVersion string `json:"apiVersion"`
+			}
+			if err := yaml.Unmarshal(doc, &header); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			if header.APIVersion == mapsv1beta1.GroupVersion.String() {
+				swapMap, err := parseV1beta1SwapMap(doc)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", key, err)
+				}
+				maps = append(maps, swapMap.Spec.Maps...)
+				continue
+			}
+
+			// Either a whole v1alpha1 SwapMap or just its spec
+			var document struct {
+				APIVersion string                   `json:"apiVersion"`
+				Kind       string                   `json:"kind"`
+				Metadata   map[string]interface{}   `json:"metadata"`
+				Spec       mapsv1alpha1.SwapMapSpec `json:"spec"`
+				mapsv1alpha1.SwapMapSpec
+			}
+			if err := yaml.UnmarshalStrict(doc, &document); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			if document.Kind != "" && document.Kind != "SwapMap" {
+				return nil, fmt.Errorf("%s: unsupported kind %q", key, document.Kind)
+			}
+			maps = append(maps, document.Maps...)
+			maps = append(maps, document.Spec.Maps...)
+		}
+	}
+	return maps, nil
+}
+
+// parseV1beta1SwapMap parses a whole v1beta1 SwapMap and converts it to v1alpha1
+func parseV1beta1SwapMap(doc []byte) (*mapsv1alpha1.SwapMap, error) {
+	var document struct {
+		APIVersion string                  `json:"apiVersion"`
+		Kind       string                  `json:"kind"`
+		Metadata   map[string]interface{}  `json:"metadata"`
+		Spec       mapsv1beta1.SwapMapSpec `json:"spec"`
+	}
+	if err := yaml.UnmarshalStrict(doc, &document); err != nil {
+		return nil, err
+	}
+	if document.Kind != "SwapMap" {
+		return nil, fmt.Errorf("unsupported kind %q", document.Kind)
+	}
+
+	swapMap := &mapsv1alpha1.SwapMap{}
+	if err := swapMap.ConvertFrom(&mapsv1beta1.SwapMap{Spec: document.Spec}); err != nil {
+		return nil, err
+	}
+	return swapMap, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+//
+// The manager's cache should be restricted to ConfigMaps labelled
+// ConfigMapSourceLabel. Like the SwapMapReconciler it runs on every replica.
+func (r *ConfigMapSourceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	needLeaderElection := false
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("configmapsource").
+		For(&corev1.ConfigMap{}).
+		WithOptions(controller.Options{NeedLeaderElection: &needLeaderElection}).
+		Complete(r)
+}
@@ -0,0 +1,369 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/metrics"
+	"twr.dev/imgswap/pkg/webhooks"
+)
+
+const (
+	// ReasonImageDrift is the event reason used when a running pod has images the maps would swap
+	ReasonImageDrift = "ImageDrift"
+	// ReasonDriftRestart is the event reason used when a workload is restarted to pick up swapped images
+	ReasonDriftRestart = "DriftRestart"
+
+	// DefaultDriftScanInterval is how often the drift scanner lists pods
+	DefaultDriftScanInterval = 10 * time.Minute
+
+	// maxReportedPods caps the pods listed in the SwapReport status to keep the object small
+	maxReportedPods = 100
+	// driftScanPageSize is the number of pods fetched per list call
+	driftScanPageSize = 500
+)
+
+//+kubebuilder:rbac:groups=maps.k8s.imgswap.io,resources=swapreports,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=maps.k8s.imgswap.io,resources=swapreports/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list
+//+kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets,verbs=get;patch
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list
+
+// DriftScanner periodically checks running pods against the MapStore and
+// reports the ones created before a map that would now swap their images, for
+// example pods started before imgswap was installed. Findings are written to
+// the status of the ReportName SwapReport, exported as metrics and recorded as
+// Events on the pods when they start drifting. When RestartWorkloads is set the Deployments,
+// StatefulSets and DaemonSets owning drifted pods are rolled out again so
+// their new pods are swapped at admission.
+//
+// The scanner only runs on the elected leader.
+type DriftScanner struct {
+	Client client.Client
+	// APIReader lists pods and namespaces directly from the API server so the
+	// manager doesn't cache every pod in the cluster
+	APIReader client.Reader
+	MapStore  *mapstore.MapStore
+	Recorder  record.EventRecorder
+	// Interval is the time between scans. Defaults to DefaultDriftScanInterval.
+	Interval time.Duration
+	// ReportName is the name of the cluster scoped SwapReport the scanner writes to
+	ReportName string
+	// ManagerNamespace and ManagerServiceAccount identify the imgswap manager's
+	// own pods, which the webhook never mutates and the scanner ignores
+	ManagerNamespace      string
+	ManagerServiceAccount string
+	// RestartWorkloads enables rollout restarts of the workloads owning drifted pods
+	RestartWorkloads bool
+
+	// reported holds the image each drifted container was expected to run at
+	// the last scan, keyed by "podUID/container", so Events are only recorded
+	// when a container starts drifting or is expected to run another image
+	reported map[string]string
+}
+
+// driftScan is the outcome of a single scan
+type driftScan struct {
+	scannedPods int32
+	pods        []mapsv1alpha1.DriftedPod
+	// workloads are the workloads owning drifted pods, keyed by "namespace/Kind/name"
+	workloads map[string]client.Object
+	// driftedPods and driftedContainers count the drifted pods by namespace and
+	// the drifted containers by map, published once the scan completes
+	driftedPods       map[string]float64
+	driftedContainers map[string]float64
+	// reported replaces DriftScanner.reported once the scan completes
+	reported map[string]string
+}
+
+func (s *DriftScanner) Start(ctx context.Context) error {
+	// Scanning before the MapStore is loaded would report nothing as drifted
+	if err := wait.PollUntilContextCancel(ctx, initialSyncInterval, true, func(context.Context) (bool, error) {
+		return s.MapStore.Synced(), nil
+	}); err != nil {
+		return nil
+	}
+
+	interval := s.Interval
+	if interval == 0 {
+		interval = DefaultDriftScanInterval
+	}
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := s.scan(ctx); err != nil {
+			log.Log.Error(err, "drift scan failed")
+		}
+	}, interval)
+	return nil
+}
+
+func (s *DriftScanner) NeedLeaderElection() bool {
+	return true
+}
+
+// scan checks every pod once and publishes the results
+func (s *DriftScanner) scan(ctx context.Context) error {
+	namespaces, err := listNamespaces(ctx, s.APIReader)
+	if err != nil {
+		return err
+	}
+
+	result := driftScan{
+		workloads:         map[string]client.Object{},
+		driftedPods:       map[string]float64{},
+		driftedContainers: map[string]float64{},
+		reported:          map[string]string{},
+	}
+
+	// Each page is decoded into a new list, decoding into the previous page
+	// would leave fields the new pods don't set at their old values
+	continueToken := ""
+	for {
+		var pods corev1.PodList
+		if err := s.APIReader.List(ctx, &pods, client.Limit(driftScanPageSize), client.Continue(continueToken)); err != nil {
+			return fmt.Errorf("unable to list pods: %w", err)
+		}
+		for i := range pods.Items {
+			s.scanPod(ctx, &pods.Items[i], namespaces, &result)
+		}
+		continueToken = pods.Continue
+		if continueToken == "" {
+			break
+		}
+	}
+
+	s.reported = result.reported
+
+	if s.RestartWorkloads {
+		s.restartWorkloads(ctx, result.workloads)
+	}
+
+	publishDriftMetrics(&result)
+	metrics.DriftScans.Inc()
+	log.Log.Info("Drift scan complete", "scannedPods", result.scannedPods, "driftedPods", len(result.pods))
+	return s.writeReport(ctx, &result)
+}
+
+// scannedNamespaces is what checking pods for drift needs to know about namespaces
+type scannedNamespaces struct {
+	// excluded are the namespaces the webhook doesn't swap images in
+	excluded map[string]bool
+	// labels are the labels of each namespace, for the selectors of maps
+	labels map[string]map[string]string
+}
+
+// listNamespaces returns the namespaces the webhook doesn't swap images in
+// and the labels of every namespace
+func listNamespaces(ctx context.Context, reader client.Reader) (scannedNamespaces, error) {
+	var list corev1.NamespaceList
+	if err := reader.List(ctx, &list); err != nil {
+		return scannedNamespaces{}, fmt.Errorf("unable to list namespaces: %w", err)
+	}
+
+	// kube-system is excluded by the webhook's default namespaceSelector
+	result := scannedNamespaces{
+		excluded: map[string]bool{metav1.NamespaceSystem: true},
+		labels:   make(map[string]map[string]string, len(list.Items)),
+	}
+	for _, namespace := range list.Items {
+		if namespace.Labels[webhooks.DisabledLabel] == "true" {
+			result.excluded[namespace.Name] = true
+		}
+		result.labels[namespace.Name] = namespace.Labels
+	}
+	return result, nil
+}
+
+// containerDrift is a container running an image the maps would swap
+type containerDrift struct {
+	container *corev1.Container
+	decision  mapstore.Decision
+}
+
+// podDrift returns the containers of a running pod with images the maps would
+// swap. Pods and containers the webhook would leave alone are ignored.
+func podDrift(mapStore *mapstore.MapStore, pod *corev1.Pod, namespaces scannedNamespaces) []containerDrift {
+	skipContainers := webhooks.SkippedContainers(pod.Annotations)
+	labels := mapstore.PodLabels{Pod: pod.Labels, Namespace: namespaces.labels[pod.Namespace]}
+	drift := []containerDrift{}
+	check := func(container *corev1.Container, kind mapsv1alpha1.ContainerKind) {
+		if skipContainers[container.Name] {
+			return
+		}
+		resolved := mapstore.ContainerOf(container, kind)
+		resolved.Labels = labels
+		if decision := mapStore.ResolveContainer(container.Image, webhooks.CanaryKey(pod), resolved); drifted(decision) {
+			drift = append(drift, containerDrift{container: container, decision: decision})
+		}
+	}
+
+	for i := range pod.Spec.InitContainers {
+		check(&pod.Spec.InitContainers[i], mapsv1alpha1.ContainerKindInit)
+	}
+	for i := range pod.Spec.Containers {
+		check(&pod.Spec.Containers[i], mapsv1alpha1.ContainerKindRegular)
+	}
+	for i := range pod.Spec.EphemeralContainers {
+		check((*corev1.Container)(&pod.Spec.EphemeralContainers[i].EphemeralContainerCommon), mapsv1alpha1.ContainerKindEphemeral)
+	}
+	return drift
+}
+
+// podScannable reports whether a pod is running in a namespace the webhook
+// swaps images in and hasn't opted out of swapping
+func podScannable(pod *corev1.Pod, excluded map[string]bool, managerNamespace, managerServiceAccount string) bool {
+	return !excluded[pod.Namespace] && pod.DeletionTimestamp == nil &&
+		pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed &&
+		!webhooks.IsManager(managerNamespace, managerServiceAccount, pod.Namespace, &pod.Spec) &&
+		!webhooks.PodSkipped(pod.Annotations)
+}
+
+// scanPod checks the containers of a single pod and adds it to the result if any drifted
+func (s *DriftScanner) scanPod(ctx context.Context, pod *corev1.Pod, namespaces scannedNamespaces, result *driftScan) {
+	if !podScannable(pod, namespaces.excluded, s.ManagerNamespace, s.ManagerServiceAccount) {
+		return
+	}
+	result.scannedPods++
+
+	drift := podDrift(s.MapStore, pod, namespaces)
+	if len(drift) == 0 {
+		return
+	}
+
+	containers := make([]mapsv1alpha1.DriftedContainer, 0, len(drift))
+	for _, d := range drift {
+		containers = append(containers, mapsv1alpha1.DriftedContainer{
+			Name:          d.container.Name,
+			Image:         d.container.Image,
+			ExpectedImage: d.decision.SwappedImage,
+			Map:           d.decision.Map.Name,
+		})
+		result.driftedContainers[d.decision.Map.Name]++
+
+		key := string(pod.UID) + "/" + d.container.Name
+		result.reported[key] = d.decision.SwappedImage
+		if s.reported[key] == d.decision.SwappedImage {
+			continue
+		}
+		s.Recorder.Eventf(pod, corev1.EventTypeWarning, ReasonImageDrift, "Container %q runs image %q, map %q would swap it to %q",
+			d.container.Name, d.container.Image, d.decision.Map.Name, d.decision.SwappedImage)
+	}
+
+	driftedPod := mapsv1alpha1.DriftedPod{Namespace: pod.Namespace, Name: pod.Name, Containers: containers}
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		driftedPod.Owner = owner.Kind + "/" + owner.Name
+	}
+	result.pods = append(result.pods, driftedPod)
+	result.driftedPods[pod.Namespace]++
+
+	if s.RestartWorkloads {
+		// The pod is still reported, it just won't be restarted
+		workload, err := workloadOwner(ctx, s.APIReader, pod)
+		if err != nil {
+			log.Log.Error(err, "unable to find workload owning drifted pod", "pod", client.ObjectKeyFromObject(pod))
+			return
+		}
+		if workload != nil {
+			result.workloads[workloadKey(workload)] = workload
+		}
+	}
+}
+
+// publishDriftMetrics replaces the drift gauges with the counts of a completed
+// scan, so they never show a partial scan
+func publishDriftMetrics(result *driftScan) {
+	metrics.DriftedPods.Reset()
+	for namespace, pods := range result.driftedPods {
+		metrics.DriftedPods.WithLabelValues(namespace).Set(pods)
+	}
+	metrics.DriftedContainers.Reset()
+	for mapName, containers := range result.driftedContainers {
+		metrics.DriftedContainers.WithLabelValues(mapName).Set(containers)
+	}
+}
+
+// drifted reports whether a running image would be swapped by the maps. Images
+// already pointing at the matched map's target were swapped at admission and
+// aren't drifted, even though prefix maps such as "default" would match them again.
+func drifted(decision mapstore.Decision) bool {
+	return decision.Swapped() && !decision.AtTarget()
+}
+
+// restartWorkloads rolls out the workloads owning drifted pods again
+func (s *DriftScanner) restartWorkloads(ctx context.Context, workloads map[string]client.Object) {
+	now := time.Now()
+	for key, workload := range workloads {
+		kind := workloadKind(workload)
+		if budget, err := blockingDisruptionBudget(ctx, s.APIReader, workload); err != nil || budget != "" {
+			log.Log.Info("Not restarting workload, PodDisruptionBudget allows no disruptions", "workload", key, "podDisruptionBudget", budget, "error", err)
+			continue
+		}
+		if err := restartWorkload(ctx, s.Client, workload, now); err != nil {
+			log.Log.Error(err, "unable to restart workload", "workload", key)
+			continue
+		}
+		log.Log.Info("Restarted workload with drifted pods", "workload", key)
+		metrics.DriftRestarts.WithLabelValues(kind).Inc()
+		s.Recorder.Eventf(workload, corev1.EventTypeNormal, ReasonDriftRestart, "Restarted %s to swap images of running pods", kind)
+	}
+}
+
+// writeReport publishes the scan result to the SwapReport status, creating the SwapReport if needed
+func (s *DriftScanner) writeReport(ctx context.Context, result *driftScan) error {
+	var report mapsv1alpha1.SwapReport
+
+	err := s.Client.Get(ctx, types.NamespacedName{Name: s.ReportName}, &report)
+	if apierrors.IsNotFound(err) {
+		report = mapsv1alpha1.SwapReport{ObjectMeta: metav1.ObjectMeta{Name: s.ReportName}}
+		err = s.Client.Create(ctx, &report)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get SwapReport %s: %w", s.ReportName, err)
+	}
+
+	now := metav1.Now()
+	report.Status = mapsv1alpha1.SwapReportStatus{
+		LastScanTime: &now,
+		ScannedPods:  result.scannedPods,
+		DriftedPods:  int32(len(result.pods)),
+		Pods:         result.pods,
+	}
+	if len(report.Status.Pods) > maxReportedPods {
+		report.Status.Pods = report.Status.Pods[:maxReportedPods]
+		report.Status.Truncated = true
+	}
+
+	if err := s.Client.Status().Update(ctx, &report); err != nil {
+		return fmt.Errorf("unable to update SwapReport %s status: %w", s.ReportName, err)
+	}
+	return nil
+}
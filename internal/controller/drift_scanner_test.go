@@ -0,0 +1,168 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/record"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/webhooks"
+)
+
+var _ = Describe("DriftScanner", func() {
+	var (
+		ctx       context.Context
+		recorder  *record.FakeRecorder
+		scanner   *DriftScanner
+		namespace string
+	)
+
+	createPod := func(name string, annotations map[string]string, image string) *corev1.Pod {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		}
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+		return pod
+	}
+
+	// report returns the SwapReport status, keeping only the pods of this test's namespace
+	report := func() mapsv1alpha1.SwapReportStatus {
+		swapReport := &mapsv1alpha1.SwapReport{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: scanner.ReportName}, swapReport)).To(Succeed())
+		status := swapReport.Status
+		status.Pods = nil
+		for _, pod := range swapReport.Status.Pods {
+			if pod.Namespace == namespace {
+				status.Pods = append(status.Pods, pod)
+			}
+		}
+		return status
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		recorder = record.NewFakeRecorder(10)
+
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "drift-" + utilrand.String(5)}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		namespace = ns.Name
+
+		store := mapstore.NewMapStore()
+		store.LoadSource("test", 0, 1, false, map[string]*mapsv1alpha1.Map{
+			"docker.io": {
+				Name:     "docker",
+				Type:     "swap",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+				SwapTo:   mapsv1alpha1.SwapRef{Registry: "harbor.example.com", Project: "dockerhub"},
+			},
+		})
+
+		scanner = &DriftScanner{
+			Client:     k8sClient,
+			APIReader:  k8sClient,
+			MapStore:   store,
+			Recorder:   recorder,
+			ReportName: "drift-" + utilrand.String(5),
+		}
+	})
+
+	It("reports running pods with images the maps would swap", func() {
+		createPod("drifted", nil, "nginx:1.25")
+		createPod("swapped", nil, "harbor.example.com/dockerhub/nginx:1.25")
+		createPod("skipped", map[string]string{webhooks.SkipAnnotation: "true"}, "nginx:1.25")
+		createPod("unmatched", nil, "quay.io/app:1")
+
+		Expect(scanner.scan(ctx)).To(Succeed())
+
+		status := report()
+		Expect(status.LastScanTime).NotTo(BeNil())
+		Expect(status.DriftedPods).To(BeNumerically(">=", 1))
+		Expect(status.Pods).To(Equal([]mapsv1alpha1.DriftedPod{{
+			Namespace: namespace,
+			Name:      "drifted",
+			Containers: []mapsv1alpha1.DriftedContainer{{
+				Name:          "app",
+				Image:         "nginx:1.25",
+				ExpectedImage: "harbor.example.com/dockerhub/nginx:1.25",
+				Map:           "docker",
+			}},
+		}}))
+	})
+
+	It("records an event when a pod starts drifting rather than on every scan", func() {
+		pod := createPod("drifted", nil, "nginx:1.25")
+
+		Expect(scanner.scan(ctx)).To(Succeed())
+		Expect(recorder.Events).To(Receive(ContainSubstring(ReasonImageDrift)))
+
+		Expect(scanner.scan(ctx)).To(Succeed())
+		Expect(recorder.Events).NotTo(Receive())
+
+		By("recording it again once the pod is expected to run another image")
+		scanner.MapStore.LoadSource("test", 0, 2, false, map[string]*mapsv1alpha1.Map{
+			"docker.io": {
+				Name:     "docker",
+				Type:     "swap",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+				SwapTo:   mapsv1alpha1.SwapRef{Registry: "mirror.example.com"},
+			},
+		})
+		Expect(scanner.scan(ctx)).To(Succeed())
+		Expect(recorder.Events).To(Receive(ContainSubstring("mirror.example.com/nginx:1.25")))
+
+		By("dropping pods that are gone")
+		Expect(k8sClient.Delete(ctx, pod)).To(Succeed())
+		Expect(scanner.scan(ctx)).To(Succeed())
+		Expect(report().Pods).To(BeEmpty())
+		Expect(scanner.reported).NotTo(HaveKey(string(pod.UID) + "/app"))
+	})
+
+	It("only reports pods in namespaces the maps' namespace selectors select", func() {
+		scanner.MapStore.LoadSource("test", 0, 2, false, map[string]*mapsv1alpha1.Map{
+			"docker.io": {
+				Name:              "docker",
+				Type:              "swap",
+				SwapFrom:          mapsv1alpha1.SwapRef{Registry: "docker.io"},
+				SwapTo:            mapsv1alpha1.SwapRef{Registry: "harbor.example.com", Project: "dockerhub"},
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "web"}},
+			},
+		})
+		createPod("drifted", nil, "nginx:1.25")
+
+		Expect(scanner.scan(ctx)).To(Succeed())
+		Expect(report().Pods).To(BeEmpty())
+
+		ns := &corev1.Namespace{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: namespace}, ns)).To(Succeed())
+		ns.Labels = map[string]string{"team": "web"}
+		Expect(k8sClient.Update(ctx, ns)).To(Succeed())
+
+		Expect(scanner.scan(ctx)).To(Succeed())
+		Expect(report().Pods).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,166 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+const (
+	// FileSourcePrefix prefixes the path of a file to form its MapStore source
+	FileSourcePrefix = "file:"
+
+	// DefaultFileSourcePrecedence puts file maps below SwapMaps, so they act as
+	// a baseline SwapMaps can override
+	DefaultFileSourcePrecedence = SwapMapPrecedence - 1
+
+	// fileSourceDebounce batches the burst of events a single change to the directory causes
+	fileSourceDebounce = 250 * time.Millisecond
+)
+
+// FileSource loads maps from the YAML files in a directory, typically a
+// mounted ConfigMap or Secret, and reloads them whenever the directory
+// changes. Each file is loaded as its own source and holds SwapMap manifests
+// or specs like a ConfigMap source. Because it doesn't depend on the API
+// server, it gives the webhook a baseline of maps even when the API server is
+// degraded. It runs on every replica regardless of leader election.
+type FileSource struct {
+	// Dir is the directory holding the files. Files starting with "." are
+	// ignored, along with subdirectories.
+	Dir      string
+	MapStore *mapstore.MapStore
+	// Precedence of the file maps against SwapMapPrecedence. Higher wins.
+	Precedence int
+
+	mu sync.Mutex
+	// loaded holds the sources loaded from the directory
+	loaded map[string]bool
+}
+
+// Load reads every file in the directory into the MapStore and removes the
+// maps of files that have gone. A file that can't be parsed keeps its
+// previously loaded maps.
+func (f *FileSource) Load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := os.ReadDir(f.Dir)
+	if err != nil {
+		return fmt.Errorf("unable to read map directory: %w", err)
+	}
+
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if strings.HasPrefix(name, ".") || (ext != ".yaml" && ext != ".yml" && ext != ".json") {
+			continue
+		}
+
+		path := filepath.Join(f.Dir, name)
+		// Mounted ConfigMaps are symlinks, so check what the entry points at
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+
+		source := FileSourcePrefix + path
+		seen[source] = true
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Log.Error(err, "unable to read map file", "file", path)
+			continue
+		}
+		maps, err := parseSourceMaps(map[string]string{name: string(data)})
+		if err != nil {
+			log.Log.Error(err, "unable to parse map file, keeping its previous maps", "file", path)
+			continue
+		}
+
+		loaded, _ := loadMaps(f.MapStore, nil, nil, source, f.Precedence, 0, false, maps)
+		log.Log.Info("Loaded map file", "file", path, "loaded", loaded, "maps", len(maps))
+	}
+
+	for source := range f.loaded {
+		if !seen[source] {
+			log.Log.Info("Map file removed, removing its maps", "file", strings.TrimPrefix(source, FileSourcePrefix))
+			f.MapStore.DeleteSource(source)
+		}
+	}
+	f.loaded = seen
+
+	return nil
+}
+
+// Start watches the directory and reloads it on every change until the context is cancelled
+func (f *FileSource) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to watch map directory: %w", err)
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(f.Dir); err != nil {
+		return fmt.Errorf("unable to watch map directory: %w", err)
+	}
+
+	// Pick up anything that changed between the initial Load and the watch starting
+	if err := f.Load(); err != nil {
+		log.Log.Error(err, "unable to reload map directory", "dir", f.Dir)
+	}
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			log.Log.V(1).Info("Map directory changed", "event", event.String())
+			if reload == nil {
+				reload = time.After(fileSourceDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Log.Error(err, "error watching map directory", "dir", f.Dir)
+		case <-reload:
+			reload = nil
+			if err := f.Load(); err != nil {
+				log.Log.Error(err, "unable to reload map directory", "dir", f.Dir)
+			}
+		}
+	}
+}
+
+func (f *FileSource) NeedLeaderElection() bool {
+	return false
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+const (
+	// initialSyncInterval is how often the initial sync re-checks the MapStore
+	initialSyncInterval = time.Second
+
+	// DefaultReconcileTimeout is how long a single reconcile may run before
+	// the reconciler is considered wedged
+	DefaultReconcileTimeout = 2 * time.Minute
+)
+
+// SetupInitialSync adds a runnable to the manager that marks the MapStore as
+// synced once every existing SwapMap and, when configMaps is set, every
+// labelled ConfigMap has been loaded. Sources that are turned off are skipped.
+func SetupInitialSync(mgr ctrl.Manager, mapStore *mapstore.MapStore, swapMaps, configMaps bool) error {
+	return mgr.Add(&initialSyncRunnable{
+		cache:      mgr.GetCache(),
+		mapStore:   mapStore,
+		swapMaps:   swapMaps,
+		configMaps: configMaps,
+	})
+}
+
+// initialSyncRunnable marks the MapStore as synced once the informer cache has
+// synced and every existing SwapMap and labelled ConfigMap has been reconciled
+// into the MapStore at its current generation. It runs on every replica
+// regardless of leader election.
+type initialSyncRunnable struct {
+	cache      cache.Cache
+	mapStore   *mapstore.MapStore
+	swapMaps   bool
+	configMaps bool
+}
+
+func (s *initialSyncRunnable) Start(ctx context.Context) error {
+	if !s.cache.WaitForCacheSync(ctx) {
+		return fmt.Errorf("informer cache failed to sync")
+	}
+
+	var swapMaps mapsv1alpha1.SwapMapList
+	var configMaps corev1.ConfigMapList
+	err := wait.PollUntilContextCancel(ctx, initialSyncInterval, true, func(ctx context.Context) (bool, error) {
+		// List on every attempt so sources deleted before they were reconciled don't block readiness
+		if s.swapMaps {
+			if err := s.cache.List(ctx, &swapMaps); err != nil {
+				return false, fmt.Errorf("unable to list SwapMaps for initial sync: %w", err)
+			}
+		}
+		if s.configMaps {
+			if err := s.cache.List(ctx, &configMaps, client.MatchingLabels{ConfigMapSourceLabel: "true"}); err != nil {
+				return false, fmt.Errorf("unable to list ConfigMaps for initial sync: %w", err)
+			}
+		}
+
+		for i := range swapMaps.Items {
+			if !s.loaded(client.ObjectKeyFromObject(&swapMaps.Items[i]).String(), swapMaps.Items[i].Generation) {
+				log.Log.V(1).Info("Waiting for SwapMap to be reconciled", "namespace", swapMaps.Items[i].Namespace, "name", swapMaps.Items[i].Name)
+				return false, nil
+			}
+		}
+		for i := range configMaps.Items {
+			if !s.loaded(ConfigMapSourcePrefix+client.ObjectKeyFromObject(&configMaps.Items[i]).String(), configMaps.Items[i].Generation) {
+				log.Log.V(1).Info("Waiting for ConfigMap to be reconciled", "namespace", configMaps.Items[i].Namespace, "name", configMaps.Items[i].Name)
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("MapStore initial sync did not complete: %w", err)
+	}
+
+	s.mapStore.MarkSynced()
+	log.Log.Info("MapStore initial sync complete", "swapMaps", len(swapMaps.Items), "configMaps", len(configMaps.Items))
+
+	return nil
+}
+
+// loaded reports whether the source has been loaded into the MapStore at
+// generation or later
+func (s *initialSyncRunnable) loaded(source string, generation int64) bool {
+	loadedGeneration, ok := s.mapStore.SourceGeneration(source)
+	return ok && loadedGeneration >= generation
+}
+
+func (s *initialSyncRunnable) NeedLeaderElection() bool {
+	return false
+}
+
+// HealthzCheck is a healthz.Checker that fails when a single reconcile has
+// been running for longer than ReconcileTimeout, which means the reconciler is
+// wedged and the MapStore is no longer being kept up to date.
+func (r *SwapMapReconciler) HealthzCheck(_ *http.Request) error {
+	started := r.reconcileStarted.Load()
+	if started == 0 {
+		return nil
+	}
+
+	timeout := r.ReconcileTimeout
+	if timeout == 0 {
+		timeout = DefaultReconcileTimeout
+	}
+
+	if running := time.Since(time.Unix(0, started)); running > timeout {
+		return fmt.Errorf("SwapMap reconcile has been running for %s", running.Round(time.Second))
+	}
+	return nil
+}
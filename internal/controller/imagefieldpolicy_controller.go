@@ -0,0 +1,195 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/fieldpolicy"
+)
+
+const (
+	// CustomResourceWebhookName is the name of the webhook, within the
+	// WebhookConfigurationName MutatingWebhookConfiguration, whose rules are
+	// managed from ImageFieldPolicies
+	CustomResourceWebhookName = "customresources.swap.imgswap.io"
+
+	// ReasonPolicyAccepted is the event reason used when an ImageFieldPolicy is loaded
+	ReasonPolicyAccepted = "PolicyAccepted"
+	// ReasonPolicyRejected is the event reason used when an ImageFieldPolicy has an invalid path
+	ReasonPolicyRejected = "PolicyRejected"
+)
+
+// ImageFieldPolicyReconciler reconciles an ImageFieldPolicy object
+type ImageFieldPolicyReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Policies *fieldpolicy.Store
+}
+
+//+kubebuilder:rbac:groups=maps.k8s.imgswap.io,resources=imagefieldpolicies,verbs=get;list;watch
+//+kubebuilder:rbac:groups=maps.k8s.imgswap.io,resources=imagefieldpolicies/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=get;list;watch;update;patch
+
+// Reconcile loads the ImageFieldPolicy into the policy store. Policies with
+// an invalid path aren't loaded.
+func (r *ImageFieldPolicyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var policy mapsv1alpha1.ImageFieldPolicy
+
+	err := r.Client.Get(ctx, req.NamespacedName, &policy)
+	if apierrors.IsNotFound(err) {
+		log.Log.Info("ImageFieldPolicy deleted", "name", req.Name)
+		r.Policies.Delete(req.Name)
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		log.Log.Error(err, "unable to fetch ImageFieldPolicy")
+		return ctrl.Result{}, err
+	}
+
+	if err := validatePolicy(&policy); err != nil {
+		log.Log.Error(err, "invalid image path", "policy", policy.Name)
+		r.Policies.Delete(policy.Name)
+		return ctrl.Result{}, nil
+	}
+
+	r.Policies.AddOrUpdate(policy.Name, policy.Spec)
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+//
+// Like the SwapMap controller it runs on every replica so each replica's
+// policy store is populated.
+func (r *ImageFieldPolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	needLeaderElection := false
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&mapsv1alpha1.ImageFieldPolicy{}).
+		WithOptions(controller.Options{NeedLeaderElection: &needLeaderElection}).
+		Complete(r)
+}
+
+// ImageFieldPolicyWebhookReconciler points the custom resource webhook at
+// every resource with a valid ImageFieldPolicy and reports whether each
+// policy was accepted
+type ImageFieldPolicyWebhookReconciler struct {
+	client.Client
+	Recorder record.EventRecorder
+	// WebhookConfigurationName is the MutatingWebhookConfiguration holding the
+	// CustomResourceWebhookName webhook
+	WebhookConfigurationName string
+}
+
+// Reconcile reports whether the ImageFieldPolicy was accepted and updates the
+// custom resource webhook rules to match every valid policy
+func (r *ImageFieldPolicyWebhookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var policy mapsv1alpha1.ImageFieldPolicy
+
+	err := r.Client.Get(ctx, req.NamespacedName, &policy)
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Log.Error(err, "unable to fetch ImageFieldPolicy")
+		return ctrl.Result{}, err
+	}
+	if err == nil {
+		if err := validatePolicy(&policy); err != nil {
+			r.Recorder.Eventf(&policy, corev1.EventTypeWarning, ReasonPolicyRejected, "Policy rejected: %v", err)
+		} else {
+			r.Recorder.Eventf(&policy, corev1.EventTypeNormal, ReasonPolicyAccepted, "Swapping images at %d paths in %s", len(policy.Spec.ImagePaths), policy.Spec.Kind)
+		}
+	}
+
+	return ctrl.Result{}, r.syncWebhookRules(ctx)
+}
+
+// syncWebhookRules points the custom resource webhook at every resource with
+// a valid policy. The rules are built from the policies in the cache rather
+// than the replica's policy store, which may not have caught up yet.
+func (r *ImageFieldPolicyWebhookReconciler) syncWebhookRules(ctx context.Context) error {
+	var policies mapsv1alpha1.ImageFieldPolicyList
+	if err := r.Client.List(ctx, &policies); err != nil {
+		return err
+	}
+	store := fieldpolicy.NewStore()
+	for i := range policies.Items {
+		if validatePolicy(&policies.Items[i]) == nil {
+			store.AddOrUpdate(policies.Items[i].Name, policies.Items[i].Spec)
+		}
+	}
+
+	var webhookConfig admissionregistrationv1.MutatingWebhookConfiguration
+
+	err := r.Client.Get(ctx, types.NamespacedName{Name: r.WebhookConfigurationName}, &webhookConfig)
+	if apierrors.IsNotFound(err) {
+		log.Log.Info("MutatingWebhookConfiguration not found, not updating custom resource rules", "name", r.WebhookConfigurationName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	rules := store.Rules()
+	for i := range webhookConfig.Webhooks {
+		webhook := &webhookConfig.Webhooks[i]
+		if webhook.Name != CustomResourceWebhookName {
+			continue
+		}
+		if reflect.DeepEqual(webhook.Rules, rules) {
+			return nil
+		}
+		webhook.Rules = rules
+		log.Log.Info("Updating custom resource webhook rules", "rules", len(rules))
+		return r.Client.Update(ctx, &webhookConfig)
+	}
+
+	log.Log.Info("Custom resource webhook not found", "configuration", r.WebhookConfigurationName, "webhook", CustomResourceWebhookName)
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+//
+// Only the elected leader updates the webhook configuration, so replicas
+// don't race each other writing it.
+func (r *ImageFieldPolicyWebhookReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("imagefieldpolicy-webhook").
+		For(&mapsv1alpha1.ImageFieldPolicy{}).
+		Complete(r)
+}
+
+// validatePolicy checks every image path of the policy
+func validatePolicy(policy *mapsv1alpha1.ImageFieldPolicy) error {
+	for _, path := range policy.Spec.ImagePaths {
+		if err := fieldpolicy.ValidatePath(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/webhooks"
+)
+
+const (
+	// ManagedByLabel marks objects created and kept up to date by imgswap
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	// ManagedByValue is the ManagedByLabel value used by imgswap
+	ManagedByValue = "imgswap"
+	// SourceAnnotation records the "namespace/name" of the Secret a pull secret was copied from
+	SourceAnnotation = "imgswap.io/source"
+
+	// ReasonPullSecretTypeChanged is the event reason used when a source pull
+	// secret's type no longer matches its copy, which can't be changed in place
+	ReasonPullSecretTypeChanged = "PullSecretTypeChanged"
+
+	// pullSecretResyncInterval is how often every namespace is re-checked, to
+	// catch maps loaded after the namespace was last reconciled
+	pullSecretResyncInterval = 10 * time.Minute
+)
+
+// PullSecretReconciler copies the image pull secrets referenced by swapTo
+// targets from SourceNamespace into every namespace the webhook swaps images
+// in, so pods swapped to a private mirror can pull from it. Secrets in the
+// target namespaces that imgswap didn't create are never overwritten.
+type PullSecretReconciler struct {
+	client.Client
+	// APIReader reads target namespace Secrets directly from the API server so
+	// the manager doesn't cache every Secret in the cluster
+	APIReader       client.Reader
+	Scheme          *runtime.Scheme
+	Recorder        record.EventRecorder
+	MapStore        *mapstore.MapStore
+	SourceNamespace string
+	// WatchSwapMaps re-syncs every namespace when a SwapMap changes. Leave it
+	// unset when the SwapMap source is turned off.
+	WatchSwapMaps bool
+}
+
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch
+
+// Reconcile makes sure every pull secret referenced by the loaded maps exists
+// in the namespace.
+func (r *PullSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var namespace corev1.Namespace
+
+	err := r.Client.Get(ctx, types.NamespacedName{Name: req.Name}, &namespace)
+	if apierrors.IsNotFound(err) {
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		log.Log.Error(err, "unable to fetch Namespace")
+		return ctrl.Result{}, err
+	}
+
+	if namespace.Name == r.SourceNamespace || namespace.DeletionTimestamp != nil || namespace.Labels[webhooks.DisabledLabel] == "true" {
+		return ctrl.Result{}, nil
+	}
+
+	for _, name := range r.MapStore.PullSecrets() {
+		if err := r.syncSecret(ctx, namespace.Name, name); err != nil {
+			log.Log.Error(err, "unable to sync pull secret", "namespace", namespace.Name, "secret", name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: pullSecretResyncInterval}, nil
+}
+
+// syncSecret creates or updates the copy of a source pull secret in a namespace
+func (r *PullSecretReconciler) syncSecret(ctx context.Context, namespace, name string) error {
+	var source corev1.Secret
+
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: r.SourceNamespace, Name: name}, &source)
+	if apierrors.IsNotFound(err) {
+		log.Log.Info("Source pull secret not found", "namespace", r.SourceNamespace, "secret", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var target corev1.Secret
+	err = r.APIReader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &target)
+	if apierrors.IsNotFound(err) {
+		log.Log.Info("Copying pull secret", "namespace", namespace, "secret", name)
+		return r.Client.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Labels:      map[string]string{ManagedByLabel: ManagedByValue},
+				Annotations: map[string]string{SourceAnnotation: client.ObjectKeyFromObject(&source).String()},
+			},
+			Type: source.Type,
+			Data: source.Data,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if target.Labels[ManagedByLabel] != ManagedByValue {
+		log.Log.V(1).Info("Pull secret exists and is not managed by imgswap, leaving it alone", "namespace", namespace, "secret", name)
+		return nil
+	}
+
+	if target.Type == source.Type && reflect.DeepEqual(target.Data, source.Data) {
+		return nil
+	}
+
+	if target.Type != source.Type {
+		// The type of a Secret is immutable and imgswap isn't allowed to
+		// delete Secrets, so the copy has to be deleted by hand to be recreated
+		log.Log.Info("Pull secret type changed, leaving the copy alone", "namespace", namespace, "secret", name, "type", target.Type, "sourceType", source.Type)
+		r.Recorder.Eventf(&target, corev1.EventTypeWarning, ReasonPullSecretTypeChanged,
+			"Source %s has type %s but this copy has type %s, delete it to have it recreated", client.ObjectKeyFromObject(&source), source.Type, target.Type)
+		return nil
+	}
+
+	log.Log.Info("Updating pull secret", "namespace", namespace, "secret", name)
+	target.Data = source.Data
+	return r.Client.Update(ctx, &target)
+}
+
+// allNamespaces enqueues every namespace, used when a source secret or the maps change
+func (r *PullSecretReconciler) allNamespaces(ctx context.Context, _ client.Object) []reconcile.Request {
+	var namespaces corev1.NamespaceList
+	if err := r.Client.List(ctx, &namespaces); err != nil {
+		log.Log.Error(err, "unable to list Namespaces")
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(namespaces.Items))
+	for _, namespace := range namespaces.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: namespace.Name}})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+//
+// The manager's cache must be restricted to Secrets in SourceNamespace.
+func (r *PullSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	inSourceNamespace := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetNamespace() == r.SourceNamespace
+	})
+
+	blder := ctrl.NewControllerManagedBy(mgr).
+		Named("pullsecret").
+		For(&corev1.Namespace{}).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.allNamespaces), builder.WithPredicates(inSourceNamespace))
+	if r.WatchSwapMaps {
+		blder = blder.Watches(&mapsv1alpha1.SwapMap{}, handler.EnqueueRequestsFromMapFunc(r.allNamespaces))
+	}
+	return blder.Complete(r)
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/webhooks"
+)
+
+var _ = Describe("PullSecretReconciler", func() {
+	var (
+		ctx        context.Context
+		recorder   *record.FakeRecorder
+		reconciler *PullSecretReconciler
+		source     *corev1.Secret
+	)
+
+	createNamespace := func(labels map[string]string) string {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "pull-secrets-" + utilrand.String(5), Labels: labels}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		return namespace.Name
+	}
+
+	reconcile := func(namespace string) {
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: namespace}})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	copyIn := func(namespace string) (*corev1.Secret, error) {
+		secret := &corev1.Secret{}
+		err := k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: source.Name}, secret)
+		return secret, err
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		recorder = record.NewFakeRecorder(10)
+
+		source = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: createNamespace(nil), Name: "harbor-pull"},
+			Type:       corev1.SecretTypeOpaque,
+			Data:       map[string][]byte{"token": []byte("v1")},
+		}
+		Expect(k8sClient.Create(ctx, source)).To(Succeed())
+
+		store := mapstore.NewMapStore()
+		store.LoadSource("test", 0, 1, false, map[string]*mapsv1alpha1.Map{
+			"docker.io": {
+				Name:     "docker",
+				Type:     "swap",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+				SwapTo:   mapsv1alpha1.SwapRef{Registry: "harbor.example.com", ImagePullSecret: source.Name},
+			},
+		})
+
+		reconciler = &PullSecretReconciler{
+			Client:          k8sClient,
+			APIReader:       k8sClient,
+			Recorder:        recorder,
+			MapStore:        store,
+			SourceNamespace: source.Namespace,
+		}
+	})
+
+	It("copies pull secrets into the namespaces the webhook swaps images in", func() {
+		namespace := createNamespace(nil)
+		reconcile(namespace)
+
+		secret, err := copyIn(namespace)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secret.Data).To(Equal(source.Data))
+		Expect(secret.Labels).To(HaveKeyWithValue(ManagedByLabel, ManagedByValue))
+		Expect(secret.Annotations).To(HaveKeyWithValue(SourceAnnotation, source.Namespace+"/"+source.Name))
+
+		By("keeping the copy up to date")
+		source.Data = map[string][]byte{"token": []byte("v2")}
+		Expect(k8sClient.Update(ctx, source)).To(Succeed())
+		reconcile(namespace)
+		secret, err = copyIn(namespace)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secret.Data).To(Equal(source.Data))
+	})
+
+	It("doesn't copy pull secrets into namespaces the webhook doesn't swap images in", func() {
+		namespace := createNamespace(map[string]string{webhooks.DisabledLabel: "true"})
+		reconcile(namespace)
+
+		_, err := copyIn(namespace)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue(), "expected the secret not to be copied, got %v", err)
+	})
+
+	It("never overwrites a secret imgswap didn't create", func() {
+		namespace := createNamespace(nil)
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: source.Name},
+			Type:       corev1.SecretTypeOpaque,
+			Data:       map[string][]byte{"token": []byte("mine")},
+		}
+		Expect(k8sClient.Create(ctx, existing)).To(Succeed())
+		reconcile(namespace)
+
+		secret, err := copyIn(namespace)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secret.Data).To(Equal(existing.Data))
+		Expect(secret.Labels).NotTo(HaveKey(ManagedByLabel))
+	})
+
+	It("records an event instead of updating a copy whose type changed", func() {
+		namespace := createNamespace(nil)
+		stale := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      source.Name,
+				Labels:    map[string]string{ManagedByLabel: ManagedByValue},
+			},
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+		}
+		Expect(k8sClient.Create(ctx, stale)).To(Succeed())
+		reconcile(namespace)
+
+		secret, err := copyIn(namespace)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secret.Type).To(Equal(corev1.SecretTypeDockerConfigJson))
+		Expect(secret.Data).To(Equal(stale.Data))
+		Expect(secret.ResourceVersion).To(Equal(stale.ResourceVersion))
+		Expect(recorder.Events).To(Receive(ContainSubstring(ReasonPullSecretTypeChanged)))
+	})
+})
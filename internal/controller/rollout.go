@@ -0,0 +1,123 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RestartedAtAnnotation is the pod template annotation `kubectl rollout restart` sets
+const RestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// workloadOwner finds the Deployment, StatefulSet or DaemonSet that manages a
+// pod. It returns nil when the pod isn't managed by one of those, such as bare
+// pods and pods owned by Jobs.
+func workloadOwner(ctx context.Context, reader client.Reader, pod *corev1.Pod) (client.Object, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil, nil
+	}
+
+	switch owner.Kind {
+	case "ReplicaSet":
+		var replicaSet appsv1.ReplicaSet
+		if err := reader.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: owner.Name}, &replicaSet); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		deploymentOwner := metav1.GetControllerOf(&replicaSet)
+		if deploymentOwner == nil || deploymentOwner.Kind != "Deployment" {
+			return nil, nil
+		}
+		return &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: deploymentOwner.Name}}, nil
+	case "StatefulSet":
+		return &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: owner.Name}}, nil
+	case "DaemonSet":
+		return &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: owner.Name}}, nil
+	}
+	return nil, nil
+}
+
+// restartWorkload triggers a rollout restart of a Deployment, StatefulSet or
+// DaemonSet the same way `kubectl rollout restart` does, by setting
+// RestartedAtAnnotation on its pod template
+func restartWorkload(ctx context.Context, c client.Client, workload client.Object, now time.Time) error {
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`, RestartedAtAnnotation, now.Format(time.RFC3339))
+	return c.Patch(ctx, workload, client.RawPatch(types.StrategicMergePatchType, []byte(patch)))
+}
+
+// workloadKind returns the kind of a workload returned by workloadOwner
+func workloadKind(workload client.Object) string {
+	switch workload.(type) {
+	case *appsv1.Deployment:
+		return "Deployment"
+	case *appsv1.StatefulSet:
+		return "StatefulSet"
+	case *appsv1.DaemonSet:
+		return "DaemonSet"
+	}
+	return ""
+}
+
+// workloadKey returns the "namespace/Kind/name" of a workload returned by workloadOwner
+func workloadKey(workload client.Object) string {
+	return workload.GetNamespace() + "/" + workloadKind(workload) + "/" + workload.GetName()
+}
+
+// blockingDisruptionBudget returns the name of a PodDisruptionBudget covering
+// the workload's pods that allows no further disruptions, or "" when a restart
+// wouldn't violate any budget. Rollouts don't go through the eviction API, so
+// budgets have to be checked before restarting.
+func blockingDisruptionBudget(ctx context.Context, reader client.Reader, workload client.Object) (string, error) {
+	if err := reader.Get(ctx, client.ObjectKeyFromObject(workload), workload); err != nil {
+		return "", err
+	}
+
+	var podLabels labels.Set
+	switch w := workload.(type) {
+	case *appsv1.Deployment:
+		podLabels = w.Spec.Template.Labels
+	case *appsv1.StatefulSet:
+		podLabels = w.Spec.Template.Labels
+	case *appsv1.DaemonSet:
+		podLabels = w.Spec.Template.Labels
+	}
+
+	var budgets policyv1.PodDisruptionBudgetList
+	if err := reader.List(ctx, &budgets, client.InNamespace(workload.GetNamespace())); err != nil {
+		return "", err
+	}
+	for _, budget := range budgets.Items {
+		selector, err := metav1.LabelSelectorAsSelector(budget.Spec.Selector)
+		if err != nil {
+			continue
+		}
+		if selector.Matches(podLabels) && budget.Status.DisruptionsAllowed < 1 {
+			return budget.Name, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/metrics"
+)
+
+const (
+	// RestartPolicyNever leaves running workloads alone
+	RestartPolicyNever = "Never"
+	// RestartPolicyRollout rollout restarts workloads running images the SwapMap would swap
+	RestartPolicyRollout = "Rollout"
+
+	// ReasonRolloutRestart is the event reason used when a workload is restarted for a SwapMap
+	ReasonRolloutRestart = "RolloutRestart"
+	// ReasonRolloutDeferred is the event reason used when a restart is held back by a PodDisruptionBudget
+	ReasonRolloutDeferred = "RolloutDeferred"
+
+	// defaultMaxRestartsPerMinute is used when a RestartPolicy doesn't set MaxRestartsPerMinute
+	defaultMaxRestartsPerMinute = 5
+	// restartCooldown is how long a restarted workload is left alone while its
+	// old pods are replaced, so it isn't restarted again mid-rollout
+	restartCooldown = 10 * time.Minute
+	// restartRetryInterval is how often deferred restarts are retried
+	restartRetryInterval = time.Minute
+	// mapStoreWaitInterval is how long to wait for the SwapMap to be loaded into the MapStore
+	mapStoreWaitInterval = 5 * time.Second
+)
+
+// RolloutRestartReconciler restarts the workloads running images a SwapMap
+// would now swap when the SwapMap's RestartPolicy asks for it. Restarts are
+// rate limited per SwapMap and held back while a PodDisruptionBudget covering
+// the workload allows no disruptions.
+type RolloutRestartReconciler struct {
+	client.Client
+	// APIReader lists pods directly from the API server so the manager doesn't
+	// cache every pod in the cluster
+	APIReader client.Reader
+	Scheme    *runtime.Scheme
+	MapStore  *mapstore.MapStore
+	Recorder  record.EventRecorder
+	// ManagerNamespace and ManagerServiceAccount identify the imgswap manager's
+	// own pods, which are never restarted
+	ManagerNamespace      string
+	ManagerServiceAccount string
+
+	mu sync.Mutex
+	// limiters holds the restart rate limiter of each SwapMap
+	limiters map[string]*restartLimiter
+	// restarted holds when each workload was last restarted, keyed by workloadKey
+	restarted map[string]time.Time
+}
+
+// restartLimiter is a SwapMap's rate limiter along with the limit it was created for
+type restartLimiter struct {
+	flowcontrol.RateLimiter
+	maxPerMinute int32
+}
+
+//+kubebuilder:rbac:groups=maps.k8s.imgswap.io,resources=swapmaps,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list
+//+kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets,verbs=get;patch
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list
+
+// Reconcile restarts the workloads owning pods with images the SwapMap's maps would swap.
+func (r *RolloutRestartReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var swapMap mapsv1alpha1.SwapMap
+
+	source := req.NamespacedName.String()
+	err := r.Client.Get(ctx, req.NamespacedName, &swapMap)
+	if apierrors.IsNotFound(err) {
+		r.mu.Lock()
+		delete(r.limiters, source)
+		r.mu.Unlock()
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		log.Log.Error(err, "unable to fetch SwapMap")
+		return ctrl.Result{}, err
+	}
+
+	policy := swapMap.Spec.RestartPolicy
+	if policy == nil || policy.Mode != RestartPolicyRollout {
+		return ctrl.Result{}, nil
+	}
+
+	// The SwapMapReconciler loads the maps concurrently, wait for it to catch up
+	if generation, ok := r.MapStore.SourceGeneration(source); !ok || generation < swapMap.Generation {
+		return ctrl.Result{RequeueAfter: mapStoreWaitInterval}, nil
+	}
+
+	workloads, err := r.driftedWorkloads(ctx, source)
+	if err != nil {
+		log.Log.Error(err, "unable to find workloads to restart", "swapMap", source)
+		return ctrl.Result{}, err
+	}
+
+	keys := make([]string, 0, len(workloads))
+	for key := range workloads {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	limiter := r.limiter(source, policy.MaxRestartsPerMinute)
+	deferred := false
+	for _, key := range keys {
+		workload := workloads[key]
+		if r.recentlyRestarted(key) {
+			continue
+		}
+
+		budget, err := blockingDisruptionBudget(ctx, r.APIReader, workload)
+		if err != nil {
+			log.Log.Error(err, "unable to check PodDisruptionBudgets", "workload", key)
+			deferred = true
+			continue
+		}
+		if budget != "" {
+			log.Log.Info("Deferring restart, PodDisruptionBudget allows no disruptions", "workload", key, "podDisruptionBudget", budget)
+			r.Recorder.Eventf(&swapMap, corev1.EventTypeNormal, ReasonRolloutDeferred, "Deferred restart of %s %s/%s, PodDisruptionBudget %s allows no disruptions",
+				workloadKind(workload), workload.GetNamespace(), workload.GetName(), budget)
+			deferred = true
+			continue
+		}
+
+		if !limiter.TryAccept() {
+			log.Log.V(1).Info("Restart rate limit reached", "swapMap", source)
+			deferred = true
+			break
+		}
+
+		if err := restartWorkload(ctx, r.Client, workload, time.Now()); err != nil {
+			log.Log.Error(err, "unable to restart workload", "workload", key)
+			deferred = true
+			continue
+		}
+		r.markRestarted(key)
+
+		kind := workloadKind(workload)
+		log.Log.Info("Restarted workload for SwapMap", "workload", key, "swapMap", source)
+		metrics.DriftRestarts.WithLabelValues(kind).Inc()
+		r.Recorder.Eventf(workload, corev1.EventTypeNormal, ReasonRolloutRestart, "Restarted %s to swap images with SwapMap %s", kind, source)
+		r.Recorder.Eventf(&swapMap, corev1.EventTypeNormal, ReasonRolloutRestart, "Restarted %s %s/%s", kind, workload.GetNamespace(), workload.GetName())
+	}
+
+	if deferred {
+		return ctrl.Result{RequeueAfter: restartRetryInterval}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// driftedWorkloads returns the workloads owning pods with images one of the
+// source's maps would swap, keyed by workloadKey
+func (r *RolloutRestartReconciler) driftedWorkloads(ctx context.Context, source string) (map[string]client.Object, error) {
+	namespaces, err := listNamespaces(ctx, r.APIReader)
+	if err != nil {
+		return nil, err
+	}
+
+	workloads := map[string]client.Object{}
+	continueToken := ""
+	for {
+		// A new list per page, like the drift scanner, so owner references
+		// never carry over from pods on the previous page
+		var pods corev1.PodList
+		if err := r.APIReader.List(ctx, &pods, client.Limit(driftScanPageSize), client.Continue(continueToken)); err != nil {
+			return nil, err
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if !podScannable(pod, namespaces.excluded, r.ManagerNamespace, r.ManagerServiceAccount) || !r.driftedBySource(pod, namespaces, source) {
+				continue
+			}
+			workload, err := workloadOwner(ctx, r.APIReader, pod)
+			if err != nil {
+				return nil, err
+			}
+			if workload != nil {
+				workloads[workloadKey(workload)] = workload
+			}
+		}
+		continueToken = pods.Continue
+		if continueToken == "" {
+			break
+		}
+	}
+	return workloads, nil
+}
+
+// driftedBySource reports whether any of the pod's images would be swapped by one of the source's maps
+func (r *RolloutRestartReconciler) driftedBySource(pod *corev1.Pod, namespaces scannedNamespaces, source string) bool {
+	for _, d := range podDrift(r.MapStore, pod, namespaces) {
+		if owner, ok := r.MapStore.Owner(d.decision.MapKey); ok && owner == source {
+			return true
+		}
+	}
+	return false
+}
+
+// limiter returns the SwapMap's rate limiter, replacing it when the limit changed
+func (r *RolloutRestartReconciler) limiter(source string, maxPerMinute int32) *restartLimiter {
+	if maxPerMinute < 1 {
+		maxPerMinute = defaultMaxRestartsPerMinute
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.limiters == nil {
+		r.limiters = map[string]*restartLimiter{}
+	}
+	limiter, ok := r.limiters[source]
+	if !ok || limiter.maxPerMinute != maxPerMinute {
+		limiter = &restartLimiter{
+			RateLimiter:  flowcontrol.NewTokenBucketRateLimiter(float32(maxPerMinute)/60, int(maxPerMinute)),
+			maxPerMinute: maxPerMinute,
+		}
+		r.limiters[source] = limiter
+	}
+	return limiter
+}
+
+// recentlyRestarted reports whether the workload was restarted within restartCooldown
+func (r *RolloutRestartReconciler) recentlyRestarted(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, restarted := range r.restarted {
+		if time.Since(restarted) > restartCooldown {
+			delete(r.restarted, k)
+		}
+	}
+	_, ok := r.restarted[key]
+	return ok
+}
+
+// markRestarted records that the workload was just restarted
+func (r *RolloutRestartReconciler) markRestarted(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.restarted == nil {
+		r.restarted = map[string]time.Time{}
+	}
+	r.restarted[key] = time.Now()
+}
+
+// SetupWithManager sets up the controller with the Manager.
+//
+// Unlike the SwapMapReconciler it only runs on the elected leader so each
+// workload is restarted once.
+func (r *RolloutRestartReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("rolloutrestart").
+		For(&mapsv1alpha1.SwapMap{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
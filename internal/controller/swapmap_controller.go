@@ -19,14 +19,50 @@ package controller
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/clock"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
 	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/metrics"
+)
+
+const (
+	// ReasonMapsAccepted is the event reason used when a SwapMap's maps are loaded
+	ReasonMapsAccepted = "MapsAccepted"
+	// ReasonMapRejected is the event reason used when a map can't be loaded
+	ReasonMapRejected = "MapRejected"
+	// ReasonMapConflict is the event reason used when a map key is already owned by another source
+	ReasonMapConflict = "MapConflict"
+	// ReasonMapsNotLoaded is the Ready condition reason used when some of a SwapMap's maps were rejected or conflict
+	ReasonMapsNotLoaded = "MapsNotLoaded"
+
+	// ConditionReady is the SwapMap condition that is true when every map is loaded
+	ConditionReady = "Ready"
+
+	// SwapMapPrecedence is the precedence of maps loaded from SwapMaps. Other
+	// map sources are configured relative to it.
+	SwapMapPrecedence = 0
 )
 
 // SwapMapReconciler reconciles a SwapMap object
@@ -34,11 +70,28 @@ type SwapMapReconciler struct {
 	client.Client
 	Scheme   *runtime.Scheme
 	MapStore *mapstore.MapStore
+	Recorder record.EventRecorder
+	// ReconcileTimeout is how long a single reconcile may run before the
+	// liveness check fails. Defaults to DefaultReconcileTimeout.
+	ReconcileTimeout time.Duration
+	// Clock decides which maps are active and when to requeue for the next
+	// activeFrom, activeUntil or schedule boundary. Defaults to the real clock.
+	Clock clock.PassiveClock
+	// Elected is closed once this replica is the elected leader. Every replica
+	// loads the maps but only the leader writes status and records Events, so
+	// replicas don't overwrite each other. Set to the manager's Elected
+	// channel by SetupWithManager; when nil the reconciler acts as the leader.
+	Elected <-chan struct{}
+
+	// reconcileStarted holds the start time (unix nanoseconds) of the
+	// in-flight reconcile, or zero when the reconciler is idle
+	reconcileStarted atomic.Int64
 }
 
 //+kubebuilder:rbac:groups=maps.k8s.imgswap.io,resources=swapmaps,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=maps.k8s.imgswap.io,resources=swapmaps/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=maps.k8s.imgswap.io,resources=swapmaps/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -52,10 +105,18 @@ type SwapMapReconciler struct {
 func (r *SwapMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	_ = log.FromContext(ctx)
 
-	// TODO(user): your logic here
+	r.reconcileStarted.Store(time.Now().UnixNano())
+	defer r.reconcileStarted.Store(0)
+
 	var swapMap mapsv1alpha1.SwapMap
 
 	err := r.Client.Get(ctx, req.NamespacedName, &swapMap)
+	if apierrors.IsNotFound(err) {
+		log.Log.Info("SwapMap deleted, removing its maps", "namespace", req.Namespace, "name", req.Name)
+		r.MapStore.DeleteSource(req.NamespacedName.String())
+		metrics.SwapMapMaps.DeleteLabelValues(req.Namespace, req.Name)
+		return ctrl.Result{}, nil
+	}
 	if err != nil {
 		log.Log.Error(err, "unable to fetch SwapMap")
 		return ctrl.Result{}, err
@@ -63,24 +124,212 @@ func (r *SwapMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 
 	log.Log.Info("Got SwapMap", "name", swapMap.Name)
 
+	mode := swapMap.Spec.Mode
+	if mode == "" {
+		mode = mapsv1alpha1.SwapMapModeEnforce
+	}
+
+	leader := r.leader()
+	var recorder record.EventRecorder
+	if leader {
+		recorder = r.Recorder
+	}
+	loaded, conflicts := loadMaps(r.MapStore, recorder, &swapMap, client.ObjectKeyFromObject(&swapMap).String(), SwapMapPrecedence, swapMap.Generation, mode == mapsv1alpha1.SwapMapModeAudit, swapMap.Spec.Maps)
+	metrics.SwapMapMaps.WithLabelValues(swapMap.Namespace, swapMap.Name).Set(float64(loaded))
+
+	now := r.now()
+	active, next := 0, time.Time{}
+	for i := range swapMap.Spec.Maps {
+		mapSpec := &swapMap.Spec.Maps[i]
+		if mapstore.MapActive(mapSpec, now) {
+			active++
+		}
+		if transition, ok := mapstore.NextTransition(mapSpec, now); ok && (next.IsZero() || transition.Before(next)) {
+			next = transition
+		}
+	}
+
+	if leader {
+		if err := r.updateStatus(ctx, &swapMap, mode, loaded, conflicts, active, now); err != nil {
+			log.Log.Error(err, "unable to update SwapMap status")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// The MapStore checks the clock on every lookup, requeueing only keeps
+	// the status current as maps become active or inactive
+	if !next.IsZero() {
+		log.Log.V(1).Info("Requeueing at the next map activation change", "name", swapMap.Name, "at", next)
+		return ctrl.Result{RequeueAfter: next.Sub(now)}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// now returns the current time according to the reconciler's clock
+func (r *SwapMapReconciler) now() time.Time {
+	if r.Clock == nil {
+		return time.Now()
+	}
+	return r.Clock.Now()
+}
+
+// leader reports whether this replica is the elected leader
+func (r *SwapMapReconciler) leader() bool {
+	if r.Elected == nil {
+		return true
+	}
+	select {
+	case <-r.Elected:
+		return true
+	default:
+		return false
+	}
+}
+
+// updateStatus records how the SwapMap's maps were loaded. Only the leader
+// calls it.
+func (r *SwapMapReconciler) updateStatus(ctx context.Context, swapMap *mapsv1alpha1.SwapMap, mode string, loaded, conflicts, active int, now time.Time) error {
+	patch := client.MergeFrom(swapMap.DeepCopy())
+
+	status := &swapMap.Status
+	status.ObservedGeneration = swapMap.Generation
+	status.Maps = int32(loaded)
+	status.Conflicts = int32(conflicts)
+	status.ActiveMaps = int32(active)
+	status.Canaries = nil
 	for _, mapSpec := range swapMap.Spec.Maps {
+		if mapSpec.Canary != nil {
+			status.Canaries = append(status.Canaries, mapsv1alpha1.CanaryStatus{Map: mapSpec.Name, Percent: mapSpec.Canary.Percent})
+		}
+	}
+	status.Mode = mode
+	status.LastReconcileTime = &metav1.Time{Time: now}
+
+	condition := metav1.Condition{
+		Type:               ConditionReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: swapMap.Generation,
+		Reason:             ReasonMapsAccepted,
+		Message:            fmt.Sprintf("Loaded %d of %d maps", loaded, len(swapMap.Spec.Maps)),
+	}
+	if loaded < len(swapMap.Spec.Maps) {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = ReasonMapsNotLoaded
+		condition.Message = fmt.Sprintf("Loaded %d of %d maps, %d rejected and %d conflicting", loaded, len(swapMap.Spec.Maps), len(swapMap.Spec.Maps)-loaded-conflicts, conflicts)
+	}
+	meta.SetStatusCondition(&status.Conditions, condition)
+
+	return client.IgnoreNotFound(r.Status().Patch(ctx, swapMap, patch))
+}
+
+// loadMaps replaces the maps loaded from source in the MapStore and returns
+// how many of them were loaded and how many lost their key to another source.
+// Maps without a valid key are skipped so the rest still load and the
+// generation is recorded for the initial sync. Rejected and conflicting maps
+// are reported as Events on obj, unless recorder is nil, as are the accepted
+// maps when the generation or the number loaded changed.
+func loadMaps(mapStore *mapstore.MapStore, recorder record.EventRecorder, obj client.Object, source string, precedence int, generation int64, audit bool, mapSpecs []mapsv1alpha1.Map) (int, int) {
+	maps := make(map[string]*mapsv1alpha1.Map, len(mapSpecs))
+	mapNames := make(map[string]string, len(mapSpecs))
+
+	for i := range mapSpecs {
+		mapSpec := mapSpecs[i]
 		mapKey, err := mapstore.GetMapKey(mapSpec)
-		fmt.Printf("Map: %v", mapSpec)
+		if err == nil {
+			err = mapstore.ValidateMap(&mapSpec)
+		}
 		if err != nil {
-			log.Log.Error(err, "unable to get map key")
-			return ctrl.Result{}, err
+			log.Log.Error(err, "unable to load map", "source", source, "map", mapSpec.Name)
+			if recorder != nil {
+				recorder.Eventf(obj, corev1.EventTypeWarning, ReasonMapRejected, "Map %q rejected: %v", mapSpec.Name, err)
+			}
+			continue
 		}
-		r.MapStore.AddOrUpdate(mapKey, &mapSpec)
+		log.Log.V(1).Info("Loading map", "source", source, "map", mapSpec.Name, "type", mapSpec.Type, "key", mapKey)
+		maps[mapKey] = &mapSpec
+		mapNames[mapKey] = mapSpec.Name
 	}
 
-	fmt.Printf("MapStore: %v", r.MapStore)
+	previousGeneration, reloaded := mapStore.SourceGeneration(source)
+	previousLoaded := mapStore.SourceOwned(source)
+	conflicts := mapStore.LoadSource(source, precedence, generation, audit, maps)
 
-	return ctrl.Result{}, nil
+	for _, mapKey := range conflicts {
+		owner, _ := mapStore.Owner(mapKey)
+		log.Log.Info("Map key is already loaded from another source", "source", source, "map", mapNames[mapKey], "key", mapKey, "owner", owner)
+		if recorder != nil {
+			recorder.Eventf(obj, corev1.EventTypeWarning, ReasonMapConflict, "Map %q key %q is already loaded from %s", mapNames[mapKey], mapKey, owner)
+		}
+	}
+
+	loaded := len(maps) - len(conflicts)
+	if recorder != nil && (!reloaded || generation != previousGeneration || loaded != previousLoaded) {
+		recorder.Eventf(obj, corev1.EventTypeNormal, ReasonMapsAccepted, "Loaded %d of %d maps", loaded, len(mapSpecs))
+	}
+
+	return loaded, len(conflicts)
 }
 
 // SetupWithManager sets up the controller with the Manager.
+//
+// Every replica serves the webhook from its own MapStore, so the controller
+// runs on all replicas rather than only on the elected leader. Every SwapMap
+// is reconciled again once the replica is elected, as until then it didn't
+// write their status. Updates that
+// don't change the generation, such as the controller's own status updates,
+// are ignored, but SwapMaps are reconciled again whenever another source takes
+// their keys or hands them back so their conflicts stay current.
 func (r *SwapMapReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	needLeaderElection := false
+	if r.Elected == nil {
+		r.Elected = mgr.Elected()
+	}
+
+	// Status was only written by the previous leader, if any
+	elected := source.Func(func(ctx context.Context, _ handler.EventHandler, queue workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+		go func() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.Elected:
+			}
+			var swapMaps mapsv1alpha1.SwapMapList
+			if err := r.List(ctx, &swapMaps); err != nil {
+				log.Log.Error(err, "unable to list SwapMaps after being elected")
+				return
+			}
+			for i := range swapMaps.Items {
+				queue.Add(ctrl.Request{NamespacedName: client.ObjectKeyFromObject(&swapMaps.Items[i])})
+			}
+		}()
+		return nil
+	})
+
+	ownersChanged := make(chan event.GenericEvent)
+	r.MapStore.OwnersChanged = func(sources []string) {
+		for _, source := range sources {
+			if key, ok := swapMapSource(source); ok {
+				swapMap := &mapsv1alpha1.SwapMap{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}}
+				// Sent from a goroutine as the MapStore is updated from within reconciles
+				go func() { ownersChanged <- event.GenericEvent{Object: swapMap} }()
+			}
+		}
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&mapsv1alpha1.SwapMap{}).
+		For(&mapsv1alpha1.SwapMap{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		WatchesRawSource(&source.Channel{Source: ownersChanged}, &handler.EnqueueRequestForObject{}).
+		WatchesRawSource(elected, &handler.EnqueueRequestForObject{}).
+		WithOptions(controller.Options{NeedLeaderElection: &needLeaderElection}).
 		Complete(r)
 }
+
+// swapMapSource returns the SwapMap a MapStore source was loaded from, if it
+// was loaded from a SwapMap rather than a ConfigMap or file
+func swapMapSource(source string) (types.NamespacedName, bool) {
+	namespace, name, ok := strings.Cut(source, "/")
+	if !ok || strings.Contains(source, ":") {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: namespace, Name: name}, true
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2023 The Webroot, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+var _ = Describe("SwapMap validation", func() {
+	create := func(maps ...mapsv1alpha1.Map) error {
+		swapMap := &mapsv1alpha1.SwapMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "validation-" + utilrand.String(5)},
+			Spec:       mapsv1alpha1.SwapMapSpec{Maps: maps},
+		}
+		err := k8sClient.Create(context.Background(), swapMap)
+		if err == nil {
+			Expect(k8sClient.Delete(context.Background(), swapMap)).To(Succeed())
+		}
+		return err
+	}
+
+	It("accepts valid maps", func() {
+		Expect(create(
+			mapsv1alpha1.Map{Name: "default", Type: "default", NoSwap: true},
+			mapsv1alpha1.Map{
+				Name:     "docker",
+				Type:     "swap",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+				SwapTo:   mapsv1alpha1.SwapRef{Registry: "registry.example.com:5000", Project: "dockerhub"},
+			},
+			mapsv1alpha1.Map{
+				Name:     "nginx",
+				Type:     "exact",
+				SwapFrom: mapsv1alpha1.SwapRef{Project: "library", Image: "nginx:1.25"},
+				NoSwap:   true,
+			},
+			// Replace maps hold strings to replace rather than registries
+			mapsv1alpha1.Map{
+				Name:     "dev",
+				Type:     "replace",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "-dev"},
+				SwapTo:   mapsv1alpha1.SwapRef{Registry: "-prod"},
+			},
+			mapsv1alpha1.Map{
+				Name:     "noswap-cache",
+				Type:     "replace",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "cache", Project: "mirror/"},
+				NoSwap:   true,
+			},
+		)).To(Succeed())
+	})
+
+	DescribeTable("rejects invalid maps",
+		func(mapSpec mapsv1alpha1.Map, message string) {
+			err := create(mapSpec)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expected an Invalid error, got %v", err)
+			Expect(err.Error()).To(ContainSubstring(message))
+		},
+		Entry("swap map without swapFrom.registry",
+			mapsv1alpha1.Map{
+				Name:     "no-registry",
+				Type:     "swap",
+				SwapFrom: mapsv1alpha1.SwapRef{Project: "library"},
+				SwapTo:   mapsv1alpha1.SwapRef{Registry: "example.com"},
+			},
+			"swap maps require swapFrom.registry"),
+		Entry("default map with another name",
+			mapsv1alpha1.Map{Name: "fallback", Type: "default", NoSwap: true},
+			`default maps must be named "default"`),
+		Entry("noSwap map with swapTo",
+			mapsv1alpha1.Map{
+				Name:     "both",
+				Type:     "exact",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io", Image: "nginx"},
+				SwapTo:   mapsv1alpha1.SwapRef{Registry: "example.com"},
+				NoSwap:   true,
+			},
+			"noSwap and swapTo are mutually exclusive"),
+		Entry("noSwap map with a swapTo imagePullSecret",
+			mapsv1alpha1.Map{
+				Name:     "secret",
+				Type:     "exact",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io", Image: "nginx"},
+				SwapTo:   mapsv1alpha1.SwapRef{ImagePullSecret: "harbor"},
+				NoSwap:   true,
+			},
+			"noSwap and swapTo are mutually exclusive"),
+		Entry("swapFrom.registry that isn't a hostname",
+			mapsv1alpha1.Map{
+				Name:     "path",
+				Type:     "swap",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io/library"},
+				SwapTo:   mapsv1alpha1.SwapRef{Registry: "example.com"},
+			},
+			"registry must be a hostname with an optional port"),
+		Entry("swapTo.registry with an invalid port",
+			mapsv1alpha1.Map{
+				Name:     "port",
+				Type:     "swap",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+				SwapTo:   mapsv1alpha1.SwapRef{Registry: "example.com:http"},
+			},
+			"registry must be a hostname with an optional port"),
+		Entry("canary.swapTo.registry that isn't a hostname",
+			mapsv1alpha1.Map{
+				Name:     "canary",
+				Type:     "swap",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+				SwapTo:   mapsv1alpha1.SwapRef{Registry: "example.com"},
+				Canary:   &mapsv1alpha1.Canary{Percent: 10, SwapTo: mapsv1alpha1.SwapRef{Registry: "canary.example.com/mirror"}},
+			},
+			"canary.swapTo.registry must be a hostname with an optional port"),
+		Entry("swapTo.registry starting with a hyphen",
+			mapsv1alpha1.Map{
+				Name:     "hyphen",
+				Type:     "swap",
+				SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+				SwapTo:   mapsv1alpha1.SwapRef{Registry: "-example.com"},
+			},
+			"registry must be a hostname with an optional port"),
+		Entry("container selector with an unknown pull policy",
+			mapsv1alpha1.Map{
+				Name:       "pull-policy",
+				Type:       "swap",
+				SwapFrom:   mapsv1alpha1.SwapRef{Registry: "docker.io"},
+				SwapTo:     mapsv1alpha1.SwapRef{Registry: "example.com"},
+				Containers: &mapsv1alpha1.ContainerSelector{PullPolicies: []corev1.PullPolicy{"Sometimes"}},
+			},
+			"pull policies must be Always, IfNotPresent or Never"),
+	)
+})
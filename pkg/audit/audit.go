@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"time"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// ActionMutated means at least one image in the object was swapped
+	ActionMutated = "mutated"
+	// ActionUnchanged means the object was admitted without changes
+	ActionUnchanged = "unchanged"
+	// ActionSkipped means the object was opted out of swapping
+	ActionSkipped = "skipped"
+	// ActionDenied means the admission request was denied
+	ActionDenied = "denied"
+	// ActionErrored means the admission request failed
+	ActionErrored = "errored"
+
+	// ContainerActionSkipped means the container was opted out of swapping
+	ContainerActionSkipped = "skipped"
+)
+
+// log is for logging in this package.
+var auditlog = logf.Log.WithName("audit")
+
+// Record is a single admission decision
+type Record struct {
+	Time      time.Time `json:"time"`
+	UID       string    `json:"uid"`
+	Operation string    `json:"operation"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	// Owner is the "Kind/name" of the object's controller, if any
+	Owner string `json:"owner,omitempty"`
+	User  string `json:"user"`
+	// Action is one of ActionMutated, ActionUnchanged, ActionSkipped, ActionDenied or ActionErrored
+	Action     string      `json:"action"`
+	Reason     string      `json:"reason,omitempty"`
+	Containers []Container `json:"containers,omitempty"`
+}
+
+// Container is the decision taken for a single container image
+type Container struct {
+	// Name is the container name, or the field path for images found in custom resources
+	Name          string `json:"name"`
+	OriginalImage string `json:"originalImage"`
+	FinalImage    string `json:"finalImage"`
+	Map           string `json:"map,omitempty"`
+	// Action is one of the mapstore actions or ContainerActionSkipped
+	Action string `json:"action"`
+	// AuditImage is the image an audit mode map would have swapped to
+	AuditImage string `json:"auditImage,omitempty"`
+}
+
+// Sink receives audit records
+type Sink interface {
+	// Write persists a single record
+	Write(record *Record) error
+}
+
+// Logger fans audit records out to every configured sink. A nil Logger
+// discards records.
+type Logger struct {
+	Sinks []Sink
+}
+
+// NewLogger creates a Logger writing to the given sinks
+func NewLogger(sinks ...Sink) *Logger {
+	return &Logger{Sinks: sinks}
+}
+
+// Log writes the record to every sink. Sink failures are logged and never
+// fail the admission request being audited.
+func (l *Logger) Log(record *Record) {
+	if l == nil {
+		return
+	}
+
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+
+	for _, sink := range l.Sinks {
+		if err := sink.Write(record); err != nil {
+			auditlog.Error(err, "unable to write audit record", "uid", record.UID)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// SinkStdout writes audit records to stdout
+	SinkStdout = "stdout"
+	// SinkFile writes audit records to a rotating file
+	SinkFile = "file"
+	// SinkHTTP POSTs audit records to a collector
+	SinkHTTP = "http"
+)
+
+// Options configures the audit sinks of the manager
+type Options struct {
+	// Sinks is a comma separated list of SinkStdout, SinkFile and SinkHTTP
+	Sinks          string
+	File           string
+	FileMaxSizeMB  int
+	FileMaxBackups int
+	HTTPURL        string
+	HTTPTimeout    time.Duration
+	HTTPQueueSize  int
+}
+
+// BindFlags binds the audit options to command line flags
+func (o *Options) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Sinks, "audit-sinks", "",
+		"Comma separated list of audit sinks to write admission decisions to (stdout, file, http). Auditing is disabled when empty.")
+	fs.StringVar(&o.File, "audit-file", "/var/log/imgswap/audit.log", "The file the file audit sink writes to.")
+	fs.IntVar(&o.FileMaxSizeMB, "audit-file-max-size", 100, "The size in megabytes at which the audit file is rotated.")
+	fs.IntVar(&o.FileMaxBackups, "audit-file-max-backups", 3, "The number of rotated audit files to keep.")
+	fs.StringVar(&o.HTTPURL, "audit-http-url", "", "The URL the http audit sink POSTs records to.")
+	fs.DurationVar(&o.HTTPTimeout, "audit-http-timeout", 5*time.Second, "The timeout for each POST made by the http audit sink.")
+	fs.IntVar(&o.HTTPQueueSize, "audit-http-queue-size", 1000, "The number of records the http audit sink buffers before dropping.")
+}
+
+// NewLogger builds a Logger from the options. It returns nil when no sinks
+// are configured. Sinks that need to run in the background (e.g. HTTPSink)
+// must be added to the manager by the caller.
+func (o *Options) NewLogger() (*Logger, error) {
+	if o.Sinks == "" {
+		return nil, nil
+	}
+
+	logger := NewLogger()
+	for _, name := range strings.Split(o.Sinks, ",") {
+		switch strings.TrimSpace(name) {
+		case SinkStdout:
+			logger.Sinks = append(logger.Sinks, NewWriterSink(os.Stdout))
+		case SinkFile:
+			sink, err := NewFileSink(o.File, int64(o.FileMaxSizeMB)*1024*1024, o.FileMaxBackups)
+			if err != nil {
+				return nil, fmt.Errorf("unable to open audit file: %w", err)
+			}
+			logger.Sinks = append(logger.Sinks, sink)
+		case SinkHTTP:
+			if o.HTTPURL == "" {
+				return nil, fmt.Errorf("the http audit sink requires --audit-http-url")
+			}
+			logger.Sinks = append(logger.Sinks, NewHTTPSink(o.HTTPURL, o.HTTPTimeout, o.HTTPQueueSize))
+		default:
+			return nil, fmt.Errorf("unknown audit sink %q", name)
+		}
+	}
+	return logger, nil
+}
@@ -0,0 +1,196 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// WriterSink writes one JSON line per record to an io.Writer such as os.Stdout
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink creates a WriterSink writing to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// FileSink writes one JSON line per record to a file, rotating it once it
+// grows past MaxSize. Rotated files are named <path>.1 through <path>.<MaxBackups>.
+type FileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink opens (or creates) the audit file at path
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// rotate shifts the existing backups along and starts a new file
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	for i := s.maxBackups; i > 0; i-- {
+		from := s.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", s.path, i-1)
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", s.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if s.maxBackups == 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return s.open()
+}
+
+func (s *FileSink) Write(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("unable to rotate audit file: %w", err)
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// Close closes the underlying file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// HTTPSink POSTs each record as JSON to a collector. Records are queued and
+// sent in the background so a slow collector never delays admission; records
+// are dropped when the queue is full.
+type HTTPSink struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+}
+
+// NewHTTPSink creates an HTTPSink posting to url. Call Start to begin sending.
+func NewHTTPSink(url string, timeout time.Duration, queueSize int) *HTTPSink {
+	return &HTTPSink{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan []byte, queueSize),
+	}
+}
+
+func (s *HTTPSink) Write(record *Record) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case s.queue <- body:
+		return nil
+	default:
+		return fmt.Errorf("audit queue for %s is full, dropping record", s.url)
+	}
+}
+
+// Start sends queued records until ctx is done. It satisfies manager.Runnable.
+func (s *HTTPSink) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case body := <-s.queue:
+			if err := s.post(body); err != nil {
+				auditlog.Error(err, "unable to send audit record", "url", s.url)
+			}
+		}
+	}
+}
+
+// NeedLeaderElection is false as every replica audits the requests it admits
+func (s *HTTPSink) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *HTTPSink) post(body []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Package debug serves read-only introspection endpoints describing what is
+// loaded into the MapStore and how images resolve against it.
+package debug
+
+import (
+	"encoding/json"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/webhooks"
+)
+
+const (
+	// MapStorePath is the path of the endpoint dumping the MapStore
+	MapStorePath = "/debug/mapstore"
+	// ResolvePath is the path of the endpoint tracing how an image resolves
+	ResolvePath = "/debug/resolve"
+)
+
+var debuglog = logf.Log.WithName("debug")
+
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// Handler serves the debug endpoints
+type Handler struct {
+	MapStore *mapstore.MapStore
+	// Reader looks up namespaces for /debug/resolve
+	Reader client.Reader
+	// Authorizer checks every request. Requests are rejected when nil.
+	Authorizer *Authorizer
+}
+
+// MapStoreResponse is the body returned by /debug/mapstore
+type MapStoreResponse struct {
+	// Synced reports whether the MapStore finished its initial sync
+	Synced bool `json:"synced"`
+	// Maps are the loaded maps sorted by key
+	Maps []mapstore.Entry `json:"maps"`
+}
+
+// ResolveResponse is the body returned by /debug/resolve
+type ResolveResponse struct {
+	Image     string `json:"image"`
+	Namespace string `json:"namespace,omitempty"`
+	// Excluded is true when the webhook doesn't swap images in the namespace
+	Excluded bool `json:"excluded"`
+	// Action is one of "swap", "noSwap", "noMatch" or "audit"
+	Action       string            `json:"action"`
+	SwappedImage string            `json:"swappedImage"`
+	MapKey       string            `json:"mapKey,omitempty"`
+	Source       string            `json:"source,omitempty"`
+	Map          *mapsv1alpha1.Map `json:"map,omitempty"`
+	Trace        []string          `json:"trace"`
+	// AuditImage is the image an audit mode map would have swapped to
+	AuditImage string `json:"auditImage,omitempty"`
+}
+
+// ServeMapStore dumps every map loaded into the MapStore
+func (h *Handler) ServeMapStore(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, MapStoreResponse{
+		Synced: h.MapStore.Synced(),
+		Maps:   h.MapStore.Entries(),
+	})
+}
+
+// ServeResolve traces how the image query parameter resolves against the
+// MapStore for a pod in the namespace query parameter
+func (h *Handler) ServeResolve(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) {
+		return
+	}
+
+	image := r.URL.Query().Get("image")
+	if image == "" {
+		http.Error(w, "image query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	resp := ResolveResponse{Image: image, Namespace: r.URL.Query().Get("namespace")}
+	trace := []string{}
+
+	if resp.Namespace != "" {
+		excluded, reason, err := h.namespaceExcluded(r, resp.Namespace)
+		if err != nil {
+			debuglog.Error(err, "unable to look up namespace", "namespace", resp.Namespace)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Excluded = excluded
+		trace = append(trace, reason)
+	}
+
+	decision, resolveTrace := h.MapStore.Trace(image)
+	resp.Action = decision.Action
+	resp.SwappedImage = decision.SwappedImage
+	resp.AuditImage = decision.AuditImage
+	resp.MapKey = decision.MapKey
+	resp.Map = decision.Map
+	if decision.MapKey != "" {
+		resp.Source, _ = h.MapStore.Owner(decision.MapKey)
+	}
+	resp.Trace = append(trace, resolveTrace...)
+	if resp.Excluded {
+		resp.Trace = append(resp.Trace, "images in the namespace are left alone regardless of the decision")
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// namespaceExcluded reports whether the webhook's default namespaceSelector excludes the namespace
+func (h *Handler) namespaceExcluded(r *http.Request, name string) (bool, string, error) {
+	if name == metav1.NamespaceSystem {
+		return true, "namespace " + name + " is excluded by the webhook", nil
+	}
+
+	var namespace corev1.Namespace
+	err := h.Reader.Get(r.Context(), types.NamespacedName{Name: name}, &namespace)
+	if apierrors.IsNotFound(err) {
+		return false, "namespace " + name + " not found, treating it as included", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	if namespace.Labels[webhooks.DisabledLabel] == "true" {
+		return true, "namespace " + name + " is labelled " + webhooks.DisabledLabel + "=true", nil
+	}
+	return false, "namespace " + name + " is included", nil
+}
+
+// authorize writes an error response and returns false when the request isn't allowed
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return false
+	}
+	if h.Authorizer == nil {
+		http.Error(w, "debug endpoints have no authorizer", http.StatusForbidden)
+		return false
+	}
+
+	code, err := h.Authorizer.Authorize(r.Context(), r)
+	if err != nil {
+		debuglog.V(1).Info("Rejected debug request", "path", r.URL.Path, "reason", err.Error())
+		http.Error(w, http.StatusText(code), code)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		debuglog.Error(err, "unable to write response")
+	}
+}
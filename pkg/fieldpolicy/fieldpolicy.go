@@ -0,0 +1,97 @@
+package fieldpolicy
+
+import (
+	"sort"
+	"sync"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+// Store holds the ImageFieldPolicies the generic webhook uses to find images
+// in custom resources
+type Store struct {
+	mu       sync.RWMutex
+	policies map[string]mapsv1alpha1.ImageFieldPolicySpec
+}
+
+// NewStore creates an empty Store
+func NewStore() *Store {
+	return &Store{
+		policies: make(map[string]mapsv1alpha1.ImageFieldPolicySpec),
+	}
+}
+
+// AddOrUpdate adds or replaces the named policy
+func (s *Store) AddOrUpdate(name string, spec mapsv1alpha1.ImageFieldPolicySpec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.policies[name] = spec
+}
+
+// Delete removes the named policy
+func (s *Store) Delete(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.policies, name)
+}
+
+// Paths returns every image path configured for the kind, across all
+// policies. Paths in more than one policy are only returned once, so their
+// images aren't swapped twice.
+func (s *Store) Paths(gvk schema.GroupVersionKind) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[string]bool{}
+	paths := []string{}
+	for _, spec := range s.policies {
+		if spec.Group == gvk.Group && spec.Version == gvk.Version && spec.Kind == gvk.Kind {
+			for _, path := range spec.ImagePaths {
+				if !seen[path] {
+					seen[path] = true
+					paths = append(paths, path)
+				}
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Rules returns the webhook rules matching every resource with a policy.
+// Resources with more than one policy get a single rule.
+func (s *Store) Rules() []admissionregistrationv1.RuleWithOperations {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.policies))
+	for name := range s.policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	seen := map[schema.GroupVersionResource]bool{}
+	rules := []admissionregistrationv1.RuleWithOperations{}
+	for _, name := range names {
+		spec := s.policies[name]
+		gvr := schema.GroupVersionResource{Group: spec.Group, Version: spec.Version, Resource: spec.Resource}
+		if seen[gvr] {
+			continue
+		}
+		seen[gvr] = true
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{spec.Group},
+				APIVersions: []string{spec.Version},
+				Resources:   []string{spec.Resource},
+			},
+		})
+	}
+	return rules
+}
@@ -0,0 +1,45 @@
+package fieldpolicy
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+func TestStore(t *testing.T) {
+	workflow := func(paths ...string) mapsv1alpha1.ImageFieldPolicySpec {
+		return mapsv1alpha1.ImageFieldPolicySpec{Group: "argoproj.io", Version: "v1alpha1", Kind: "Workflow", Resource: "workflows", ImagePaths: paths}
+	}
+
+	store := NewStore()
+	store.AddOrUpdate("argo", workflow("spec.templates[*].container.image"))
+	store.AddOrUpdate("argo-scripts", workflow("spec.templates[*].script.image", "spec.templates[*].container.image"))
+	store.AddOrUpdate("tekton", mapsv1alpha1.ImageFieldPolicySpec{
+		Group: "tekton.dev", Version: "v1", Kind: "Task", Resource: "tasks", ImagePaths: []string{"spec.steps[*].image"},
+	})
+
+	gvk := schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Workflow"}
+	if got, want := store.Paths(gvk), []string{"spec.templates[*].container.image", "spec.templates[*].script.image"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Paths(%v) = %v, want %v", gvk, got, want)
+	}
+
+	resources := [][]string{}
+	for _, rule := range store.Rules() {
+		resources = append(resources, []string{rule.APIGroups[0], rule.APIVersions[0], rule.Resources[0]})
+	}
+	if want := [][]string{{"argoproj.io", "v1alpha1", "workflows"}, {"tekton.dev", "v1", "tasks"}}; !reflect.DeepEqual(resources, want) {
+		t.Errorf("Rules() match %v, want %v", resources, want)
+	}
+
+	store.Delete("argo")
+	store.Delete("argo-scripts")
+	if got := store.Paths(gvk); len(got) != 0 {
+		t.Errorf("Paths(%v) after deleting its policies = %v", gvk, got)
+	}
+	if got := store.Rules(); len(got) != 1 {
+		t.Errorf("Rules() after deleting the argo policies = %v, want the tekton rule", got)
+	}
+}
@@ -0,0 +1,105 @@
+package fieldpolicy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// segment is a single step of an image path: a field name, a list index or,
+// when index is wildcard, every item of a list
+type segment struct {
+	field string
+	index int
+}
+
+const wildcard = -1
+
+// parsePath splits a path like "spec.templates[*].container.image" into segments
+func parsePath(path string) ([]segment, error) {
+	segments := []segment{}
+
+	for _, part := range strings.Split(path, ".") {
+		field, rest, _ := strings.Cut(part, "[")
+		if field == "" && rest == "" {
+			return nil, fmt.Errorf("invalid path %q: empty field", path)
+		}
+		if field != "" {
+			segments = append(segments, segment{field: field})
+		}
+
+		for rest != "" {
+			index, remaining, found := strings.Cut(rest, "]")
+			if !found {
+				return nil, fmt.Errorf("invalid path %q: unterminated index", path)
+			}
+			if index == "*" {
+				segments = append(segments, segment{index: wildcard})
+			} else {
+				i, err := strconv.Atoi(index)
+				if err != nil || i < 0 {
+					return nil, fmt.Errorf("invalid path %q: bad index %q", path, index)
+				}
+				segments = append(segments, segment{index: i})
+			}
+			rest = strings.TrimPrefix(remaining, "[")
+		}
+	}
+	return segments, nil
+}
+
+// ValidatePath reports whether path is a valid image path
+func ValidatePath(path string) error {
+	_, err := parsePath(path)
+	return err
+}
+
+// SwapFields calls swap for every string found at path in obj and replaces it
+// with the result. Missing fields are ignored. The location of each field is
+// passed to swap as a path with concrete list indexes.
+func SwapFields(obj map[string]interface{}, path string, swap func(location, value string) string) error {
+	segments, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+
+	walk(obj, segments, "", swap)
+	return nil
+}
+
+// walk descends into value following segments, returning the possibly replaced value
+func walk(value interface{}, segments []segment, location string, swap func(location, value string) string) interface{} {
+	if len(segments) == 0 {
+		if s, ok := value.(string); ok {
+			return swap(location, s)
+		}
+		return value
+	}
+
+	seg := segments[0]
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if seg.field == "" {
+			return value
+		}
+		child, ok := v[seg.field]
+		if !ok {
+			return value
+		}
+		childLocation := seg.field
+		if location != "" {
+			childLocation = location + "." + seg.field
+		}
+		v[seg.field] = walk(child, segments[1:], childLocation, swap)
+	case []interface{}:
+		if seg.field != "" {
+			return value
+		}
+		for i := range v {
+			if seg.index == wildcard || seg.index == i {
+				v[i] = walk(v[i], segments[1:], fmt.Sprintf("%s[%d]", location, i), swap)
+			}
+		}
+	}
+	return value
+}
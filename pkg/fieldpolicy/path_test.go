@@ -0,0 +1,119 @@
+package fieldpolicy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []segment
+	}{
+		{"image", []segment{{field: "image"}}},
+		{"spec.containers[*].image", []segment{{field: "spec"}, {field: "containers"}, {index: wildcard}, {field: "image"}}},
+		{"spec.steps[2].image", []segment{{field: "spec"}, {field: "steps"}, {index: 2}, {field: "image"}}},
+		{"spec.matrix[*][0].image", []segment{{field: "spec"}, {field: "matrix"}, {index: wildcard}, {index: 0}, {field: "image"}}},
+	}
+	for _, tt := range tests {
+		got, err := parsePath(tt.path)
+		if err != nil {
+			t.Errorf("parsePath(%q): %v", tt.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePath(%q) = %+v, want %+v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParsePathInvalid(t *testing.T) {
+	for _, path := range []string{
+		"",
+		".image",
+		"spec..image",
+		"spec.image.",
+		"spec.containers[*.image",
+		"spec.containers[].image",
+		"spec.containers[x].image",
+		"spec.containers[-1].image",
+		"spec.containers[0]image",
+	} {
+		if _, err := parsePath(path); err == nil {
+			t.Errorf("parsePath(%q) succeeded, want an error", path)
+		}
+		if err := ValidatePath(path); err == nil {
+			t.Errorf("ValidatePath(%q) succeeded, want an error", path)
+		}
+	}
+}
+
+func TestSwapFields(t *testing.T) {
+	const obj = `{
+		"spec": {
+			"image": "nginx",
+			"templates": [
+				{"container": {"image": "busybox"}},
+				{"script": {"image": "alpine"}},
+				{"container": {"image": 3}}
+			],
+			"matrix": [["a", "b"], ["c"]]
+		}
+	}`
+
+	tests := []struct {
+		path      string
+		locations []string
+	}{
+		{"spec.image", []string{"spec.image"}},
+		{"spec.templates[*].container.image", []string{"spec.templates[0].container.image"}},
+		{"spec.templates[1].script.image", []string{"spec.templates[1].script.image"}},
+		{"spec.matrix[*][0]", []string{"spec.matrix[0][0]", "spec.matrix[1][0]"}},
+		// Paths that don't match the object's shape are ignored
+		{"spec.templates[5].container.image", []string{}},
+		{"spec.image.name", []string{}},
+		{"spec.templates.container", []string{}},
+		{"spec[*]", []string{}},
+		{"status.image", []string{}},
+	}
+	for _, tt := range tests {
+		var value map[string]interface{}
+		if err := json.Unmarshal([]byte(obj), &value); err != nil {
+			t.Fatal(err)
+		}
+
+		locations := []string{}
+		err := SwapFields(value, tt.path, func(location, image string) string {
+			locations = append(locations, location)
+			return "swapped/" + image
+		})
+		if err != nil {
+			t.Errorf("SwapFields(%q): %v", tt.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(locations, tt.locations) {
+			t.Errorf("SwapFields(%q) visited %v, want %v", tt.path, locations, tt.locations)
+		}
+	}
+
+	var value map[string]interface{}
+	if err := json.Unmarshal([]byte(obj), &value); err != nil {
+		t.Fatal(err)
+	}
+	if err := SwapFields(value, "spec.templates[*].container.image", func(_, image string) string { return "swapped/" + image }); err != nil {
+		t.Fatal(err)
+	}
+	templates := value["spec"].(map[string]interface{})["templates"].([]interface{})
+	if image := templates[0].(map[string]interface{})["container"].(map[string]interface{})["image"]; image != "swapped/busybox" {
+		t.Errorf("swapped image = %v, want %q", image, "swapped/busybox")
+	}
+	// Values that aren't strings are left alone
+	if image := templates[2].(map[string]interface{})["container"].(map[string]interface{})["image"]; image != float64(3) {
+		t.Errorf("non-string image = %v, want 3", image)
+	}
+
+	if err := SwapFields(value, "spec..image", func(_, image string) string { return image }); err == nil {
+		t.Errorf("SwapFields with an invalid path succeeded")
+	}
+}
@@ -0,0 +1,265 @@
+// Package legacy converts the maps file of the original imageswap webhook
+// into SwapMaps.
+//
+// The maps file has one map per line, with the image prefix to match and the
+// prefix to swap it to separated by "::":
+//
+//	default::harbor.example.com
+//	docker.io::harbor.example.com/dockerhub
+//	gcr.io::
+//	noswap_wildcards::internal.example.com, cache
+//	[EXACT]docker.io/library/nginx:1.19::harbor.example.com/library/nginx:1.19
+//	[REPLACE]registry.old.example.com::registry.new.example.com
+//
+// An empty target disables swapping for the prefix. "[EXACT]" and "[REPLACE]"
+// mark a single line, or start a section of lines when on a line of their own.
+package legacy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+const (
+	// delimiter separates the image prefix from its target
+	delimiter = "::"
+	// noSwapWildcardsKey is the key of the line listing substrings of images never to swap
+	noSwapWildcardsKey = "noswap_wildcards"
+
+	sectionSwap    = ""
+	sectionExact   = "[EXACT]"
+	sectionReplace = "[REPLACE]"
+)
+
+// Warning is a construct of the maps file that didn't convert cleanly
+type Warning struct {
+	// Line is the line number of the construct in the maps file
+	Line    int
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("line %d: %s", w.Line, w.Message)
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// converter holds the state of a conversion
+type converter struct {
+	maps     []mapsv1alpha1.Map
+	warnings []Warning
+	// keys maps the key of each converted map to its index in maps
+	keys map[string]int
+	// names tracks the map names used so far
+	names map[string]bool
+}
+
+// Convert parses a legacy maps file into a SwapMap with the given name and
+// namespace. Constructs that don't map cleanly onto SwapMaps are converted as
+// closely as possible and reported as warnings; lines that can't be converted
+// at all are skipped with a warning.
+func Convert(r io.Reader, name, namespace string) (*mapsv1alpha1.SwapMap, []Warning, error) {
+	c := &converter{keys: map[string]int{}, names: map[string]bool{}}
+
+	section := sectionSwap
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		lineSection := section
+		switch {
+		case line == sectionExact || line == sectionReplace:
+			section = line
+			continue
+		case strings.HasPrefix(line, sectionExact):
+			lineSection, line = sectionExact, strings.TrimPrefix(line, sectionExact)
+		case strings.HasPrefix(line, sectionReplace):
+			lineSection, line = sectionReplace, strings.TrimPrefix(line, sectionReplace)
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			c.warn(lineNumber, "unknown section %s, its lines are skipped", line)
+			section = line
+			continue
+		}
+		if lineSection != sectionSwap && lineSection != sectionExact && lineSection != sectionReplace {
+			continue
+		}
+
+		key, target, ok := strings.Cut(line, delimiter)
+		if !ok {
+			// Maps files before imageswap v1.4 used a single colon, which can't tell registry ports apart
+			key, target, ok = strings.Cut(line, ":")
+			if !ok {
+				c.warn(lineNumber, "no %q delimiter in %q, line skipped", delimiter, line)
+				continue
+			}
+			c.warn(lineNumber, "%q uses the old single colon delimiter, check the registry port wasn't taken as the delimiter", line)
+		}
+		key, target = strings.TrimSpace(key), strings.TrimSpace(target)
+
+		switch {
+		case lineSection == sectionExact:
+			c.addExact(lineNumber, key, target)
+		case lineSection == sectionReplace:
+			c.addReplace(lineNumber, key, target)
+		case key == "default":
+			c.addDefault(lineNumber, target)
+		case key == noSwapWildcardsKey:
+			c.addNoSwapWildcards(lineNumber, target)
+		default:
+			c.addSwap(lineNumber, key, target)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	swapMap := &mapsv1alpha1.SwapMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: mapsv1alpha1.GroupVersion.String(),
+			Kind:       "SwapMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       mapsv1alpha1.SwapMapSpec{Maps: c.maps},
+	}
+	return swapMap, c.warnings, nil
+}
+
+func (c *converter) warn(line int, format string, args ...interface{}) {
+	c.warnings = append(c.warnings, Warning{Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *converter) addDefault(line int, target string) {
+	c.add(line, mapsv1alpha1.Map{
+		Name:   "default",
+		Type:   "default",
+		SwapTo: splitRef(target),
+		NoSwap: target == "",
+	})
+}
+
+func (c *converter) addSwap(line int, key, target string) {
+	if strings.ContainsAny(key, "*?[") {
+		c.warn(line, "%q looks like a pattern but is matched as a literal prefix", key)
+	}
+	c.warnLibrary(line, key)
+	c.add(line, mapsv1alpha1.Map{
+		Name:     c.name(key),
+		Type:     "swap",
+		SwapFrom: splitRef(key),
+		SwapTo:   splitRef(target),
+		NoSwap:   target == "",
+	})
+}
+
+func (c *converter) addExact(line int, key, target string) {
+	if key == "" {
+		c.warn(line, "exact map without an image, line skipped")
+		return
+	}
+	if target == "" {
+		c.warn(line, "exact map for %q has no target, converted to noSwap", key)
+	}
+	c.warnLibrary(line, key)
+	c.add(line, mapsv1alpha1.Map{
+		Name:     c.name("exact-" + key),
+		Type:     "exact",
+		SwapFrom: splitRef(key),
+		SwapTo:   splitRef(target),
+		NoSwap:   target == "",
+	})
+}
+
+func (c *converter) addReplace(line int, key, target string) {
+	if key == "" {
+		c.warn(line, "replace map without a string to replace, line skipped")
+		return
+	}
+	if target == "" {
+		c.warn(line, "replace map for %q would remove the string, converted to noSwap as SwapMaps can't replace with nothing", key)
+	}
+	c.add(line, mapsv1alpha1.Map{
+		Name:     c.name("replace-" + key),
+		Type:     "replace",
+		SwapFrom: splitRef(key),
+		SwapTo:   splitRef(target),
+		NoSwap:   target == "",
+	})
+}
+
+// addNoSwapWildcards converts each wildcard to a noSwap "replace" map, which
+// matches images containing the wildcard just like imageswap did. They are
+// consulted after "exact" maps rather than before every other map.
+func (c *converter) addNoSwapWildcards(line int, wildcards string) {
+	for _, wildcard := range strings.Split(wildcards, ",") {
+		wildcard = strings.TrimSpace(wildcard)
+		if wildcard == "" {
+			continue
+		}
+		c.add(line, mapsv1alpha1.Map{
+			Name:     c.name("noswap-" + wildcard),
+			Type:     "replace",
+			SwapFrom: splitRef(wildcard),
+			NoSwap:   true,
+		})
+	}
+}
+
+// warnLibrary warns about keys relying on imageswap expanding official images
+// such as "nginx" to "docker.io/library/nginx", which SwapMaps don't
+func (c *converter) warnLibrary(line int, key string) {
+	if strings.HasPrefix(key, "docker.io/library") {
+		c.warn(line, "%q won't match official images given without \"library/\", such as \"nginx\"", key)
+	}
+}
+
+// add appends the map, replacing any earlier map with the same key
+func (c *converter) add(line int, mapSpec mapsv1alpha1.Map) {
+	key, err := mapstore.GetMapKey(mapSpec)
+	if err != nil {
+		c.warn(line, "unable to convert map %q: %v, line skipped", mapSpec.Name, err)
+		return
+	}
+
+	if i, ok := c.keys[key]; ok {
+		c.warn(line, "%q is mapped again, replacing the earlier map %q", key, c.maps[i].Name)
+		mapSpec.Name = c.maps[i].Name
+		c.maps[i] = mapSpec
+		return
+	}
+	c.keys[key] = len(c.maps)
+	c.maps = append(c.maps, mapSpec)
+}
+
+// name returns a unique map name derived from s
+func (c *converter) name(s string) string {
+	base := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if base == "" || base == "default" {
+		base = "map"
+	}
+
+	name := base
+	for i := 2; c.names[name]; i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	c.names[name] = true
+	return name
+}
+
+// splitRef splits an image prefix into a SwapRef whose GetMapKey and
+// GetSwapTarget give back the prefix: the first path segment is the
+// registry and the rest the project
+func splitRef(prefix string) mapsv1alpha1.SwapRef {
+	registry, project, _ := strings.Cut(prefix, "/")
+	return mapsv1alpha1.SwapRef{Registry: registry, Project: project}
+}
@@ -0,0 +1,106 @@
+package legacy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+func TestConvert(t *testing.T) {
+	ref := func(registry, project string) mapsv1alpha1.SwapRef {
+		return mapsv1alpha1.SwapRef{Registry: registry, Project: project}
+	}
+
+	tests := []struct {
+		name  string
+		maps  string
+		want  []mapsv1alpha1.Map
+		lines []int
+	}{
+		{
+			name: "single line prefixes",
+			maps: "[EXACT]docker.io/library/nginx:1.19::harbor.example.com/library/nginx:1.19\n" +
+				"[REPLACE]registry.old.example.com::registry.new.example.com\n" +
+				"docker.io::harbor.example.com/dockerhub\n",
+			want: []mapsv1alpha1.Map{
+				{Name: "exact-docker-io-library-nginx-1-19", Type: "exact", SwapFrom: ref("docker.io", "library/nginx:1.19"), SwapTo: ref("harbor.example.com", "library/nginx:1.19")},
+				{Name: "replace-registry-old-example-com", Type: "replace", SwapFrom: ref("registry.old.example.com", ""), SwapTo: ref("registry.new.example.com", "")},
+				// A prefix only marks its own line
+				{Name: "docker-io", Type: "swap", SwapFrom: ref("docker.io", ""), SwapTo: ref("harbor.example.com", "dockerhub")},
+			},
+			lines: []int{1},
+		},
+		{
+			name: "sections",
+			maps: "# comment\n[EXACT]\nquay.io/app:1::harbor.example.com/app:1\n\n[REPLACE]\n-dev::-prod\n",
+			want: []mapsv1alpha1.Map{
+				{Name: "exact-quay-io-app-1", Type: "exact", SwapFrom: ref("quay.io", "app:1"), SwapTo: ref("harbor.example.com", "app:1")},
+				{Name: "replace-dev", Type: "replace", SwapFrom: ref("-dev", ""), SwapTo: ref("-prod", "")},
+			},
+		},
+		{
+			name: "noswap wildcards",
+			maps: "noswap_wildcards::internal.example.com, cache, \n",
+			want: []mapsv1alpha1.Map{
+				{Name: "noswap-internal-example-com", Type: "replace", SwapFrom: ref("internal.example.com", ""), NoSwap: true},
+				{Name: "noswap-cache", Type: "replace", SwapFrom: ref("cache", ""), NoSwap: true},
+			},
+		},
+		{
+			name: "single colon delimiter",
+			maps: "docker.io:harbor.example.com\nno delimiter\n",
+			want: []mapsv1alpha1.Map{
+				{Name: "docker-io", Type: "swap", SwapFrom: ref("docker.io", ""), SwapTo: ref("harbor.example.com", "")},
+			},
+			lines: []int{1, 2},
+		},
+		{
+			name: "key mapped twice",
+			maps: "docker.io::a.example.com\ndocker.io::b.example.com\n",
+			want: []mapsv1alpha1.Map{
+				{Name: "docker-io", Type: "swap", SwapFrom: ref("docker.io", ""), SwapTo: ref("b.example.com", "")},
+			},
+			lines: []int{2},
+		},
+		{
+			name: "unknown section",
+			maps: "[CUSTOM]\nfoo::bar\n[EXACT]\nquay.io/app:1::\n",
+			want: []mapsv1alpha1.Map{
+				{Name: "exact-quay-io-app-1", Type: "exact", SwapFrom: ref("quay.io", "app:1"), NoSwap: true},
+			},
+			lines: []int{1, 4},
+		},
+		{
+			name: "default without a target",
+			maps: "default::\n",
+			want: []mapsv1alpha1.Map{
+				{Name: "default", Type: "default", NoSwap: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		swapMap, warnings, err := Convert(strings.NewReader(tt.maps), "legacy", "imgswap-system")
+		if err != nil {
+			t.Errorf("%s: Convert: %v", tt.name, err)
+			continue
+		}
+		if swapMap.Name != "legacy" || swapMap.Namespace != "imgswap-system" || swapMap.Kind != "SwapMap" {
+			t.Errorf("%s: converted to %s %s/%s", tt.name, swapMap.Kind, swapMap.Namespace, swapMap.Name)
+		}
+		if !reflect.DeepEqual(swapMap.Spec.Maps, tt.want) {
+			t.Errorf("%s: maps = %+v, want %+v", tt.name, swapMap.Spec.Maps, tt.want)
+		}
+		lines := []int{}
+		for _, warning := range warnings {
+			lines = append(lines, warning.Line)
+		}
+		if len(tt.lines) == 0 {
+			tt.lines = []int{}
+		}
+		if !reflect.DeepEqual(lines, tt.lines) {
+			t.Errorf("%s: warnings %v on lines %v, want lines %v", tt.name, warnings, lines, tt.lines)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package mapstore
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+// Container describes the pod container an image is resolved for, matched
+// against the container criteria and selectors of maps
+type Container struct {
+	// Name is the name of the container
+	Name string
+	// Kind is whether the container is an init, regular or ephemeral container
+	Kind mapsv1alpha1.ContainerKind
+	// PullPolicy is the image pull policy of the container
+	PullPolicy corev1.PullPolicy
+	// Labels are the labels of the container's pod and its namespace
+	Labels PodLabels
+}
+
+// ContainerOf describes a container of the given kind. Containers without an
+// image pull policy, as in manifests that haven't been through the API server,
+// get the policy Kubernetes would default them to.
+func ContainerOf(container *corev1.Container, kind mapsv1alpha1.ContainerKind) Container {
+	pullPolicy := container.ImagePullPolicy
+	if pullPolicy == "" {
+		pullPolicy = corev1.PullIfNotPresent
+		if ref := ParseImage(container.Image); ref.Digest == "" && (ref.Tag == "" || ref.Tag == "latest") {
+			pullPolicy = corev1.PullAlways
+		}
+	}
+	return Container{Name: container.Name, Kind: kind, PullPolicy: pullPolicy}
+}
+
+// ContainerSelected reports whether the container meets the map's container
+// criteria. Maps without criteria apply to every image, maps with criteria
+// only to images of containers meeting them, so never when container is nil.
+func ContainerSelected(selector *mapsv1alpha1.ContainerSelector, container *Container) bool {
+	if selector == nil {
+		return true
+	}
+	if container == nil {
+		return false
+	}
+	if len(selector.Names) > 0 && !matchesAny(selector.Names, container.Name) {
+		return false
+	}
+	if matchesAny(selector.ExcludeNames, container.Name) {
+		return false
+	}
+	if len(selector.Kinds) > 0 && !contains(selector.Kinds, container.Kind) {
+		return false
+	}
+	if len(selector.PullPolicies) > 0 && !contains(selector.PullPolicies, container.PullPolicy) {
+		return false
+	}
+	return true
+}
+
+// matchesAny reports whether the name matches one of the glob patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains[T comparable](values []T, value T) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateContainers checks the container name patterns of a map
+func validateContainers(selector *mapsv1alpha1.ContainerSelector) error {
+	if selector == nil {
+		return nil
+	}
+	for _, pattern := range append(append([]string{}, selector.Names...), selector.ExcludeNames...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid container name pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
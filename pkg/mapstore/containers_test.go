@@ -0,0 +1,106 @@
+package mapstore
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+func TestContainerOf(t *testing.T) {
+	tests := []struct {
+		image      string
+		pullPolicy corev1.PullPolicy
+		want       corev1.PullPolicy
+	}{
+		{"nginx", "", corev1.PullAlways},
+		{"nginx:latest", "", corev1.PullAlways},
+		{"nginx:1.25", "", corev1.PullIfNotPresent},
+		{"nginx@sha256:abc", "", corev1.PullIfNotPresent},
+		{"nginx:1.25", corev1.PullNever, corev1.PullNever},
+	}
+	for _, tt := range tests {
+		container := ContainerOf(&corev1.Container{Name: "app", Image: tt.image, ImagePullPolicy: tt.pullPolicy}, mapsv1alpha1.ContainerKindRegular)
+		if container.PullPolicy != tt.want {
+			t.Errorf("ContainerOf(%q, %q) pull policy = %q, want %q", tt.image, tt.pullPolicy, container.PullPolicy, tt.want)
+		}
+	}
+}
+
+func TestContainerSelected(t *testing.T) {
+	app := &Container{Name: "app", Kind: mapsv1alpha1.ContainerKindRegular, PullPolicy: corev1.PullAlways}
+	sidecar := &Container{Name: "istio-proxy", Kind: mapsv1alpha1.ContainerKindRegular, PullPolicy: corev1.PullIfNotPresent}
+	init := &Container{Name: "migrate", Kind: mapsv1alpha1.ContainerKindInit, PullPolicy: corev1.PullIfNotPresent}
+
+	tests := []struct {
+		name      string
+		selector  *mapsv1alpha1.ContainerSelector
+		container *Container
+		want      bool
+	}{
+		{"no criteria", nil, app, true},
+		{"no criteria without container", nil, nil, true},
+		{"criteria without container", &mapsv1alpha1.ContainerSelector{}, nil, false},
+		{"name pattern", &mapsv1alpha1.ContainerSelector{Names: []string{"ap*"}}, app, true},
+		{"name pattern mismatch", &mapsv1alpha1.ContainerSelector{Names: []string{"ap*"}}, sidecar, false},
+		{"excluded sidecar", &mapsv1alpha1.ContainerSelector{ExcludeNames: []string{"istio-*", "vault-agent"}}, sidecar, false},
+		{"not excluded", &mapsv1alpha1.ContainerSelector{ExcludeNames: []string{"istio-*", "vault-agent"}}, app, true},
+		{"kind", &mapsv1alpha1.ContainerSelector{Kinds: []mapsv1alpha1.ContainerKind{mapsv1alpha1.ContainerKindInit}}, init, true},
+		{"kind mismatch", &mapsv1alpha1.ContainerSelector{Kinds: []mapsv1alpha1.ContainerKind{mapsv1alpha1.ContainerKindInit}}, app, false},
+		{"pull policy", &mapsv1alpha1.ContainerSelector{PullPolicies: []corev1.PullPolicy{corev1.PullAlways}}, app, true},
+		{"pull policy mismatch", &mapsv1alpha1.ContainerSelector{PullPolicies: []corev1.PullPolicy{corev1.PullAlways}}, init, false},
+		{"every criterion", &mapsv1alpha1.ContainerSelector{Names: []string{"*"}, Kinds: []mapsv1alpha1.ContainerKind{mapsv1alpha1.ContainerKindRegular}, PullPolicies: []corev1.PullPolicy{corev1.PullIfNotPresent}}, app, false},
+	}
+	for _, tt := range tests {
+		if got := ContainerSelected(tt.selector, tt.container); got != tt.want {
+			t.Errorf("%s: ContainerSelected = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveContainer(t *testing.T) {
+	store := NewMapStore()
+	store.LoadSource("test", 0, 1, false, map[string]*mapsv1alpha1.Map{
+		"default": {Name: "default", Type: "default", SwapTo: mapsv1alpha1.SwapRef{Registry: "mirror.example.com"}},
+		"docker.io": {
+			Name:       "docker",
+			Type:       "swap",
+			SwapFrom:   mapsv1alpha1.SwapRef{Registry: "docker.io"},
+			SwapTo:     mapsv1alpha1.SwapRef{Registry: "cache.example.com"},
+			Containers: &mapsv1alpha1.ContainerSelector{ExcludeNames: []string{"vault-agent"}, PullPolicies: []corev1.PullPolicy{corev1.PullAlways}},
+		},
+	})
+
+	tests := []struct {
+		image     string
+		container Container
+		action    string
+		want      string
+	}{
+		{"nginx:1.25", Container{Name: "app", Kind: mapsv1alpha1.ContainerKindRegular, PullPolicy: corev1.PullAlways}, ActionSwap, "cache.example.com/nginx:1.25"},
+		// Containers the docker map doesn't select are left alone rather than
+		// falling through to the default map
+		{"nginx:1.25", Container{Name: "vault-agent", Kind: mapsv1alpha1.ContainerKindRegular, PullPolicy: corev1.PullAlways}, ActionNoSwap, "nginx:1.25"},
+		{"nginx:1.25", Container{Name: "app", Kind: mapsv1alpha1.ContainerKindRegular, PullPolicy: corev1.PullIfNotPresent}, ActionNoSwap, "nginx:1.25"},
+		// Images the docker map doesn't match still get the default map
+		{"quay.io/app:1", Container{Name: "vault-agent", Kind: mapsv1alpha1.ContainerKindRegular, PullPolicy: corev1.PullAlways}, ActionSwap, "mirror.example.com/app:1"},
+	}
+	for _, tt := range tests {
+		decision := store.ResolveContainer(tt.image, "", tt.container)
+		if decision.Action != tt.action || decision.SwappedImage != tt.want {
+			t.Errorf("ResolveContainer(%q, %+v) = %s %q, want %s %q", tt.image, tt.container, decision.Action, decision.SwappedImage, tt.action, tt.want)
+		}
+	}
+
+	if decision := store.Resolve("nginx:1.25"); decision.Action != ActionNoSwap || decision.Map.Name != "docker" {
+		t.Errorf("Resolve without a container = %s by %+v, want noSwap by the docker map", decision.Action, decision.Map)
+	}
+}
+
+func TestValidateMapContainers(t *testing.T) {
+	mapSpec := &mapsv1alpha1.Map{Containers: &mapsv1alpha1.ContainerSelector{ExcludeNames: []string{"istio-[proxy"}}}
+	if err := ValidateMap(mapSpec); err == nil {
+		t.Errorf("ValidateMap accepted an invalid container name pattern")
+	}
+}
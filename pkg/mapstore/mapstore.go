@@ -2,7 +2,13 @@ package mapstore
 
 import (
 	"fmt"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/utils/clock"
 
 	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
 )
@@ -19,7 +25,36 @@ type mapStore interface {
 }
 
 type MapStore struct {
+	mu   sync.RWMutex
 	maps map[string]*mapsv1alpha1.Map
+	// owners tracks which source (e.g. "namespace/name" of a SwapMap) loaded each map key
+	owners map[string]string
+	// sources holds everything loaded from each source, including keys other sources won
+	sources map[string]*sourceMaps
+	// order holds the map keys by descending priority, then key
+	order []string
+	// schedules holds the parsed schedule of each map key with a valid one
+	schedules map[string]*CronSchedule
+	// selectors holds the parsed selectors of each map key with any
+	selectors map[string]*podSelectors
+	// namespaceSelectors is whether any map has a namespace selector
+	namespaceSelectors bool
+	synced             atomic.Bool
+
+	// Clock decides which maps are active. Defaults to the real clock.
+	Clock clock.PassiveClock
+	// OwnersChanged, when set, is called with the other sources that gained or
+	// lost map keys when a source is loaded or deleted, as their conflicts have
+	// changed without them being reloaded. It is called without the lock held.
+	OwnersChanged func(sources []string)
+}
+
+// sourceMaps is what was last loaded from a source
+type sourceMaps struct {
+	precedence int
+	generation int64
+	audit      bool
+	maps       map[string]*mapsv1alpha1.Map
 }
 
 func (m *MapStore) New() (*mapsv1alpha1.SwapMapList, error) {
@@ -27,17 +62,303 @@ func (m *MapStore) New() (*mapsv1alpha1.SwapMapList, error) {
 }
 
 func (m *MapStore) Get(name string) (bool, *mapsv1alpha1.Map) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	mapSpec, ok := m.maps[name]
 	return ok, mapSpec
 }
 
 func (m *MapStore) AddOrUpdate(mapKey string, mapSpec *mapsv1alpha1.Map) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.maps[mapKey] = mapSpec
+	m.index()
 	return nil
 }
 
 func (m *MapStore) Delete(mapName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	delete(m.maps, mapName)
+	delete(m.owners, mapName)
+	m.index()
+	return nil
+}
+
+// LoadSource replaces every map previously loaded from source with the given
+// maps and records the source generation they were loaded from. When several
+// sources load the same key the one with the highest precedence wins; on a tie
+// the source whose name sorts first wins. Keys won by another source are
+// returned as conflicts, and are taken over automatically if that source is
+// deleted. Images matched by the maps of an audit source resolve to
+// ActionAudit and are never swapped.
+func (m *MapStore) LoadSource(source string, precedence int, generation int64, audit bool, maps map[string]*mapsv1alpha1.Map) []string {
+	m.mu.Lock()
+	m.sources[source] = &sourceMaps{precedence: precedence, generation: generation, audit: audit, maps: maps}
+	changed := m.rebuild(source)
+
+	conflicts := []string{}
+	for mapKey := range maps {
+		if m.owners[mapKey] != source {
+			conflicts = append(conflicts, mapKey)
+		}
+	}
+	m.mu.Unlock()
+
+	m.notifyOwnersChanged(changed)
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// Owner returns the source that loaded the map key
+func (m *MapStore) Owner(mapKey string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	owner, ok := m.owners[mapKey]
+	return owner, ok
+}
+
+// DeleteSource removes every map loaded from source
+func (m *MapStore) DeleteSource(source string) {
+	m.mu.Lock()
+	delete(m.sources, source)
+	changed := m.rebuild(source)
+	m.mu.Unlock()
+
+	m.notifyOwnersChanged(changed)
+}
+
+// notifyOwnersChanged calls OwnersChanged with the sources, if there are any
+func (m *MapStore) notifyOwnersChanged(sources []string) {
+	if m.OwnersChanged != nil && len(sources) > 0 {
+		m.OwnersChanged(sources)
+	}
+}
+
+// rebuild recomputes the winning map and owner of every key from the loaded
+// sources and returns the sources other than changedSource that gained or lost
+// keys. Sources are applied in name order, so the outcome doesn't depend on
+// the order they were loaded in. Maps added directly with AddOrUpdate are kept
+// unless a source loads the same key.
+func (m *MapStore) rebuild(changedSource string) []string {
+	maps := make(map[string]*mapsv1alpha1.Map, len(m.maps))
+	owners := make(map[string]string, len(m.owners))
+
+	for mapKey, mapSpec := range m.maps {
+		if _, owned := m.owners[mapKey]; !owned {
+			maps[mapKey] = mapSpec
+		}
+	}
+
+	names := make([]string, 0, len(m.sources))
+	for name := range m.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		source := m.sources[name]
+		for mapKey, mapSpec := range source.maps {
+			if owner, ok := owners[mapKey]; ok {
+				if source.precedence <= m.sources[owner].precedence {
+					continue
+				}
+			}
+			maps[mapKey] = mapSpec
+			owners[mapKey] = name
+		}
+	}
+
+	changed := map[string]bool{}
+	for mapKey, owner := range m.owners {
+		if owners[mapKey] != owner {
+			changed[owner] = true
+			changed[owners[mapKey]] = true
+		}
+	}
+	for mapKey, owner := range owners {
+		if _, owned := m.owners[mapKey]; !owned {
+			changed[owner] = true
+		}
+	}
+	delete(changed, "")
+	delete(changed, changedSource)
+
+	m.maps = maps
+	m.owners = owners
+	m.index()
+
+	sources := make([]string, 0, len(changed))
+	for source := range changed {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// index orders the map keys by descending priority so maps that could both
+// match an image are tried in a predictable order, and parses the schedules
+// and selectors of the maps once rather than on every lookup
+func (m *MapStore) index() {
+	order := make([]string, 0, len(m.maps))
+	schedules := map[string]*CronSchedule{}
+	selectors := map[string]*podSelectors{}
+	namespaceSelectors := false
+	for mapKey, mapSpec := range m.maps {
+		order = append(order, mapKey)
+		if schedule := parseSchedule(mapSpec); schedule != nil {
+			schedules[mapKey] = schedule
+		}
+		if selector := parseSelectors(mapSpec); selector != nil {
+			selectors[mapKey] = selector
+		}
+		namespaceSelectors = namespaceSelectors || mapSpec.NamespaceSelector != nil
+	}
+	sort.Slice(order, func(i, j int) bool {
+		pi, pj := m.maps[order[i]].Priority, m.maps[order[j]].Priority
+		if pi != pj {
+			return pi > pj
+		}
+		return order[i] < order[j]
+	})
+	m.order = order
+	m.schedules = schedules
+	m.selectors = selectors
+	m.namespaceSelectors = namespaceSelectors
+}
+
+// NamespaceSelectors reports whether any loaded map has a namespace selector,
+// so callers only look up the labels of a pod's namespace when they matter
+func (m *MapStore) NamespaceSelectors() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.namespaceSelectors
+}
+
+// audited reports whether the map key was loaded from an audit source.
+// The caller must hold the lock.
+func (m *MapStore) audited(mapKey string) bool {
+	source, ok := m.sources[m.owners[mapKey]]
+	return ok && source.audit
+}
+
+// now returns the current time according to the MapStore's clock
+func (m *MapStore) now() time.Time {
+	if m.Clock == nil {
+		return time.Now()
+	}
+	return m.Clock.Now()
+}
+
+// SourceGeneration returns the generation last loaded from source
+func (m *MapStore) SourceGeneration(source string) (int64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	loaded, ok := m.sources[source]
+	if !ok {
+		return 0, false
+	}
+	return loaded.generation, true
+}
+
+// SourceOwned returns how many map keys source currently owns
+func (m *MapStore) SourceOwned(source string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	owned := 0
+	for _, owner := range m.owners {
+		if owner == source {
+			owned++
+		}
+	}
+	return owned
+}
+
+// Entry is a map loaded into the MapStore along with where it was loaded from
+type Entry struct {
+	// Key is the key the map is stored under
+	Key string `json:"key"`
+	// Source is the source that loaded the map (e.g. "namespace/name" of a SwapMap)
+	Source string `json:"source,omitempty"`
+	// Generation is the generation of the source the map was loaded from
+	Generation int64 `json:"generation"`
+	// Precedence is the precedence of the source
+	Precedence int `json:"precedence"`
+	// Audit is true when the source only reports what its maps would swap
+	Audit bool `json:"audit,omitempty"`
+	// Type is the type of the map
+	Type string `json:"type"`
+	// Map is the map itself
+	Map *mapsv1alpha1.Map `json:"map"`
+}
+
+// Entries returns every loaded map sorted by key
+func (m *MapStore) Entries() []Entry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := make([]Entry, 0, len(m.maps))
+	for mapKey, mapSpec := range m.maps {
+		entry := Entry{Key: mapKey, Type: mapSpec.Type, Map: mapSpec}
+		if source, ok := m.owners[mapKey]; ok {
+			entry.Source = source
+			entry.Generation = m.sources[source].generation
+			entry.Precedence = m.sources[source].precedence
+			entry.Audit = m.sources[source].audit
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// PullSecrets returns the names of the image pull secrets referenced by the
+// loaded maps, including those of canary targets
+func (m *MapStore) PullSecrets() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := map[string]bool{}
+	names := []string{}
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, mapSpec := range m.maps {
+		add(mapSpec.SwapTo.ImagePullSecret)
+		// Canary pods only get the canary secret when the canary has its own target
+		if mapSpec.Canary != nil && GetSwapTarget(mapSpec.Canary.SwapTo) != "" {
+			add(mapSpec.Canary.SwapTo.ImagePullSecret)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MarkSynced records that the MapStore has been loaded from all existing SwapMaps
+func (m *MapStore) MarkSynced() {
+	m.synced.Store(true)
+}
+
+// Synced reports whether the MapStore has completed its initial sync
+func (m *MapStore) Synced() bool {
+	return m.synced.Load()
+}
+
+// ReadyzCheck is a healthz.Checker that fails until the MapStore has synced
+func (m *MapStore) ReadyzCheck(_ *http.Request) error {
+	if !m.Synced() {
+		return fmt.Errorf("mapstore has not completed its initial sync")
+	}
 	return nil
 }
 
@@ -47,7 +368,9 @@ func NewMapStore() *MapStore {
 
 	once.Do(func() {
 		ms = &MapStore{
-			maps: make(map[string]*mapsv1alpha1.Map),
+			maps:    make(map[string]*mapsv1alpha1.Map),
+			owners:  make(map[string]string),
+			sources: make(map[string]*sourceMaps),
 		}
 	})
 	return ms
@@ -56,8 +379,6 @@ func NewMapStore() *MapStore {
 func GetMapKey(mapSpec mapsv1alpha1.Map) (string, error) {
 	mapKey := ""
 
-	fmt.Printf("\nRegistry: %v, Project: %v, Image: %v\n", mapSpec.SwapFrom.Registry, mapSpec.SwapFrom.Project, mapSpec.SwapFrom.Image)
-
 	if mapSpec.Name == "default" && mapSpec.Type == "default" {
 		mapKey += "default"
 		return mapKey, nil
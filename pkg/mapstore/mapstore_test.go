@@ -0,0 +1,221 @@
+package mapstore
+
+import (
+	"reflect"
+	"testing"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		image string
+		want  ImageRef
+	}{
+		{"nginx", ImageRef{Registry: "docker.io", Repository: "nginx"}},
+		{"library/nginx:1.25", ImageRef{Registry: "docker.io", Repository: "library/nginx", Tag: "1.25"}},
+		{"docker.io/library/nginx:1.25", ImageRef{Registry: "docker.io", Repository: "library/nginx", Tag: "1.25"}},
+		{"quay.io/team/app@sha256:abc", ImageRef{Registry: "quay.io", Repository: "team/app", Digest: "sha256:abc"}},
+		{"quay.io/team/app:1.0@sha256:abc", ImageRef{Registry: "quay.io", Repository: "team/app", Tag: "1.0", Digest: "sha256:abc"}},
+		{"registry.example.com:5000/app", ImageRef{Registry: "registry.example.com:5000", Repository: "app"}},
+		{"registry.example.com:5000/app:2", ImageRef{Registry: "registry.example.com:5000", Repository: "app", Tag: "2"}},
+		{"localhost/app:dev", ImageRef{Registry: "localhost", Repository: "app", Tag: "dev"}},
+		{"localhost:5000/app", ImageRef{Registry: "localhost:5000", Repository: "app"}},
+	}
+	for _, tt := range tests {
+		if got := ParseImage(tt.image); got != tt.want {
+			t.Errorf("ParseImage(%q) = %+v, want %+v", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestImageRefString(t *testing.T) {
+	for image, want := range map[string]string{
+		"nginx":      "docker.io/nginx",
+		"nginx:1.25": "docker.io/nginx:1.25",
+		"registry.example.com:5000/app@sha256:abc": "registry.example.com:5000/app@sha256:abc",
+	} {
+		if got := ParseImage(image).String(); got != want {
+			t.Errorf("ParseImage(%q).String() = %q, want %q", image, got, want)
+		}
+	}
+}
+
+func TestResolvePrecedence(t *testing.T) {
+	store := NewMapStore()
+	store.LoadSource("test", 0, 1, false, map[string]*mapsv1alpha1.Map{
+		"default": {Name: "default", Type: "default", SwapTo: mapsv1alpha1.SwapRef{Registry: "default.example.com"}},
+		"docker.io": {
+			Name:     "docker",
+			Type:     "swap",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "docker.example.com"},
+		},
+		"docker.io/library": {
+			Name:     "library",
+			Type:     "swap",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io", Project: "library"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "library.example.com"},
+		},
+		"docker.io/library/nginx:1.25": {
+			Name:     "nginx",
+			Type:     "exact",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io", Project: "library", Image: "nginx:1.25"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "exact.example.com", Image: "nginx:1.25-patched"},
+		},
+		"-dev": {
+			Name:     "dev",
+			Type:     "replace",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "-dev"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "-prod"},
+		},
+		"quay.io/team/app": {
+			Name:     "no-swap",
+			Type:     "exact",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "quay.io", Project: "team", Image: "app"},
+			NoSwap:   true,
+		},
+		"ghcr.io": {
+			Name:      "wildcard",
+			Type:      "swap",
+			SwapFrom:  mapsv1alpha1.SwapRef{Registry: "ghcr.io"},
+			SwapTo:    mapsv1alpha1.SwapRef{Registry: "wildcard.example.com"},
+			Wildcards: []string{"*.example.org/*"},
+		},
+	})
+
+	tests := []struct {
+		image, action, want, mapName string
+	}{
+		// Exact maps win over every other map
+		{"library/nginx:1.25", ActionSwap, "exact.example.com/nginx:1.25-patched", "nginx"},
+		// Replace maps win over swap maps
+		{"docker.io/library/app-dev:1", ActionSwap, "docker.io/library/app-prod:1", "dev"},
+		// The longest swap prefix wins
+		{"library/nginx:1.26", ActionSwap, "library.example.com/nginx:1.26", "library"},
+		{"docker.io/bitnami/redis:7", ActionSwap, "docker.example.com/bitnami/redis:7", "docker"},
+		{"quay.io/team/app", ActionNoSwap, "quay.io/team/app", "no-swap"},
+		// Wildcards come after swap prefixes but before the default map
+		{"registry.example.org/app:1", ActionSwap, "wildcard.example.com/app:1", "wildcard"},
+		{"gcr.io/app:1", ActionSwap, "default.example.com/app:1", "default"},
+	}
+	for _, tt := range tests {
+		decision := store.Resolve(tt.image)
+		mapName := ""
+		if decision.Map != nil {
+			mapName = decision.Map.Name
+		}
+		if decision.Action != tt.action || decision.SwappedImage != tt.want || mapName != tt.mapName {
+			t.Errorf("Resolve(%q) = %s %q by map %q, want %s %q by map %q", tt.image, decision.Action, decision.SwappedImage, mapName, tt.action, tt.want, tt.mapName)
+		}
+	}
+
+	store.DeleteSource("test")
+	if decision := store.Resolve("nginx"); decision.Action != ActionNoMatch {
+		t.Errorf("Resolve after DeleteSource = %s, want %s", decision.Action, ActionNoMatch)
+	}
+}
+
+func TestLoadSourcePrecedence(t *testing.T) {
+	mapSpec := func(target string) map[string]*mapsv1alpha1.Map {
+		return map[string]*mapsv1alpha1.Map{
+			"docker.io": {Name: "docker", Type: "swap", SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"}, SwapTo: mapsv1alpha1.SwapRef{Registry: target}},
+		}
+	}
+
+	store := NewMapStore()
+	store.LoadSource("configmap", -1, 1, false, mapSpec("configmap.example.com"))
+	if conflicts := store.LoadSource("swapmap", 0, 1, false, mapSpec("swapmap.example.com")); len(conflicts) != 0 {
+		t.Errorf("higher precedence source lost keys %v", conflicts)
+	}
+	if owner, _ := store.Owner("docker.io"); owner != "swapmap" {
+		t.Errorf("docker.io owned by %q, want the higher precedence source", owner)
+	}
+
+	store.DeleteSource("swapmap")
+	if got := store.Resolve("nginx").SwappedImage; got != "configmap.example.com/nginx" {
+		t.Errorf("after the owner was deleted resolved to %q, want the lower precedence source's swap", got)
+	}
+}
+
+func TestLoadSourceTie(t *testing.T) {
+	mapSpec := func(target string) map[string]*mapsv1alpha1.Map {
+		return map[string]*mapsv1alpha1.Map{
+			"docker.io": {Name: "docker", Type: "swap", SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"}, SwapTo: mapsv1alpha1.SwapRef{Registry: target}},
+		}
+	}
+
+	// Whichever order the sources are loaded in, the one whose name sorts first wins
+	for _, order := range [][]string{{"ns/a", "ns/b"}, {"ns/b", "ns/a"}} {
+		store := NewMapStore()
+		for _, source := range order {
+			store.LoadSource(source, 0, 1, false, mapSpec(source+".example.com"))
+		}
+		if owner, _ := store.Owner("docker.io"); owner != "ns/a" {
+			t.Errorf("loading %v, docker.io owned by %q, want %q", order, owner, "ns/a")
+		}
+		// Reloading the loser doesn't take the key over
+		if conflicts := store.LoadSource("ns/b", 0, 2, false, mapSpec("ns/b.example.com")); len(conflicts) != 1 {
+			t.Errorf("loading %v, reloaded source got conflicts %v, want docker.io", order, conflicts)
+		}
+	}
+}
+
+func TestOwnersChanged(t *testing.T) {
+	mapSpec := func(target string) map[string]*mapsv1alpha1.Map {
+		return map[string]*mapsv1alpha1.Map{
+			"docker.io": {Name: "docker", Type: "swap", SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"}, SwapTo: mapsv1alpha1.SwapRef{Registry: target}},
+		}
+	}
+
+	var changed []string
+	store := NewMapStore()
+	store.OwnersChanged = func(sources []string) { changed = append(changed, sources...) }
+
+	store.LoadSource("ns/b", 0, 1, false, mapSpec("b.example.com"))
+	store.LoadSource("ns/c", 0, 1, false, mapSpec("c.example.com"))
+	if len(changed) != 0 {
+		t.Errorf("loading a source that lost the key reported %v as changed", changed)
+	}
+
+	// ns/a takes the key over from ns/b
+	store.LoadSource("ns/a", 0, 1, false, mapSpec("a.example.com"))
+	if want := []string{"ns/b"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("taking a key over reported %v as changed, want %v", changed, want)
+	}
+
+	// Deleting ns/a hands the key back to ns/b, ns/c still conflicts
+	changed = nil
+	store.DeleteSource("ns/a")
+	if want := []string{"ns/b"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("deleting the owner reported %v as changed, want %v", changed, want)
+	}
+}
+
+func TestPullSecrets(t *testing.T) {
+	store := NewMapStore()
+	store.LoadSource("test", 0, 1, false, map[string]*mapsv1alpha1.Map{
+		"docker.io": {
+			Name:     "docker",
+			Type:     "swap",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "harbor.example.com", ImagePullSecret: "harbor"},
+			Canary: &mapsv1alpha1.Canary{
+				Percent: 10,
+				SwapTo:  mapsv1alpha1.SwapRef{Registry: "mirror.example.com", ImagePullSecret: "mirror"},
+			},
+		},
+		"quay.io": {
+			Name:     "quay",
+			Type:     "swap",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "quay.io"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "harbor.example.com", ImagePullSecret: "harbor"},
+			// Without a target of its own the canary is swapped to the map's swapTo
+			Canary: &mapsv1alpha1.Canary{Percent: 10, SwapTo: mapsv1alpha1.SwapRef{ImagePullSecret: "unused"}},
+		},
+	})
+
+	if got, want := store.PullSecrets(), []string{"harbor", "mirror"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PullSecrets() = %v, want %v", got, want)
+	}
+}
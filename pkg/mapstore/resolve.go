@@ -0,0 +1,351 @@
+package mapstore
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strings"
+	"time"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+const (
+	// DefaultRegistry is the registry assumed for images that don't specify one
+	DefaultRegistry = "docker.io"
+
+	// ActionSwap means the image was rewritten by a map
+	ActionSwap = "swap"
+	// ActionNoSwap means the image matched a map that explicitly disables swapping
+	ActionNoSwap = "noSwap"
+	// ActionNoMatch means no map (including the default map) matched the image
+	ActionNoMatch = "noMatch"
+	// ActionAudit means the image matched a map loaded in audit mode, which
+	// would have swapped it to AuditImage
+	ActionAudit = "audit"
+
+	// CanaryGroupCanary is the group of pods a canary map is rolled out to
+	CanaryGroupCanary = "canary"
+	// CanaryGroupControl is the group of pods a canary map isn't rolled out to yet
+	CanaryGroupControl = "control"
+)
+
+// ImageRef is a container image reference split into its parts
+type ImageRef struct {
+	// Registry is the registry host (and optional port) of the image
+	Registry string
+	// Repository is the path of the image within the registry (e.g. "library/nginx")
+	Repository string
+	// Tag is the image tag, if any
+	Tag string
+	// Digest is the image digest, if any
+	Digest string
+}
+
+// ParseImage splits an image reference into its parts. Images without an
+// explicit registry are assumed to live in DefaultRegistry.
+func ParseImage(image string) ImageRef {
+	ref := ImageRef{}
+
+	if i := strings.Index(image, "@"); i >= 0 {
+		ref.Digest = image[i+1:]
+		image = image[:i]
+	}
+
+	// A colon after the last slash separates the tag, anything before that is a registry port
+	if i := strings.LastIndex(image, ":"); i >= 0 && !strings.Contains(image[i:], "/") {
+		ref.Tag = image[i+1:]
+		image = image[:i]
+	}
+
+	first, rest, found := strings.Cut(image, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		ref.Registry = first
+		ref.Repository = rest
+	} else {
+		ref.Registry = DefaultRegistry
+		ref.Repository = image
+	}
+
+	return ref
+}
+
+// Name returns the registry and repository of the image without tag or digest
+func (r ImageRef) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// String returns the fully qualified image reference
+func (r ImageRef) String() string {
+	image := r.Name()
+	if r.Tag != "" {
+		image += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		image += "@" + r.Digest
+	}
+	return image
+}
+
+// Decision is the outcome of resolving an image against the MapStore
+type Decision struct {
+	// Image is the image as it was submitted
+	Image string
+	// SwappedImage is the image after the matched map was applied. It equals
+	// Image when no swap happened.
+	SwappedImage string
+	// MapKey is the key of the matched map, empty when nothing matched
+	MapKey string
+	// Map is the matched map, nil when nothing matched
+	Map *mapsv1alpha1.Map
+	// Action is one of ActionSwap, ActionNoSwap, ActionNoMatch or ActionAudit
+	Action string
+	// AuditImage is the image an audit mode map would have swapped to, empty
+	// unless Action is ActionAudit
+	AuditImage string
+	// Canary is CanaryGroupCanary or CanaryGroupControl when the matched map
+	// has a canary, and empty otherwise
+	Canary string
+}
+
+// Swapped reports whether the decision rewrote the image
+func (d Decision) Swapped() bool {
+	return d.Action == ActionSwap && d.SwappedImage != d.Image
+}
+
+// AtTarget reports whether the image already points at the matched map's
+// target, or its canary target, i.e. it was swapped before. Prefix maps such
+// as "default" match swapped images again, so swapping them twice would nest
+// the target.
+func (d Decision) AtTarget() bool {
+	if d.Map == nil {
+		return false
+	}
+	targets := []string{GetSwapTarget(d.Map.SwapTo)}
+	if d.Map.Canary != nil {
+		targets = append(targets, GetSwapTarget(d.Map.Canary.SwapTo))
+	}
+	for _, target := range targets {
+		if target != "" && strings.HasPrefix(ParseImage(d.Image).String(), target+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve works out what the loaded maps would do to the given image.
+//
+// Maps are consulted in order of specificity: "exact" maps matching the whole
+// image, "replace" maps matching a substring, "swap" maps matching the longest
+// registry/project/image prefix, wildcard patterns and finally the "default" map.
+// Replace and wildcard maps are tried by descending priority, then key. Maps
+// outside their activeFrom, activeUntil and schedule are passed over, as are
+// maps with container criteria or selectors, which only apply through
+// ResolveContainer.
+func (m *MapStore) Resolve(image string) Decision {
+	return m.ResolveFor(image, "")
+}
+
+// ResolveFor resolves the image like Resolve for a pod whose canary key, the
+// UID of its controller or else its namespace and name, places it in the
+// canary or control group of maps with a canary. Pods without a canary key
+// are in the control group.
+func (m *MapStore) ResolveFor(image, canaryKey string) Decision {
+	return m.resolve(image, canaryKey, nil, func(string, ...interface{}) {})
+}
+
+// ResolveContainer resolves the image of a pod container like ResolveFor. A
+// container left out by the container criteria or the namespace and pod
+// selectors of the map matching its image isn't swapped.
+func (m *MapStore) ResolveContainer(image, canaryKey string, container Container) Decision {
+	return m.resolve(image, canaryKey, &container, func(string, ...interface{}) {})
+}
+
+// Trace resolves the image like Resolve and also returns the steps taken to
+// reach the decision, for debugging maps
+func (m *MapStore) Trace(image string) (Decision, []string) {
+	trace := []string{}
+	decision := m.resolve(image, "", nil, func(format string, args ...interface{}) {
+		trace = append(trace, fmt.Sprintf(format, args...))
+	})
+	return decision, trace
+}
+
+func (m *MapStore) resolve(image, canaryKey string, container *Container, tracef func(format string, args ...interface{})) Decision {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	decision := m.match(image, canaryKey, container, m.now(), tracef)
+	if decision.Canary != "" {
+		tracef("map %q is rolled out to %d%% of pods, the pod is in the %s group", decision.Map.Name, decision.Map.Canary.Percent, decision.Canary)
+	}
+	if decision.Swapped() && m.audited(decision.MapKey) {
+		tracef("map %q is in audit mode, not swapping to %q", decision.Map.Name, decision.SwappedImage)
+		decision.Action = ActionAudit
+		decision.AuditImage = decision.SwappedImage
+		decision.SwappedImage = decision.Image
+	}
+	return decision
+}
+
+// match finds the map for the image. The caller must hold the lock.
+func (m *MapStore) match(image, canaryKey string, container *Container, now time.Time, tracef func(format string, args ...interface{})) Decision {
+	ref := ParseImage(image)
+	full := ref.String()
+	decision := Decision{Image: image, SwappedImage: image, Action: ActionNoMatch}
+	tracef("parsed %q as registry %q, repository %q, tag %q, digest %q", image, ref.Registry, ref.Repository, ref.Tag, ref.Digest)
+
+	applies := func(key string, mapSpec *mapsv1alpha1.Map) bool {
+		if !mapActive(mapSpec, m.schedules[key], now) {
+			tracef("map %q matched but isn't active at %s", mapSpec.Name, now.UTC().Format(time.RFC3339))
+			return false
+		}
+		return true
+	}
+	// Images the matched map's container criteria or selectors leave out
+	// aren't swapped, rather than being passed on to a less specific map such
+	// as the default
+	pick := func(key string, mapSpec *mapsv1alpha1.Map, swap func(target string) string) Decision {
+		if !ContainerSelected(mapSpec.Containers, container) {
+			if container == nil {
+				tracef("map %q only applies to selected pod containers, not swapping", mapSpec.Name)
+			} else {
+				tracef("map %q doesn't select %s container %q with pull policy %s, not swapping", mapSpec.Name, container.Kind, container.Name, container.PullPolicy)
+			}
+			decision.MapKey, decision.Map, decision.Action = key, mapSpec, ActionNoSwap
+			return decision
+		}
+		if !m.selectors[key].selects(container) {
+			if container == nil {
+				tracef("map %q only applies to pods its namespace and pod selectors select, not swapping", mapSpec.Name)
+			} else {
+				tracef("map %q doesn't select pods labelled %v in namespaces labelled %v, not swapping", mapSpec.Name, container.Labels.Pod, container.Labels.Namespace)
+			}
+			decision.MapKey, decision.Map, decision.Action = key, mapSpec, ActionNoSwap
+			return decision
+		}
+		return decide(decision, key, mapSpec, canaryKey, swap)
+	}
+
+	for _, key := range m.order {
+		if mapSpec := m.maps[key]; mapSpec.Type == "exact" && (key == image || key == full) && applies(key, mapSpec) {
+			tracef("exact map %q matched key %q", mapSpec.Name, key)
+			return pick(key, mapSpec, func(target string) string { return target })
+		}
+	}
+	tracef("no exact map matched %q or %q", image, full)
+
+	for _, key := range m.order {
+		if mapSpec := m.maps[key]; mapSpec.Type == "replace" && strings.Contains(image, key) && applies(key, mapSpec) {
+			tracef("replace map %q matched substring %q", mapSpec.Name, key)
+			return pick(key, mapSpec, func(target string) string { return strings.Replace(image, key, target, 1) })
+		}
+	}
+	tracef("no replace map matched a substring of %q", image)
+
+	// Walk the image name from most to least specific looking for a swap map
+	name := ref.Name()
+	candidates := []string{""}
+	if suffix := strings.TrimPrefix(full, name); suffix != "" {
+		candidates = []string{suffix, ""}
+	}
+	for prefix := name; prefix != ""; {
+		for _, suffix := range candidates {
+			key := prefix + suffix
+			if mapSpec, ok := m.maps[key]; ok && mapSpec.Type == "swap" && applies(key, mapSpec) {
+				tracef("swap map %q matched prefix %q", mapSpec.Name, key)
+				return pick(key, mapSpec, func(target string) string { return target + strings.TrimPrefix(full, key) })
+			}
+			tracef("no swap map for prefix %q", key)
+		}
+		candidates = []string{""}
+		i := strings.LastIndex(prefix, "/")
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+
+	for _, key := range m.order {
+		mapSpec := m.maps[key]
+		for _, pattern := range mapSpec.Wildcards {
+			if ok, _ := path.Match(pattern, name); ok && applies(key, mapSpec) {
+				tracef("wildcard %q of map %q matched %q", pattern, mapSpec.Name, name)
+				return pick(key, mapSpec, func(target string) string { return replaceRegistry(ref, target) })
+			}
+		}
+	}
+	tracef("no wildcard matched %q", name)
+
+	if mapSpec, ok := m.maps["default"]; ok && applies("default", mapSpec) {
+		tracef("default map %q matched", mapSpec.Name)
+		return pick("default", mapSpec, func(target string) string { return replaceRegistry(ref, target) })
+	}
+	tracef("no active default map loaded")
+
+	return decision
+}
+
+// decide fills in the decision for a matched map, using swap to rewrite the
+// image to the map's target or, for canary pods, its canary target
+func decide(decision Decision, key string, mapSpec *mapsv1alpha1.Map, canaryKey string, swap func(target string) string) Decision {
+	decision.MapKey = key
+	decision.Map = mapSpec
+
+	target := GetSwapTarget(mapSpec.SwapTo)
+	if mapSpec.Canary != nil && !mapSpec.NoSwap {
+		decision.Canary = CanaryGroup(canaryKey, mapSpec.Canary.Percent)
+		canaryTarget := GetSwapTarget(mapSpec.Canary.SwapTo)
+		switch {
+		case decision.Canary == CanaryGroupCanary && canaryTarget != "":
+			target = canaryTarget
+		case decision.Canary == CanaryGroupControl && canaryTarget == "":
+			target = ""
+		}
+	}
+
+	if mapSpec.NoSwap || target == "" {
+		decision.Action = ActionNoSwap
+		return decision
+	}
+
+	decision.Action = ActionSwap
+	decision.SwappedImage = swap(target)
+	return decision
+}
+
+// CanaryGroup places the canary key in the canary group of a map rolled out
+// to percent of pods, or the control group. Keys hash to a fixed bucket, so a
+// key stays in the canary group as the percentage rises. Empty keys are always
+// in the control group.
+func CanaryGroup(canaryKey string, percent int32) string {
+	if canaryKey == "" {
+		return CanaryGroupControl
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(canaryKey))
+	if int32(hash.Sum32()%100) < percent {
+		return CanaryGroupCanary
+	}
+	return CanaryGroupControl
+}
+
+// replaceRegistry swaps the registry of an image for the given target prefix
+func replaceRegistry(ref ImageRef, target string) string {
+	if target == "" {
+		return ref.String()
+	}
+	ref.Registry = target
+	return ref.String()
+}
+
+// GetSwapTarget returns the image prefix a SwapRef points at
+func GetSwapTarget(swapRef mapsv1alpha1.SwapRef) string {
+	parts := []string{}
+	for _, part := range []string{swapRef.Registry, swapRef.Project, swapRef.Image} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,83 @@
+package mapstore
+
+import (
+	"fmt"
+	"testing"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+func TestCanaryGroup(t *testing.T) {
+	canaries := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("replicaset-uid-%d", i)
+		if CanaryGroup(key, 0) != CanaryGroupControl || CanaryGroup(key, 100) != CanaryGroupCanary {
+			t.Fatalf("%q isn't in the control group at 0%% and the canary group at 100%%", key)
+		}
+		if CanaryGroup(key, 20) == CanaryGroupCanary {
+			canaries++
+			if CanaryGroup(key, 50) != CanaryGroupCanary {
+				t.Errorf("%q left the canary group when the percentage rose", key)
+			}
+		}
+	}
+	if canaries < 150 || canaries > 250 {
+		t.Errorf("%d of 1000 keys in the canary group at 20%%", canaries)
+	}
+	if CanaryGroup("", 100) != CanaryGroupControl {
+		t.Errorf("empty key isn't in the control group")
+	}
+}
+
+func TestResolveForCanary(t *testing.T) {
+	store := NewMapStore()
+	store.LoadSource("test", 0, 1, false, map[string]*mapsv1alpha1.Map{
+		"quay.io": {
+			Name:     "quay",
+			Type:     "swap",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "quay.io"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "old.example.com"},
+			Canary:   &mapsv1alpha1.Canary{Percent: 50, SwapTo: mapsv1alpha1.SwapRef{Registry: "new.example.com", ImagePullSecret: "new"}},
+		},
+		"ghcr.io": {
+			Name:     "ghcr",
+			Type:     "swap",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "ghcr.io"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "mirror.example.com"},
+			Canary:   &mapsv1alpha1.Canary{Percent: 50},
+		},
+	})
+
+	canaryKey, controlKey := "", ""
+	for i := 0; canaryKey == "" || controlKey == ""; i++ {
+		key := fmt.Sprintf("uid-%d", i)
+		if CanaryGroup(key, 50) == CanaryGroupCanary {
+			canaryKey = key
+		} else {
+			controlKey = key
+		}
+	}
+
+	tests := []struct {
+		image, key, group, want string
+	}{
+		{"quay.io/app:1", canaryKey, CanaryGroupCanary, "new.example.com/app:1"},
+		{"quay.io/app:1", controlKey, CanaryGroupControl, "old.example.com/app:1"},
+		{"ghcr.io/app:1", canaryKey, CanaryGroupCanary, "mirror.example.com/app:1"},
+		{"ghcr.io/app:1", controlKey, CanaryGroupControl, "ghcr.io/app:1"},
+	}
+	for _, tt := range tests {
+		decision := store.ResolveFor(tt.image, tt.key)
+		if decision.Canary != tt.group || decision.SwappedImage != tt.want {
+			t.Errorf("ResolveFor(%q, %s key) = %q in group %q, want %q in group %q", tt.image, tt.group, decision.SwappedImage, decision.Canary, tt.want, tt.group)
+		}
+	}
+
+	// Images swapped for either group aren't swapped again
+	for _, image := range []string{"new.example.com/app:1", "old.example.com/app:1"} {
+		decision := Decision{Image: image, Map: store.maps["quay.io"]}
+		if !decision.AtTarget() {
+			t.Errorf("%q isn't at the target of the quay map", image)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package mapstore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+// cronDescriptors are the shorthands accepted in place of a cron expression
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSearchLimit bounds the search for the next time a schedule fires, so
+// expressions that never fire, such as "0 0 31 2 *", don't search forever
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// maxWindowFollow bounds how many overlapping windows are joined when working
+// out when a window ends
+const maxWindowFollow = 1000
+
+// CronSchedule is a parsed five field cron expression, evaluated in UTC
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record a "*" day of month or day of week. When
+	// neither is "*" a day matching either field matches, as in cron.
+	domAny, dowAny bool
+}
+
+// ParseCron parses a standard five field cron expression (minute, hour, day of
+// month, month, day of week) or one of the @yearly, @monthly, @weekly, @daily
+// and @hourly shorthands. Fields accept "*", numbers, ranges, lists and steps.
+func ParseCron(spec string) (*CronSchedule, error) {
+	if expanded, ok := cronDescriptors[strings.TrimSpace(spec)]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q has %d fields, expected 5", spec, len(fields))
+	}
+
+	schedule := &CronSchedule{}
+	var err error
+	if schedule.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if schedule.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if schedule.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if schedule.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	// Both 0 and 7 are Sunday
+	if schedule.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.domAny = strings.HasPrefix(fields[2], "*")
+	schedule.dowAny = strings.HasPrefix(fields[4], "*")
+
+	return schedule, nil
+}
+
+// parseCronField returns the bits of the values a cron field matches
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		start, end := min, max
+		if rangePart != "*" {
+			low, high, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(low); err != nil {
+				return 0, fmt.Errorf("invalid value %q", low)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(high); err != nil {
+					return 0, fmt.Errorf("invalid value %q", high)
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first time after t the schedule fires, or the zero time if
+// it doesn't fire within the next five years
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// MapActive reports whether the map is in use at now: after activeFrom,
+// before activeUntil and, with a schedule, within one of its windows. Maps
+// with an invalid schedule are never active.
+func MapActive(mapSpec *mapsv1alpha1.Map, now time.Time) bool {
+	return mapActive(mapSpec, parseSchedule(mapSpec), now)
+}
+
+// mapActive is MapActive with the map's schedule already parsed by
+// parseSchedule, so it isn't parsed again for every image resolved
+func mapActive(mapSpec *mapsv1alpha1.Map, schedule *CronSchedule, now time.Time) bool {
+	if mapSpec.ActiveFrom != nil && now.Before(mapSpec.ActiveFrom.Time) {
+		return false
+	}
+	if mapSpec.ActiveUntil != nil && !now.Before(mapSpec.ActiveUntil.Time) {
+		return false
+	}
+	if mapSpec.Schedule == nil {
+		return true
+	}
+	if schedule == nil {
+		return false
+	}
+
+	_, active := scheduleWindow(schedule, mapSpec.Schedule.Duration.Duration, now)
+	return active
+}
+
+// parseSchedule returns the parsed cron expression of the map's schedule, or
+// nil if it has no schedule or the expression is invalid
+func parseSchedule(mapSpec *mapsv1alpha1.Map) *CronSchedule {
+	if mapSpec.Schedule == nil {
+		return nil
+	}
+	schedule, err := ParseCron(mapSpec.Schedule.Cron)
+	if err != nil {
+		return nil
+	}
+	return schedule
+}
+
+// NextTransition returns the first time after now the map becomes active or
+// inactive, and false if it never changes again
+func NextTransition(mapSpec *mapsv1alpha1.Map, now time.Time) (time.Time, bool) {
+	next := time.Time{}
+	consider := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+
+	if mapSpec.ActiveFrom != nil {
+		consider(mapSpec.ActiveFrom.Time)
+	}
+	if mapSpec.ActiveUntil != nil {
+		consider(mapSpec.ActiveUntil.Time)
+	}
+	if mapSpec.Schedule != nil {
+		if schedule, err := ParseCron(mapSpec.Schedule.Cron); err == nil {
+			if end, active := scheduleWindow(schedule, mapSpec.Schedule.Duration.Duration, now); active {
+				consider(windowEnd(schedule, mapSpec.Schedule.Duration.Duration, end))
+			} else {
+				consider(schedule.Next(now))
+			}
+		}
+	}
+
+	// Nothing changes once activeUntil has passed
+	if mapSpec.ActiveUntil != nil && next.After(mapSpec.ActiveUntil.Time) {
+		return time.Time{}, false
+	}
+	return next, !next.IsZero()
+}
+
+// scheduleWindow reports whether now falls within a window of the schedule,
+// i.e. less than duration after the schedule fired, and when that window ends.
+// Windows that overlap are treated as one.
+func scheduleWindow(schedule *CronSchedule, duration time.Duration, now time.Time) (time.Time, bool) {
+	if duration <= 0 {
+		return time.Time{}, false
+	}
+
+	// The first firing after now-duration starts the window now is in, if it
+	// isn't after now
+	start := schedule.Next(now.Add(-duration))
+	if start.IsZero() || start.After(now) {
+		return time.Time{}, false
+	}
+	return start.Add(duration), true
+}
+
+// windowEnd returns when the window starting at end-duration ends, following
+// firings that start before the previous window ends. Schedules firing more
+// often than their duration are followed for at most maxWindowFollow firings.
+func windowEnd(schedule *CronSchedule, duration time.Duration, end time.Time) time.Time {
+	next := schedule.Next(end.Add(-duration))
+	for i := 0; i < maxWindowFollow && !next.IsZero() && next.Before(end); i++ {
+		end = next.Add(duration)
+		next = schedule.Next(next)
+	}
+	return end
+}
+
+// ValidateMap checks the parts of a map that are only interpreted when
+// resolving images, so maps that would never work can be rejected on load
+func ValidateMap(mapSpec *mapsv1alpha1.Map) error {
+	if err := validateContainers(mapSpec.Containers); err != nil {
+		return err
+	}
+	if err := validateSelectors(mapSpec); err != nil {
+		return err
+	}
+	if mapSpec.Schedule == nil {
+		return nil
+	}
+	if _, err := ParseCron(mapSpec.Schedule.Cron); err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+	if mapSpec.Schedule.Duration.Duration <= 0 {
+		return fmt.Errorf("invalid schedule: duration must be positive")
+	}
+	return nil
+}
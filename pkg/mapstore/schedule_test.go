@@ -0,0 +1,126 @@
+package mapstore
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+func date(day, hour, minute int) time.Time {
+	// June 2023 starts on a Thursday
+	return time.Date(2023, 6, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	tests := []struct {
+		cron string
+		from time.Time
+		want time.Time
+	}{
+		{"0 2 * * *", date(1, 0, 0), date(1, 2, 0)},
+		{"0 2 * * *", date(1, 2, 0), date(2, 2, 0)},
+		{"*/15 * * * *", date(1, 0, 7), date(1, 0, 15)},
+		{"30 9-17/4 * * *", date(1, 10, 0), date(1, 13, 30)},
+		{"0 2 * * 1", date(1, 0, 0), date(5, 2, 0)},
+		{"0 2 * * 7", date(1, 0, 0), date(4, 2, 0)},
+		{"0 0 10,20 * *", date(11, 0, 0), date(20, 0, 0)},
+		// Day of month and day of week both restricted: either matches
+		{"0 0 10 * 6", date(1, 0, 0), date(3, 0, 0)},
+		{"@monthly", date(1, 0, 0), time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", date(1, 0, 0), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", date(1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		schedule, err := ParseCron(tt.cron)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", tt.cron, err)
+		}
+		if got := schedule.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q.Next(%s) = %s, want %s", tt.cron, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, cron := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseCron(cron); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want an error", cron)
+		}
+	}
+}
+
+func TestMapActive(t *testing.T) {
+	from, until := metav1.NewTime(date(5, 2, 0)), metav1.NewTime(date(10, 0, 0))
+	window := &mapsv1alpha1.Schedule{Cron: "0 2 * * 6", Duration: metav1.Duration{Duration: 4 * time.Hour}}
+
+	tests := []struct {
+		name    string
+		mapSpec mapsv1alpha1.Map
+		now     time.Time
+		active  bool
+		next    time.Time
+	}{
+		{"before activeFrom", mapsv1alpha1.Map{ActiveFrom: &from}, date(5, 1, 59), false, from.Time},
+		{"at activeFrom", mapsv1alpha1.Map{ActiveFrom: &from}, from.Time, true, time.Time{}},
+		{"before activeUntil", mapsv1alpha1.Map{ActiveUntil: &until}, date(9, 23, 59), true, until.Time},
+		{"at activeUntil", mapsv1alpha1.Map{ActiveUntil: &until}, until.Time, false, time.Time{}},
+		{"before window", mapsv1alpha1.Map{Schedule: window}, date(3, 1, 0), false, date(3, 2, 0)},
+		{"in window", mapsv1alpha1.Map{Schedule: window}, date(3, 5, 59), true, date(3, 6, 0)},
+		{"after window", mapsv1alpha1.Map{Schedule: window}, date(3, 6, 0), false, date(10, 2, 0)},
+		{"window after activeUntil", mapsv1alpha1.Map{ActiveUntil: &until, Schedule: window}, date(3, 6, 0), false, until.Time},
+		{"invalid schedule", mapsv1alpha1.Map{Schedule: &mapsv1alpha1.Schedule{Cron: "daily", Duration: window.Duration}}, date(3, 3, 0), false, time.Time{}},
+	}
+	for _, tt := range tests {
+		if active := MapActive(&tt.mapSpec, tt.now); active != tt.active {
+			t.Errorf("%s: MapActive = %v, want %v", tt.name, active, tt.active)
+		}
+		next, ok := NextTransition(&tt.mapSpec, tt.now)
+		if !next.Equal(tt.next) || ok == tt.next.IsZero() {
+			t.Errorf("%s: NextTransition = %s, %v, want %s", tt.name, next, ok, tt.next)
+		}
+	}
+}
+
+func TestNextTransitionJoinsOverlappingWindows(t *testing.T) {
+	mapSpec := &mapsv1alpha1.Map{Schedule: &mapsv1alpha1.Schedule{Cron: "0 * * * *", Duration: metav1.Duration{Duration: 90 * time.Minute}}}
+	mapSpec.ActiveUntil = &metav1.Time{Time: date(1, 12, 0)}
+
+	next, ok := NextTransition(mapSpec, date(1, 3, 0))
+	if !ok || !next.Equal(date(1, 12, 0)) {
+		t.Errorf("NextTransition = %s, %v, want %s", next, ok, date(1, 12, 0))
+	}
+}
+
+func TestResolveWithClock(t *testing.T) {
+	clock := clocktesting.NewFakePassiveClock(date(3, 1, 0))
+	store := NewMapStore()
+	store.Clock = clock
+	store.LoadSource("test", 0, 1, false, map[string]*mapsv1alpha1.Map{
+		"default": {Name: "default", Type: "default", SwapTo: mapsv1alpha1.SwapRef{Registry: "mirror.example.com"}},
+		"docker.io": {
+			Name:     "maintenance",
+			Type:     "swap",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "dr.example.com"},
+			Schedule: &mapsv1alpha1.Schedule{Cron: "0 2 * * 6", Duration: metav1.Duration{Duration: 4 * time.Hour}},
+		},
+	})
+
+	for _, tt := range []struct {
+		now  time.Time
+		want string
+	}{
+		{date(3, 1, 0), "mirror.example.com/nginx:1.25"},
+		{date(3, 2, 0), "dr.example.com/nginx:1.25"},
+		{date(3, 6, 0), "mirror.example.com/nginx:1.25"},
+	} {
+		clock.SetTime(tt.now)
+		if got := store.Resolve("nginx:1.25").SwappedImage; got != tt.want {
+			t.Errorf("at %s resolved to %q, want %q", tt.now, got, tt.want)
+		}
+	}
+}
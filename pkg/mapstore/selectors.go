@@ -0,0 +1,74 @@
+package mapstore
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+// PodLabels are the labels of the pod, or pod template, an image is resolved
+// for and of its namespace, matched against the selectors of maps
+type PodLabels struct {
+	// Pod are the labels of the pod or pod template
+	Pod map[string]string
+	// Namespace are the labels of the pod's namespace
+	Namespace map[string]string
+}
+
+// podSelectors are the parsed namespace and pod selectors of a map
+type podSelectors struct {
+	namespace labels.Selector
+	pod       labels.Selector
+}
+
+// parseSelectors returns the parsed selectors of the map, or nil if it has
+// none. Invalid selectors select nothing.
+func parseSelectors(mapSpec *mapsv1alpha1.Map) *podSelectors {
+	if mapSpec.NamespaceSelector == nil && mapSpec.PodSelector == nil {
+		return nil
+	}
+	return &podSelectors{
+		namespace: parseSelector(mapSpec.NamespaceSelector),
+		pod:       parseSelector(mapSpec.PodSelector),
+	}
+}
+
+// parseSelector returns the label selector, selecting everything when it is
+// nil and nothing when it is invalid
+func parseSelector(selector *metav1.LabelSelector) labels.Selector {
+	if selector == nil {
+		return labels.Everything()
+	}
+	parsed, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return labels.Nothing()
+	}
+	return parsed
+}
+
+// selects reports whether the pod and its namespace meet the map's selectors.
+// Maps without selectors apply to every image, maps with selectors only to
+// images of pods they select, so never when container is nil.
+func (s *podSelectors) selects(container *Container) bool {
+	if s == nil {
+		return true
+	}
+	if container == nil {
+		return false
+	}
+	return s.namespace.Matches(labels.Set(container.Labels.Namespace)) && s.pod.Matches(labels.Set(container.Labels.Pod))
+}
+
+// validateSelectors checks the namespace and pod selectors of a map
+func validateSelectors(mapSpec *mapsv1alpha1.Map) error {
+	if _, err := metav1.LabelSelectorAsSelector(mapSpec.NamespaceSelector); err != nil {
+		return fmt.Errorf("invalid namespaceSelector: %w", err)
+	}
+	if _, err := metav1.LabelSelectorAsSelector(mapSpec.PodSelector); err != nil {
+		return fmt.Errorf("invalid podSelector: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package mapstore
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+)
+
+func TestResolveContainerSelectors(t *testing.T) {
+	store := NewMapStore()
+	store.LoadSource("test", 0, 1, false, map[string]*mapsv1alpha1.Map{
+		"default": {Name: "default", Type: "default", SwapTo: mapsv1alpha1.SwapRef{Registry: "mirror.example.com"}},
+		"docker.io": {
+			Name:     "docker",
+			Type:     "swap",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "cache.example.com"},
+			NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "team", Operator: metav1.LabelSelectorOpIn, Values: []string{"web", "api"}},
+			}},
+			PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "frontend"}},
+		},
+	})
+	if !store.NamespaceSelectors() {
+		t.Errorf("NamespaceSelectors = false with a namespace selector loaded")
+	}
+
+	web := map[string]string{"team": "web"}
+	frontend := map[string]string{"tier": "frontend", "app": "shop"}
+	tests := []struct {
+		name   string
+		image  string
+		labels PodLabels
+		action string
+		want   string
+	}{
+		{"selected", "nginx:1.25", PodLabels{Pod: frontend, Namespace: web}, ActionSwap, "cache.example.com/nginx:1.25"},
+		// Pods the docker map doesn't select are left alone rather than
+		// falling through to the default map
+		{"other namespace", "nginx:1.25", PodLabels{Pod: frontend, Namespace: map[string]string{"team": "data"}}, ActionNoSwap, "nginx:1.25"},
+		{"unknown namespace", "nginx:1.25", PodLabels{Pod: frontend}, ActionNoSwap, "nginx:1.25"},
+		{"other pod", "nginx:1.25", PodLabels{Pod: map[string]string{"tier": "backend"}, Namespace: web}, ActionNoSwap, "nginx:1.25"},
+		// Images the docker map doesn't match still get the default map
+		{"unmatched image", "quay.io/app:1", PodLabels{}, ActionSwap, "mirror.example.com/app:1"},
+	}
+	for _, tt := range tests {
+		decision := store.ResolveContainer(tt.image, "", Container{Name: "app", Labels: tt.labels})
+		if decision.Action != tt.action || decision.SwappedImage != tt.want {
+			t.Errorf("%s: ResolveContainer(%q) = %s %q, want %s %q", tt.name, tt.image, decision.Action, decision.SwappedImage, tt.action, tt.want)
+		}
+	}
+
+	if decision := store.Resolve("nginx:1.25"); decision.Action != ActionNoSwap || decision.Map.Name != "docker" {
+		t.Errorf("Resolve without a pod = %s by %+v, want noSwap by the docker map", decision.Action, decision.Map)
+	}
+}
+
+func TestValidateMapSelectors(t *testing.T) {
+	invalid := &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: metav1.LabelSelectorOpIn}}}
+	for _, mapSpec := range []*mapsv1alpha1.Map{{NamespaceSelector: invalid}, {PodSelector: invalid}} {
+		if err := ValidateMap(mapSpec); err == nil {
+			t.Errorf("ValidateMap accepted an invalid selector in %+v", mapSpec)
+		}
+	}
+	if err := ValidateMap(&mapsv1alpha1.Map{PodSelector: &metav1.LabelSelector{}}); err != nil {
+		t.Errorf("ValidateMap rejected an empty pod selector: %v", err)
+	}
+}
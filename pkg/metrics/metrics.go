@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+var (
+	// ImageSwaps counts images rewritten by a map
+	ImageSwaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgswap_image_swaps_total",
+		Help: "Number of images swapped, by source registry, target registry and map",
+	}, []string{"source_registry", "target_registry", "map"})
+
+	// ImagesUnchanged counts images a map swapped to the image they already had
+	ImagesUnchanged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgswap_images_unchanged_total",
+		Help: "Number of images a map matched but left unchanged, by source registry and map",
+	}, []string{"source_registry", "map"})
+
+	// ImagesUnmatched counts images no map (including the default map) matched
+	ImagesUnmatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgswap_images_unmatched_total",
+		Help: "Number of images that matched no map, by source registry",
+	}, []string{"source_registry"})
+
+	// ImageNoSwaps counts images left alone because the matching map disables swapping
+	ImageNoSwaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgswap_image_noswap_total",
+		Help: "Number of images that matched a noSwap map, by source registry and map",
+	}, []string{"source_registry", "map"})
+
+	// ImageAudits counts images an audit mode map would have swapped
+	ImageAudits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgswap_image_audits_total",
+		Help: "Number of images an audit mode map would have swapped, by source registry, target registry and map",
+	}, []string{"source_registry", "target_registry", "map"})
+
+	// CanaryImages counts images matched by maps with a canary, by the group of their pod
+	CanaryImages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgswap_canary_images_total",
+		Help: "Number of images matched by a map with a canary, by map and canary or control group",
+	}, []string{"map", "group"})
+
+	// AdmissionDenials counts admission requests that were denied
+	AdmissionDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgswap_admission_denials_total",
+		Help: "Number of admission requests denied, by webhook",
+	}, []string{"webhook"})
+
+	// AdmissionErrors counts admission requests that failed with an error
+	AdmissionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgswap_admission_errors_total",
+		Help: "Number of admission requests that errored, by webhook and HTTP status code",
+	}, []string{"webhook", "code"})
+
+	// AdmissionDuration observes how long admission requests take to handle
+	AdmissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "imgswap_admission_duration_seconds",
+		Help:    "Time taken to handle admission requests, by webhook",
+		Buckets: []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	}, []string{"webhook"})
+
+	// SwapMapMaps reports how many maps each SwapMap has loaded into the MapStore
+	SwapMapMaps = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imgswap_swapmap_maps_loaded",
+		Help: "Number of maps loaded into the MapStore, by SwapMap",
+	}, []string{"namespace", "name"})
+
+	// DriftedPods reports how many running pods the last drift scan found with images the maps would swap
+	DriftedPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imgswap_drift_pods",
+		Help: "Number of running pods with images the loaded maps would swap, by namespace",
+	}, []string{"namespace"})
+
+	// DriftedContainers reports how many running containers the last drift scan found with images the maps would swap
+	DriftedContainers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imgswap_drift_containers",
+		Help: "Number of running containers with images the loaded maps would swap, by map",
+	}, []string{"map"})
+
+	// DriftScans counts completed drift scans
+	DriftScans = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "imgswap_drift_scans_total",
+		Help: "Number of completed drift scans",
+	})
+
+	// DriftRestarts counts workloads restarted because their pods drifted
+	DriftRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgswap_drift_restarts_total",
+		Help: "Number of workloads restarted to pick up swapped images, by kind",
+	}, []string{"kind"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		ImageSwaps,
+		ImagesUnchanged,
+		ImagesUnmatched,
+		ImageNoSwaps,
+		ImageAudits,
+		CanaryImages,
+		AdmissionDenials,
+		AdmissionErrors,
+		AdmissionDuration,
+		SwapMapMaps,
+		DriftedPods,
+		DriftedContainers,
+		DriftScans,
+		DriftRestarts,
+	)
+}
+
+// RecordDecision counts the outcome of resolving a single image
+func RecordDecision(decision mapstore.Decision) {
+	sourceRegistry := mapstore.ParseImage(decision.Image).Registry
+
+	if decision.Canary != "" {
+		CanaryImages.WithLabelValues(decision.Map.Name, decision.Canary).Inc()
+	}
+
+	switch {
+	case decision.Swapped():
+		ImageSwaps.WithLabelValues(sourceRegistry, mapstore.ParseImage(decision.SwappedImage).Registry, decision.Map.Name).Inc()
+	case decision.Action == mapstore.ActionSwap:
+		// Such as control pods of a canary without its own target
+		ImagesUnchanged.WithLabelValues(sourceRegistry, decision.Map.Name).Inc()
+	case decision.Action == mapstore.ActionNoSwap:
+		ImageNoSwaps.WithLabelValues(sourceRegistry, decision.Map.Name).Inc()
+	case decision.Action == mapstore.ActionAudit:
+		ImageAudits.WithLabelValues(sourceRegistry, mapstore.ParseImage(decision.AuditImage).Registry, decision.Map.Name).Inc()
+	default:
+		ImagesUnmatched.WithLabelValues(sourceRegistry).Inc()
+	}
+}
+
+// ObserveAdmission records the latency and outcome of an admission request
+func ObserveAdmission(webhook string, start time.Time, resp admission.Response) {
+	AdmissionDuration.WithLabelValues(webhook).Observe(time.Since(start).Seconds())
+
+	if resp.Allowed {
+		return
+	}
+
+	// admission.Denied responds with 403, anything else is an admission.Errored
+	code := int32(http.StatusForbidden)
+	if resp.Result != nil {
+		code = resp.Result.Code
+	}
+	if code == http.StatusForbidden {
+		AdmissionDenials.WithLabelValues(webhook).Inc()
+		return
+	}
+	AdmissionErrors.WithLabelValues(webhook, strconv.Itoa(int(code))).Inc()
+}
@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+func TestRecordDecision(t *testing.T) {
+	mapSpec := &mapsv1alpha1.Map{Name: "quay"}
+
+	RecordDecision(mapstore.Decision{Image: "quay.io/app:1", SwappedImage: "mirror.example.com/app:1", Map: mapSpec, Action: mapstore.ActionSwap})
+	// Control pods of a canary without its own target keep their image
+	RecordDecision(mapstore.Decision{Image: "quay.io/app:1", SwappedImage: "quay.io/app:1", Map: mapSpec, Action: mapstore.ActionSwap, Canary: mapstore.CanaryGroupControl})
+
+	if got := testutil.ToFloat64(ImageSwaps.WithLabelValues("quay.io", "mirror.example.com", "quay")); got != 1 {
+		t.Errorf("swaps = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(ImageSwaps.WithLabelValues("quay.io", "quay.io", "quay")); got != 0 {
+		t.Errorf("unchanged image counted as %v swaps", got)
+	}
+	if got := testutil.ToFloat64(ImagesUnchanged.WithLabelValues("quay.io", "quay")); got != 1 {
+		t.Errorf("unchanged = %v, want 1", got)
+	}
+}
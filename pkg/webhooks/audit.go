@@ -0,0 +1,49 @@
+package webhooks
+
+import (
+	"net/http"
+
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"twr.dev/imgswap/pkg/audit"
+)
+
+// newAuditRecord starts an audit record for an admission request
+func newAuditRecord(req admission.Request) *audit.Record {
+	return &audit.Record{
+		UID:       string(req.UID),
+		Operation: string(req.Operation),
+		Kind:      req.Kind.Kind,
+		Namespace: req.Namespace,
+		Name:      req.Name,
+		User:      req.UserInfo.Username,
+	}
+}
+
+// finishAuditRecord fills in the overall action from the admission response
+// unless the handler already decided it
+func finishAuditRecord(record *audit.Record, resp admission.Response) *audit.Record {
+	if !resp.Allowed {
+		record.Action = audit.ActionErrored
+		if resp.Result != nil {
+			record.Reason = resp.Result.Message
+			if resp.Result.Code == http.StatusForbidden {
+				record.Action = audit.ActionDenied
+			}
+		}
+		return record
+	}
+
+	if record.Action != "" {
+		return record
+	}
+
+	record.Action = audit.ActionUnchanged
+	for _, container := range record.Containers {
+		if container.FinalImage != container.OriginalImage {
+			record.Action = audit.ActionMutated
+			break
+		}
+	}
+	return record
+}
@@ -0,0 +1,95 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"twr.dev/imgswap/pkg/audit"
+	"twr.dev/imgswap/pkg/fieldpolicy"
+	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/metrics"
+)
+
+// CustomResourceImageSwapper swaps images inside arbitrary resources at the
+// paths configured by ImageFieldPolicies, using the same MapStore matching as
+// PodImageSwapper. Its webhook rules are managed by the ImageFieldPolicy
+// controller rather than a kubebuilder marker.
+type CustomResourceImageSwapper struct {
+	MapStore *mapstore.MapStore
+	Policies *fieldpolicy.Store
+	// Recorder emits Events about swapped objects. Events are skipped when nil.
+	Recorder record.EventRecorder
+	// AuditLogger receives one record per admission request. Auditing is skipped when nil.
+	AuditLogger *audit.Logger
+}
+
+func (crsw *CustomResourceImageSwapper) Handle(ctx context.Context, req admission.Request) (resp admission.Response) {
+	start := time.Now()
+	auditRecord := newAuditRecord(req)
+	defer func() {
+		metrics.ObserveAdmission("custom-imgswap", start, resp)
+		crsw.AuditLogger.Log(finishAuditRecord(auditRecord, resp))
+	}()
+
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(req.Object.Raw, &obj.Object); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	auditRecord.Name = objectName(obj)
+	auditRecord.Owner = ownerName(obj)
+
+	paths := crsw.Policies.Paths(schema.GroupVersionKind(req.Kind))
+	if len(paths) == 0 {
+		auditRecord.Action, auditRecord.Reason = audit.ActionSkipped, "no ImageFieldPolicy for kind"
+		return admission.Allowed("no ImageFieldPolicy matches this kind")
+	}
+
+	if PodSkipped(obj.GetAnnotations()) {
+		swapmaplog.Info("Skipping object", "kind", req.Kind.Kind, "name", obj.GetName(), "namespace", req.Namespace, "annotation", SkipAnnotation)
+		auditRecord.Action, auditRecord.Reason = audit.ActionSkipped, SkipAnnotation+" annotation"
+		return admission.Allowed("object opted out of image swapping")
+	}
+
+	swapmaplog.Info("Mutating object", "kind", req.Kind.Kind, "name", obj.GetName(), "namespace", req.Namespace)
+
+	for _, path := range paths {
+		err := fieldpolicy.SwapFields(obj.Object, path, func(location, image string) string {
+			decision := crsw.MapStore.ResolveFor(image, CanaryKey(obj))
+			result := audit.Container{Name: location, OriginalImage: image, FinalImage: image, Action: decision.Action, AuditImage: decision.AuditImage}
+			if decision.Map != nil {
+				result.Map = decision.Map.Name
+			}
+			// Swapped on an earlier admission
+			if decision.Swapped() && decision.AtTarget() {
+				auditRecord.Containers = append(auditRecord.Containers, result)
+				return image
+			}
+
+			metrics.RecordDecision(decision)
+			if decision.Swapped() {
+				swapmaplog.Info("Swapping image", "field", location, "image", decision.Image, "swappedImage", decision.SwappedImage, "map", decision.MapKey)
+				result.FinalImage = decision.SwappedImage
+			}
+			auditRecord.Containers = append(auditRecord.Containers, result)
+			return result.FinalImage
+		})
+		if err != nil {
+			swapmaplog.Error(err, "unable to walk image path", "kind", req.Kind.Kind, "path", path)
+		}
+	}
+
+	marshaledObj, err := json.Marshal(obj.Object)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	recordSwapped(crsw.Recorder, req, obj, auditRecord.Containers)
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledObj)
+}
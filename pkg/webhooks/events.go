@@ -0,0 +1,98 @@
+package webhooks
+
+import (
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"twr.dev/imgswap/pkg/audit"
+)
+
+// ReasonImagesSwapped is the event reason used when an object's images are swapped
+const ReasonImagesSwapped = "ImagesSwapped"
+
+// recordSwapped emits an Event describing the images swapped in an object
+func recordSwapped(recorder record.EventRecorder, req admission.Request, obj metav1.Object, containers []audit.Container) {
+	if recorder == nil {
+		return
+	}
+
+	images := []string{}
+	for _, container := range containers {
+		if container.FinalImage != container.OriginalImage {
+			images = append(images, fmt.Sprintf("%s -> %s", container.OriginalImage, container.FinalImage))
+		}
+	}
+	if len(images) == 0 {
+		return
+	}
+
+	target := eventTarget(req, obj)
+	if target == nil {
+		return
+	}
+	recorder.Eventf(target, corev1.EventTypeNormal, ReasonImagesSwapped,
+		"Swapped images for %s %s: %s", strings.ToLower(req.Kind.Kind), objectName(obj), strings.Join(images, ", "))
+}
+
+// eventTarget returns the object Events about an admitted object should be
+// attached to. Objects being created don't exist yet, so Events go to the
+// owning workload when there is one, the object itself when it is being
+// updated and to the namespace otherwise. Cluster scoped objects being created
+// have no namespace to fall back to, so nil is returned and no Event recorded.
+func eventTarget(req admission.Request, obj metav1.Object) runtime.Object {
+	if owner := metav1.GetControllerOf(obj); owner != nil {
+		return &metav1.PartialObjectMetadata{
+			TypeMeta: metav1.TypeMeta{APIVersion: owner.APIVersion, Kind: owner.Kind},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      owner.Name,
+				Namespace: req.Namespace,
+				UID:       owner.UID,
+			},
+		}
+	}
+
+	if req.Operation == admissionv1.Update {
+		return &metav1.PartialObjectMetadata{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: metav1.GroupVersion{Group: req.Kind.Group, Version: req.Kind.Version}.String(),
+				Kind:       req.Kind.Kind,
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      obj.GetName(),
+				Namespace: req.Namespace,
+				UID:       obj.GetUID(),
+			},
+		}
+	}
+
+	if req.Namespace == "" {
+		return nil
+	}
+	return &corev1.Namespace{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+		ObjectMeta: metav1.ObjectMeta{Name: req.Namespace},
+	}
+}
+
+// ownerName returns the "Kind/name" of the object's controller, if any
+func ownerName(obj metav1.Object) string {
+	if owner := metav1.GetControllerOf(obj); owner != nil {
+		return owner.Kind + "/" + owner.Name
+	}
+	return ""
+}
+
+// objectName returns the object name, falling back to its generateName prefix
+func objectName(obj metav1.Object) string {
+	if obj.GetName() != "" {
+		return obj.GetName()
+	}
+	return obj.GetGenerateName()
+}
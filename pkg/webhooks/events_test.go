@@ -0,0 +1,93 @@
+package webhooks
+
+import (
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"twr.dev/imgswap/pkg/audit"
+)
+
+func TestEventTarget(t *testing.T) {
+	object := func(namespace string, owned bool) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetName("build")
+		obj.SetNamespace(namespace)
+		obj.SetUID("object-uid")
+		if owned {
+			controller := true
+			obj.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "example.com/v1", Kind: "Pipeline", Name: "release", UID: "owner-uid", Controller: &controller}})
+		}
+		return obj
+	}
+	request := func(operation admissionv1.Operation, namespace string) admission.Request {
+		return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: operation,
+			Kind:      metav1.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Build"},
+			Namespace: namespace,
+		}}
+	}
+
+	tests := []struct {
+		name      string
+		req       admission.Request
+		obj       metav1.Object
+		kind      string
+		namespace string
+		target    string
+		uid       types.UID
+	}{
+		{"owned", request(admissionv1.Create, "apps"), object("apps", true), "Pipeline", "apps", "release", "owner-uid"},
+		{"updated", request(admissionv1.Update, "apps"), object("apps", false), "Build", "apps", "build", "object-uid"},
+		{"created", request(admissionv1.Create, "apps"), object("apps", false), "Namespace", "", "apps", ""},
+		{"cluster scoped updated", request(admissionv1.Update, ""), object("", false), "Build", "", "build", "object-uid"},
+		{"cluster scoped created", request(admissionv1.Create, ""), object("", false), "", "", "", ""},
+	}
+	for _, tt := range tests {
+		target := eventTarget(tt.req, tt.obj)
+		if tt.kind == "" {
+			if target != nil {
+				t.Errorf("%s: target = %+v, want none", tt.name, target)
+			}
+			continue
+		}
+		if target == nil {
+			t.Errorf("%s: no target, want %s %s", tt.name, tt.kind, tt.target)
+			continue
+		}
+		meta := target.(metav1.Object)
+		kind := target.GetObjectKind().GroupVersionKind().Kind
+		if kind != tt.kind || meta.GetNamespace() != tt.namespace || meta.GetName() != tt.target || meta.GetUID() != tt.uid {
+			t.Errorf("%s: target = %s %s/%s (%s), want %s %s/%s (%s)", tt.name,
+				kind, meta.GetNamespace(), meta.GetName(), meta.GetUID(), tt.kind, tt.namespace, tt.target, tt.uid)
+		}
+	}
+}
+
+func TestRecordSwapped(t *testing.T) {
+	obj := &unstructured.Unstructured{}
+	obj.SetName("build")
+	swapped := []audit.Container{{Name: "spec.image", OriginalImage: "nginx", FinalImage: "harbor.example.com/dockerhub/nginx"}}
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Kind:      metav1.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Build"},
+	}}
+
+	recorder := record.NewFakeRecorder(1)
+	recordSwapped(recorder, req, obj, swapped)
+	if len(recorder.Events) != 0 {
+		t.Errorf("recorded %q for a cluster scoped object being created", <-recorder.Events)
+	}
+
+	req.Namespace = "apps"
+	obj.SetNamespace("apps")
+	recordSwapped(recorder, req, obj, swapped)
+	if len(recorder.Events) != 1 {
+		t.Errorf("recorded no event for a namespaced object being created")
+	}
+}
@@ -0,0 +1,187 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/audit"
+	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/metrics"
+)
+
+// PodSkipped reports whether the pod annotations opt the whole pod out of swapping
+func PodSkipped(annotations map[string]string) bool {
+	return annotations[SkipAnnotation] == "true"
+}
+
+// SkippedContainers returns the names of the containers the pod annotations opt out of swapping
+func SkippedContainers(annotations map[string]string) map[string]bool {
+	skipContainers := map[string]bool{}
+	for _, name := range strings.Split(annotations[SkipContainersAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			skipContainers[name] = true
+		}
+	}
+	return skipContainers
+}
+
+// IsManager reports whether a pod spec in the namespace belongs to the imgswap
+// manager itself. When managerServiceAccount is empty every pod spec in the
+// manager's namespace is treated as the manager's.
+func IsManager(managerNamespace, managerServiceAccount, namespace string, spec *corev1.PodSpec) bool {
+	if managerNamespace == "" || namespace != managerNamespace {
+		return false
+	}
+	return managerServiceAccount == "" || spec.ServiceAccountName == managerServiceAccount
+}
+
+// CanaryKey returns the key placing an object's images in the canary or
+// control group of maps with a canary: the UID of its controller, so every pod
+// of a ReplicaSet is in the same group, or else its namespace and name. The
+// object's own UID isn't used as it isn't known yet at admission, so the
+// webhook and the drift scanner would place the pod differently.
+func CanaryKey(obj metav1.Object) string {
+	if owner := metav1.GetControllerOf(obj); owner != nil {
+		return string(owner.UID)
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// podLabels returns the labels of a pod, or pod template, in the namespace
+// for the selectors of maps. The namespace is only looked up when a loaded
+// map has a namespace selector. Without a reader, as in webhook-only mode,
+// only the kubernetes.io/metadata.name label of the namespace is known.
+func podLabels(ctx context.Context, reader client.Reader, mapStore *mapstore.MapStore, namespace string, labels map[string]string) (mapstore.PodLabels, error) {
+	result := mapstore.PodLabels{Pod: labels}
+	if !mapStore.NamespaceSelectors() {
+		return result, nil
+	}
+	if reader == nil {
+		result.Namespace = map[string]string{corev1.LabelMetadataName: namespace}
+		return result, nil
+	}
+	ns := &corev1.Namespace{}
+	if err := reader.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		return result, fmt.Errorf("unable to get namespace %s: %w", namespace, err)
+	}
+	result.Namespace = ns.Labels
+	return result, nil
+}
+
+// SwapPodSpec rewrites the image of every container in the pod spec that
+// hasn't been opted out through the pod annotations and returns the decision
+// taken for each container. It is shared by every handler that mutates pods
+// or pod templates. Each image is resolved for its container, so maps with
+// container criteria only swap the containers they select, and maps with
+// selectors only the pods whose labels they select. Images matched by maps
+// with a canary are left for pod admission when canaryKey is empty, as for
+// pod templates.
+func SwapPodSpec(mapStore *mapstore.MapStore, annotations map[string]string, labels mapstore.PodLabels, canaryKey string, spec *corev1.PodSpec) []audit.Container {
+	skipContainers := SkippedContainers(annotations)
+
+	containers := []audit.Container{}
+	pullSecrets := []string{}
+	swap := func(container *corev1.Container, kind mapsv1alpha1.ContainerKind) {
+		result, pullSecret := swapContainerImage(mapStore, container, kind, labels, canaryKey, skipContainers)
+		containers = append(containers, result)
+		if pullSecret != "" {
+			pullSecrets = append(pullSecrets, pullSecret)
+		}
+	}
+
+	for i := range spec.InitContainers {
+		swap(&spec.InitContainers[i], mapsv1alpha1.ContainerKindInit)
+	}
+	for i := range spec.Containers {
+		swap(&spec.Containers[i], mapsv1alpha1.ContainerKindRegular)
+	}
+	for i := range spec.EphemeralContainers {
+		swap((*corev1.Container)(&spec.EphemeralContainers[i].EphemeralContainerCommon), mapsv1alpha1.ContainerKindEphemeral)
+	}
+
+	addImagePullSecrets(spec, pullSecrets)
+	return containers
+}
+
+// addImagePullSecrets appends the named secrets to the pod spec unless already present
+func addImagePullSecrets(spec *corev1.PodSpec, names []string) {
+	for _, name := range names {
+		present := false
+		for _, ref := range spec.ImagePullSecrets {
+			if ref.Name == name {
+				present = true
+				break
+			}
+		}
+		if !present {
+			swapmaplog.Info("Adding image pull secret", "secret", name)
+			spec.ImagePullSecrets = append(spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+		}
+	}
+}
+
+// swapContainerImage rewrites the image of a single container unless it has
+// been opted out and returns the decision taken for it, along with the image
+// pull secret the swapped image needs, if any
+func swapContainerImage(mapStore *mapstore.MapStore, container *corev1.Container, kind mapsv1alpha1.ContainerKind, labels mapstore.PodLabels, canaryKey string, skipContainers map[string]bool) (audit.Container, string) {
+	result := audit.Container{
+		Name:          container.Name,
+		OriginalImage: container.Image,
+		FinalImage:    container.Image,
+	}
+
+	if skipContainers[container.Name] {
+		swapmaplog.V(1).Info("Skipping container", "container", container.Name, "annotation", SkipContainersAnnotation)
+		result.Action = audit.ContainerActionSkipped
+		return result, ""
+	}
+
+	resolved := mapstore.ContainerOf(container, kind)
+	resolved.Labels = labels
+	decision := mapStore.ResolveContainer(container.Image, canaryKey, resolved)
+	if decision.Canary != "" && canaryKey == "" {
+		// The pod's controller, and so its group, isn't known yet
+		swapmaplog.V(1).Info("Leaving canary map image for pod admission", "container", container.Name, "image", container.Image, "map", decision.MapKey)
+		result.Action = audit.ContainerActionSkipped
+		result.Map = decision.Map.Name
+		return result, ""
+	}
+	if decision.Swapped() && decision.AtTarget() {
+		// Swapped on an earlier admission or when the webhook is reinvoked
+		swapmaplog.V(1).Info("Image already swapped", "container", container.Name, "image", container.Image, "map", decision.MapKey)
+		result.Action = decision.Action
+		result.Map = decision.Map.Name
+		return result, pullSecret(decision)
+	}
+	metrics.RecordDecision(decision)
+	result.Action = decision.Action
+	result.AuditImage = decision.AuditImage
+	if decision.Map != nil {
+		result.Map = decision.Map.Name
+	}
+	if decision.Action == mapstore.ActionAudit {
+		swapmaplog.Info("Audit mode, not swapping image", "container", container.Name, "image", decision.Image, "auditImage", decision.AuditImage, "map", decision.MapKey)
+	}
+
+	if decision.Swapped() {
+		swapmaplog.Info("Swapping image", "container", container.Name, "image", decision.Image, "swappedImage", decision.SwappedImage, "map", decision.MapKey)
+		container.Image = decision.SwappedImage
+		result.FinalImage = decision.SwappedImage
+		return result, pullSecret(decision)
+	}
+	return result, ""
+}
+
+// pullSecret returns the image pull secret of the target the decision swapped to
+func pullSecret(decision mapstore.Decision) string {
+	if decision.Canary == mapstore.CanaryGroupCanary && mapstore.GetSwapTarget(decision.Map.Canary.SwapTo) != "" {
+		return decision.Map.Canary.SwapTo.ImagePullSecret
+	}
+	return decision.Map.SwapTo.ImagePullSecret
+}
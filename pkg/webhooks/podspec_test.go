@@ -0,0 +1,51 @@
+package webhooks
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+func TestSwapPodSpecPullSecrets(t *testing.T) {
+	tests := []struct {
+		name     string
+		images   []string
+		existing []corev1.LocalObjectReference
+		want     []corev1.LocalObjectReference
+	}{
+		{
+			name:   "added once for several swapped containers",
+			images: []string{"nginx:1.25", "busybox:1"},
+			want:   []corev1.LocalObjectReference{{Name: "harbor"}},
+		},
+		{
+			name:     "already listed",
+			images:   []string{"nginx:1.25"},
+			existing: []corev1.LocalObjectReference{{Name: "other"}, {Name: "harbor"}},
+			want:     []corev1.LocalObjectReference{{Name: "other"}, {Name: "harbor"}},
+		},
+		{
+			name:     "appended to the existing secrets",
+			images:   []string{"nginx:1.25"},
+			existing: []corev1.LocalObjectReference{{Name: "other"}},
+			want:     []corev1.LocalObjectReference{{Name: "other"}, {Name: "harbor"}},
+		},
+		{
+			name:   "not added when nothing is swapped",
+			images: []string{"ghcr.io/app:1"},
+		},
+	}
+
+	store := testMapStore()
+	for _, tt := range tests {
+		spec := testPod(nil, tt.images...).Spec
+		spec.ImagePullSecrets = tt.existing
+		SwapPodSpec(store, nil, mapstore.PodLabels{}, "apps/app", &spec)
+		if !reflect.DeepEqual(spec.ImagePullSecrets, tt.want) {
+			t.Errorf("%s: imagePullSecrets = %v, want %v", tt.name, spec.ImagePullSecrets, tt.want)
+		}
+	}
+}
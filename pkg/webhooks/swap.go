@@ -4,36 +4,103 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"time"
 
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"twr.dev/imgswap/pkg/audit"
+	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/metrics"
+)
+
+const (
+	// DisabledLabel is the namespace label that excludes a namespace from the webhook
+	DisabledLabel = "imgswap.io/disabled"
+	// SkipAnnotation is the pod annotation that, when "true", leaves all of the pod's images alone
+	SkipAnnotation = "imgswap.io/skip"
+	// SkipContainersAnnotation is a comma separated list of container names to leave alone
+	SkipContainersAnnotation = "imgswap.io/skip-containers"
 )
 
 // log is for logging in this package.
 var swapmaplog = logf.Log.WithName("pod-imgswap-webhook")
 
 type PodImageSwapper struct {
-	Client  client.Client
-	decoder *admission.Decoder
+	Client   client.Client
+	MapStore *mapstore.MapStore
+	// ManagerNamespace is the namespace the imgswap manager runs in. Its own
+	// pods are never mutated so a bad map can't stop the webhook coming back up.
+	ManagerNamespace string
+	// ManagerServiceAccount narrows the self-exclusion to pods running as the
+	// manager's service account. When empty the whole ManagerNamespace is excluded.
+	ManagerServiceAccount string
+	// Recorder emits Events about swapped pods. Events are skipped when nil.
+	Recorder record.EventRecorder
+	// AuditLogger receives one record per admission request. Auditing is skipped when nil.
+	AuditLogger *audit.Logger
+	decoder     *admission.Decoder
 }
 
-// +kubebuilder:webhook:path="/pod-imgswap",mutating=true,failurePolicy=fail,groups="",resources=pods,verbs=create;update,versions=v1,name=swap.imgswap.io
-func (pisw *PodImageSwapper) Handle(ctx context.Context, req admission.Request) admission.Response {
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// +kubebuilder:webhook:path="/pod-imgswap",mutating=true,failurePolicy=fail,sideEffects=None,reinvocationPolicy=IfNeeded,groups="",resources=pods,verbs=create,versions=v1,name=swap.imgswap.io,admissionReviewVersions=v1
+
+// Handle swaps the images of an admitted pod
+func (pisw *PodImageSwapper) Handle(ctx context.Context, req admission.Request) (resp admission.Response) {
+	start := time.Now()
+	auditRecord := newAuditRecord(req)
+	defer func() {
+		metrics.ObserveAdmission("pod-imgswap", start, resp)
+		pisw.AuditLogger.Log(finishAuditRecord(auditRecord, resp))
+	}()
+
+	// Only the images of a running pod can change, so adding image pull
+	// secrets on update would get the whole update rejected
+	if req.Operation != admissionv1.Create {
+		auditRecord.Action, auditRecord.Reason = audit.ActionSkipped, "pods are only swapped when created"
+		return admission.Allowed("pods are only swapped when created")
+	}
+
 	pod := &corev1.Pod{}
 	err := pisw.decoder.Decode(req, pod)
 	if err != nil {
 		return admission.Errored(http.StatusBadRequest, err)
 	}
+	auditRecord.Name = objectName(pod)
+	auditRecord.Owner = ownerName(pod)
+
+	if IsManager(pisw.ManagerNamespace, pisw.ManagerServiceAccount, req.Namespace, &pod.Spec) {
+		swapmaplog.Info("Skipping imgswap manager pod", "name", pod.Name, "namespace", req.Namespace)
+		auditRecord.Action, auditRecord.Reason = audit.ActionSkipped, "imgswap manager pod"
+		return admission.Allowed("imgswap manager pods are never mutated")
+	}
+
+	if PodSkipped(pod.Annotations) {
+		swapmaplog.Info("Skipping pod", "name", pod.Name, "namespace", req.Namespace, "annotation", SkipAnnotation)
+		auditRecord.Action, auditRecord.Reason = audit.ActionSkipped, SkipAnnotation+" annotation"
+		return admission.Allowed("pod opted out of image swapping")
+	}
 
 	// mutate the fields in pod
-	swapmaplog.Info("Mutating pod", "name", pod.Name)
+	swapmaplog.Info("Mutating pod", "name", pod.Name, "namespace", req.Namespace)
+
+	labels, err := podLabels(ctx, pisw.Client, pisw.MapStore, req.Namespace, pod.Labels)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	auditRecord.Containers = SwapPodSpec(pisw.MapStore, pod.Annotations, labels, CanaryKey(pod), &pod.Spec)
 
 	marshaledPod, err := json.Marshal(pod)
 	if err != nil {
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
+
+	recordSwapped(pisw.Recorder, req, pod, auditRecord.Containers)
 	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
 }
 
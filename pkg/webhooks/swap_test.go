@@ -0,0 +1,238 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	mapsv1alpha1 "twr.dev/imgswap/api/v1alpha1"
+	"twr.dev/imgswap/pkg/mapstore"
+)
+
+// testMapStore returns a MapStore swapping docker.io images to a harbor mirror
+// and quay.io images to a mirror, or a new registry for canary pods
+func testMapStore() *mapstore.MapStore {
+	store := mapstore.NewMapStore()
+	store.LoadSource("test", 0, 1, false, map[string]*mapsv1alpha1.Map{
+		"docker.io": {
+			Name:     "docker",
+			Type:     "swap",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "docker.io"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "harbor.example.com", Project: "dockerhub", ImagePullSecret: "harbor"},
+		},
+		"quay.io": {
+			Name:     "quay",
+			Type:     "swap",
+			SwapFrom: mapsv1alpha1.SwapRef{Registry: "quay.io"},
+			SwapTo:   mapsv1alpha1.SwapRef{Registry: "quay.example.com"},
+			Canary:   &mapsv1alpha1.Canary{Percent: 50, SwapTo: mapsv1alpha1.SwapRef{Registry: "canary.example.com"}},
+		},
+	})
+	return store
+}
+
+// admissionRequest returns an admission request for the object
+func admissionRequest(t *testing.T, operation admissionv1.Operation, kind metav1.GroupVersionKind, namespace string, obj runtime.Object) admission.Request {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("marshalling %s: %v", kind.Kind, err)
+	}
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: operation,
+		Kind:      kind,
+		Namespace: namespace,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+// patchedValues returns the values set by the response's patches, keyed by path
+func patchedValues(t *testing.T, resp admission.Response) map[string]interface{} {
+	if !resp.Allowed {
+		t.Fatalf("request denied: %v", resp.Result)
+	}
+	values := map[string]interface{}{}
+	for _, patch := range resp.Patches {
+		values[patch.Path] = patch.Value
+	}
+	return values
+}
+
+func testPod(annotations map[string]string, images ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps", Annotations: annotations},
+		Spec:       corev1.PodSpec{ServiceAccountName: "default"},
+	}
+	for i, image := range images {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: []string{"app", "sidecar"}[i], Image: image})
+	}
+	return pod
+}
+
+func TestPodImageSwapper(t *testing.T) {
+	podKind := metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	manager := testPod(nil, "nginx:1.25")
+	manager.Namespace = "imgswap-system"
+	manager.Spec.ServiceAccountName = "imgswap-controller-manager"
+
+	tests := []struct {
+		name      string
+		operation admissionv1.Operation
+		pod       *corev1.Pod
+		want      map[string]interface{}
+	}{
+		{
+			name:      "swapped",
+			operation: admissionv1.Create,
+			pod:       testPod(nil, "nginx:1.25"),
+			want: map[string]interface{}{
+				"/spec/containers/0/image": "harbor.example.com/dockerhub/nginx:1.25",
+				"/spec/imagePullSecrets":   []interface{}{map[string]interface{}{"name": "harbor"}},
+			},
+		},
+		{
+			name:      "skip annotation",
+			operation: admissionv1.Create,
+			pod:       testPod(map[string]string{SkipAnnotation: "true"}, "nginx:1.25"),
+			want:      map[string]interface{}{},
+		},
+		{
+			name:      "skip annotation not true",
+			operation: admissionv1.Create,
+			pod:       testPod(map[string]string{SkipAnnotation: "false"}, "nginx:1.25"),
+			want: map[string]interface{}{
+				"/spec/containers/0/image": "harbor.example.com/dockerhub/nginx:1.25",
+				"/spec/imagePullSecrets":   []interface{}{map[string]interface{}{"name": "harbor"}},
+			},
+		},
+		{
+			name:      "skip containers annotation",
+			operation: admissionv1.Create,
+			pod:       testPod(map[string]string{SkipContainersAnnotation: " app ,other"}, "nginx:1.25", "busybox:1"),
+			want: map[string]interface{}{
+				"/spec/containers/1/image": "harbor.example.com/dockerhub/busybox:1",
+				"/spec/imagePullSecrets":   []interface{}{map[string]interface{}{"name": "harbor"}},
+			},
+		},
+		{
+			name:      "manager pod",
+			operation: admissionv1.Create,
+			pod:       manager,
+			want:      map[string]interface{}{},
+		},
+		{
+			name:      "already at target",
+			operation: admissionv1.Create,
+			pod: func() *corev1.Pod {
+				pod := testPod(nil, "harbor.example.com/dockerhub/nginx:1.25")
+				pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "harbor"}}
+				return pod
+			}(),
+			want: map[string]interface{}{},
+		},
+		{
+			name:      "update",
+			operation: admissionv1.Update,
+			pod:       testPod(nil, "nginx:1.25"),
+			want:      map[string]interface{}{},
+		},
+	}
+
+	swapper := &PodImageSwapper{
+		MapStore:              testMapStore(),
+		ManagerNamespace:      "imgswap-system",
+		ManagerServiceAccount: "imgswap-controller-manager",
+	}
+	if err := swapper.InjectDecoder(admission.NewDecoder(clientgoscheme.Scheme)); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		resp := swapper.Handle(context.Background(), admissionRequest(t, tt.operation, podKind, tt.pod.Namespace, tt.pod))
+		if got := patchedValues(t, resp); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: patched %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPodImageSwapperSelectors(t *testing.T) {
+	podKind := metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	store := mapstore.NewMapStore()
+	store.LoadSource("test", 0, 1, false, map[string]*mapsv1alpha1.Map{
+		"docker.io": {
+			Name:              "docker",
+			Type:              "swap",
+			SwapFrom:          mapsv1alpha1.SwapRef{Registry: "docker.io"},
+			SwapTo:            mapsv1alpha1.SwapRef{Registry: "harbor.example.com"},
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "web"}},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "shop"}},
+		},
+	})
+	swapper := &PodImageSwapper{
+		Client: fake.NewClientBuilder().WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps", Labels: map[string]string{"team": "web"}}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "data", Labels: map[string]string{"team": "data"}}},
+		).Build(),
+		MapStore: store,
+	}
+	if err := swapper.InjectDecoder(admission.NewDecoder(clientgoscheme.Scheme)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		labels    map[string]string
+		want      map[string]interface{}
+	}{
+		{"selected", "apps", map[string]string{"app": "shop"}, map[string]interface{}{"/spec/containers/0/image": "harbor.example.com/nginx:1.25"}},
+		{"other pod", "apps", map[string]string{"app": "blog"}, map[string]interface{}{}},
+		{"other namespace", "data", map[string]string{"app": "shop"}, map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		pod := testPod(nil, "nginx:1.25")
+		pod.Namespace, pod.Labels = tt.namespace, tt.labels
+		resp := swapper.Handle(context.Background(), admissionRequest(t, admissionv1.Create, podKind, tt.namespace, pod))
+		if got := patchedValues(t, resp); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: patched %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The namespace has to be known for the namespace selector to be checked
+	resp := swapper.Handle(context.Background(), admissionRequest(t, admissionv1.Create, podKind, "missing", testPod(nil, "nginx:1.25")))
+	if resp.Allowed {
+		t.Errorf("allowed a pod in a namespace that couldn't be looked up")
+	}
+}
+
+func TestIsManager(t *testing.T) {
+	spec := &corev1.PodSpec{ServiceAccountName: "imgswap-controller-manager"}
+	other := &corev1.PodSpec{ServiceAccountName: "default"}
+
+	tests := []struct {
+		name                             string
+		managerNamespace, serviceAccount string
+		namespace                        string
+		spec                             *corev1.PodSpec
+		want                             bool
+	}{
+		{"manager", "imgswap-system", "imgswap-controller-manager", "imgswap-system", spec, true},
+		{"other service account", "imgswap-system", "imgswap-controller-manager", "imgswap-system", other, false},
+		{"other namespace", "imgswap-system", "imgswap-controller-manager", "apps", spec, false},
+		{"whole namespace", "imgswap-system", "", "imgswap-system", other, true},
+		{"no manager namespace", "", "", "", other, false},
+	}
+	for _, tt := range tests {
+		if got := IsManager(tt.managerNamespace, tt.serviceAccount, tt.namespace, tt.spec); got != tt.want {
+			t.Errorf("%s: IsManager = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"twr.dev/imgswap/pkg/audit"
+	"twr.dev/imgswap/pkg/mapstore"
+	"twr.dev/imgswap/pkg/metrics"
+)
+
+// WorkloadImageSwapper swaps the images in the pod templates of Deployments,
+// StatefulSets, DaemonSets, Jobs and CronJobs so the stored workload matches
+// the images its pods will run. Pods are still swapped by PodImageSwapper
+// at admission, so this webhook fails open.
+type WorkloadImageSwapper struct {
+	Client   client.Client
+	MapStore *mapstore.MapStore
+	// ManagerNamespace and ManagerServiceAccount identify the imgswap manager's
+	// own workloads, which are never mutated. See PodImageSwapper.
+	ManagerNamespace      string
+	ManagerServiceAccount string
+	// Recorder emits Events about swapped workloads. Events are skipped when nil.
+	Recorder record.EventRecorder
+	// AuditLogger receives one record per admission request. Auditing is skipped when nil.
+	AuditLogger *audit.Logger
+	decoder     *admission.Decoder
+}
+
+// +kubebuilder:webhook:path="/workload-imgswap",mutating=true,failurePolicy=ignore,sideEffects=None,reinvocationPolicy=Never,groups=apps;batch,resources=deployments;statefulsets;daemonsets;jobs;cronjobs,verbs=create;update,versions=v1,name=workloads.swap.imgswap.io,admissionReviewVersions=v1
+
+// Handle swaps the images in the pod template of an admitted workload
+func (wisw *WorkloadImageSwapper) Handle(ctx context.Context, req admission.Request) (resp admission.Response) {
+	start := time.Now()
+	auditRecord := newAuditRecord(req)
+	defer func() {
+		metrics.ObserveAdmission("workload-imgswap", start, resp)
+		wisw.AuditLogger.Log(finishAuditRecord(auditRecord, resp))
+	}()
+
+	// A Job's pod template is immutable once created, so any patch to it on
+	// update would get the whole update rejected
+	if req.Kind.Kind == "Job" && req.Operation == admissionv1.Update {
+		auditRecord.Action, auditRecord.Reason = audit.ActionSkipped, "job pod template is immutable"
+		return admission.Allowed("job pod templates can't be changed after creation")
+	}
+
+	obj, template, err := wisw.decodeWorkload(req)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	auditRecord.Name = objectName(obj)
+	auditRecord.Owner = ownerName(obj)
+
+	if IsManager(wisw.ManagerNamespace, wisw.ManagerServiceAccount, req.Namespace, &template.Spec) {
+		swapmaplog.Info("Skipping imgswap manager workload", "kind", req.Kind.Kind, "name", obj.GetName(), "namespace", req.Namespace)
+		auditRecord.Action, auditRecord.Reason = audit.ActionSkipped, "imgswap manager workload"
+		return admission.Allowed("imgswap manager workloads are never mutated")
+	}
+
+	// Annotations on the pod template win over those on the workload itself
+	annotations := map[string]string{}
+	for k, v := range obj.GetAnnotations() {
+		annotations[k] = v
+	}
+	for k, v := range template.Annotations {
+		annotations[k] = v
+	}
+
+	if PodSkipped(annotations) {
+		swapmaplog.Info("Skipping workload", "kind", req.Kind.Kind, "name", obj.GetName(), "namespace", req.Namespace, "annotation", SkipAnnotation)
+		auditRecord.Action, auditRecord.Reason = audit.ActionSkipped, SkipAnnotation+" annotation"
+		return admission.Allowed("workload opted out of image swapping")
+	}
+
+	swapmaplog.Info("Mutating workload", "kind", req.Kind.Kind, "name", obj.GetName(), "namespace", req.Namespace)
+
+	labels, err := podLabels(ctx, wisw.Client, wisw.MapStore, req.Namespace, template.Labels)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	auditRecord.Containers = SwapPodSpec(wisw.MapStore, annotations, labels, "", &template.Spec)
+
+	marshaledObj, err := json.Marshal(obj)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	recordSwapped(wisw.Recorder, req, obj, auditRecord.Containers)
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledObj)
+}
+
+// decodeWorkload decodes the workload in the request and returns it along
+// with a pointer to its pod template
+func (wisw *WorkloadImageSwapper) decodeWorkload(req admission.Request) (client.Object, *corev1.PodTemplateSpec, error) {
+	switch req.Kind.Kind {
+	case "Deployment":
+		deployment := &appsv1.Deployment{}
+		return deployment, &deployment.Spec.Template, wisw.decoder.Decode(req, deployment)
+	case "StatefulSet":
+		statefulSet := &appsv1.StatefulSet{}
+		return statefulSet, &statefulSet.Spec.Template, wisw.decoder.Decode(req, statefulSet)
+	case "DaemonSet":
+		daemonSet := &appsv1.DaemonSet{}
+		return daemonSet, &daemonSet.Spec.Template, wisw.decoder.Decode(req, daemonSet)
+	case "Job":
+		job := &batchv1.Job{}
+		return job, &job.Spec.Template, wisw.decoder.Decode(req, job)
+	case "CronJob":
+		cronJob := &batchv1.CronJob{}
+		return cronJob, &cronJob.Spec.JobTemplate.Spec.Template, wisw.decoder.Decode(req, cronJob)
+	default:
+		return nil, nil, fmt.Errorf("unsupported workload kind %q", req.Kind.Kind)
+	}
+}
+
+func (wisw *WorkloadImageSwapper) InjectDecoder(d *admission.Decoder) error {
+	wisw.decoder = d
+	return nil
+}
@@ -0,0 +1,93 @@
+package webhooks
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestWorkloadImageSwapper(t *testing.T) {
+	template := func(images ...string) corev1.PodTemplateSpec {
+		return corev1.PodTemplateSpec{Spec: testPod(nil, images...).Spec}
+	}
+	deploymentKind := metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	jobKind := metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}
+
+	tests := []struct {
+		name      string
+		operation admissionv1.Operation
+		kind      metav1.GroupVersionKind
+		obj       runtime.Object
+		want      map[string]interface{}
+	}{
+		{
+			name:      "deployment",
+			operation: admissionv1.Create,
+			kind:      deploymentKind,
+			obj:       &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}, Spec: appsv1.DeploymentSpec{Template: template("nginx:1.25")}},
+			want: map[string]interface{}{
+				"/spec/template/spec/containers/0/image": "harbor.example.com/dockerhub/nginx:1.25",
+				"/spec/template/spec/imagePullSecrets":   []interface{}{map[string]interface{}{"name": "harbor"}},
+			},
+		},
+		{
+			// The pod's group depends on its ReplicaSet, so canary maps are left for pod admission
+			name:      "canary map deferred",
+			operation: admissionv1.Create,
+			kind:      deploymentKind,
+			obj:       &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}, Spec: appsv1.DeploymentSpec{Template: template("quay.io/app:1", "nginx:1.25")}},
+			want: map[string]interface{}{
+				"/spec/template/spec/containers/1/image": "harbor.example.com/dockerhub/nginx:1.25",
+				"/spec/template/spec/imagePullSecrets":   []interface{}{map[string]interface{}{"name": "harbor"}},
+			},
+		},
+		{
+			name:      "template skip annotation",
+			operation: admissionv1.Create,
+			kind:      deploymentKind,
+			obj: func() runtime.Object {
+				deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}, Spec: appsv1.DeploymentSpec{Template: template("nginx:1.25")}}
+				deployment.Spec.Template.Annotations = map[string]string{SkipAnnotation: "true"}
+				return deployment
+			}(),
+			want: map[string]interface{}{},
+		},
+		{
+			name:      "job create",
+			operation: admissionv1.Create,
+			kind:      jobKind,
+			obj:       &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: "apps"}, Spec: batchv1.JobSpec{Template: template("nginx:1.25")}},
+			want: map[string]interface{}{
+				"/spec/template/spec/containers/0/image": "harbor.example.com/dockerhub/nginx:1.25",
+				"/spec/template/spec/imagePullSecrets":   []interface{}{map[string]interface{}{"name": "harbor"}},
+			},
+		},
+		{
+			name:      "job update",
+			operation: admissionv1.Update,
+			kind:      jobKind,
+			obj:       &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: "apps"}, Spec: batchv1.JobSpec{Template: template("nginx:1.25")}},
+			want:      map[string]interface{}{},
+		},
+	}
+
+	swapper := &WorkloadImageSwapper{MapStore: testMapStore()}
+	if err := swapper.InjectDecoder(admission.NewDecoder(clientgoscheme.Scheme)); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		resp := swapper.Handle(context.Background(), admissionRequest(t, tt.operation, tt.kind, "apps", tt.obj))
+		if got := patchedValues(t, resp); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: patched %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}